@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	eventEmployeeAdded        = "employee.added"
+	eventEmployeeRemoved      = "employee.removed"
+	eventEmployeeRenamed      = "employee.renamed"
+	eventEmployeeMoved        = "employee.moved"
+	eventReportingLineChanged = "reportingLine.changed"
+	eventTeamAdded            = "team.added"
+	eventTeamRemoved          = "team.removed"
+	eventTeamRenamed          = "team.renamed"
+	eventTeamReparented       = "team.reparented"
+	eventLeadChanged          = "lead.changed"
+	eventVacanciesChanged     = "vacancies.changed"
+)
+
+// chartEvent is a change between two revisions of the org chart as people think of it, an
+// employee or team id along with what happened to it. From and to hold team ids for moves,
+// names for renames, employee ids for leads and counts for vacancies. Added teams come with
+// their leads and vacancies rather than a change of each per stream, and removed teams with
+// the vacancies they had.
+type chartEvent struct {
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Team   string `json:"team,omitempty"`
+	Stream string `json:"stream,omitempty"`
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+	// FromAncestry and ToAncestry are the paths of a reparented team from the top level
+	FromAncestry string `json:"fromAncestry,omitempty"`
+	ToAncestry   string `json:"toAncestry,omitempty"`
+	// Delta is the change in the number of vacancies
+	Delta int `json:"delta,omitempty"`
+	// Leads are the leads of an added team by stream
+	Leads map[string]string `json:"leads,omitempty"`
+	// Vacancies are the vacancies of an added or removed team by stream
+	Vacancies map[string]int `json:"vacancies,omitempty"`
+}
+
+func (e chartEvent) String() string {
+	switch e.Type {
+	case eventEmployeeAdded, eventEmployeeRemoved:
+		return fmt.Sprintf("%s %s (%s) in %s", e.Type, e.ID, e.Name, e.Team)
+	case eventTeamAdded:
+		return fmt.Sprintf("%s %s (%s): %q%s%s", e.Type, e.ID, e.Name, e.To, e.leadsString(strconv.Quote), e.vacanciesString())
+	case eventTeamRemoved:
+		return fmt.Sprintf("%s %s (%s): %q%s", e.Type, e.ID, e.Name, e.From, e.vacanciesString())
+	case eventTeamReparented:
+		return fmt.Sprintf("%s %s (%s): %q -> %q", e.Type, e.ID, e.Name, e.FromAncestry, e.ToAncestry)
+	case eventLeadChanged:
+		return fmt.Sprintf("%s %s (%s) %s: %q -> %q", e.Type, e.ID, e.Name, e.Stream, e.From, e.To)
+	case eventVacanciesChanged:
+		return fmt.Sprintf("%s %s (%s) %s: %s -> %s (%+d)", e.Type, e.ID, e.Name, e.Stream, e.From, e.To, e.Delta)
+	default:
+		return fmt.Sprintf("%s %s (%s): %q -> %q", e.Type, e.ID, e.Name, e.From, e.To)
+	}
+}
+
+// teamLeads returns the lead of each stream of a team
+func teamLeads(t *Team) map[string]string {
+	return map[string]string{
+		"engineering": t.TeachLeadID,
+		"product":     t.ProductLeadID,
+	}
+}
+
+var leadStreams = []string{"engineering", "product"}
+
+// presentLeads returns the leads of a team, leaving out streams without one
+func presentLeads(t *Team) map[string]string {
+	leads := map[string]string{}
+
+	for stream, id := range teamLeads(t) {
+		if id != "" {
+			leads[stream] = id
+		}
+	}
+
+	return leads
+}
+
+// presentVacancies returns the vacancies of a team, leaving out streams without any
+func presentVacancies(t *Team) map[string]int {
+	vacancies := map[string]int{}
+
+	for stream, count := range t.Vacancies {
+		if count != 0 {
+			vacancies[stream] = count
+		}
+	}
+
+	return vacancies
+}
+
+// leadsString describes the leads of an added team, formatting their ids with code
+func (e chartEvent) leadsString(code func(string) string) string {
+	leads := []string{}
+
+	for _, stream := range leadStreams {
+		if id, ok := e.Leads[stream]; ok {
+			leads = append(leads, stream+" "+code(id))
+		}
+	}
+
+	if len(leads) == 0 {
+		return ""
+	}
+
+	return ", led by " + strings.Join(leads, " and ")
+}
+
+// vacanciesString describes the vacancies of an added or removed team
+func (e chartEvent) vacanciesString() string {
+	vacancies := []string{}
+
+	for _, stream := range vacancyStreams(e.Vacancies, nil) {
+		vacancies = append(vacancies, fmt.Sprintf("%d %s", e.Vacancies[stream], stream))
+	}
+
+	if len(vacancies) == 0 {
+		return ""
+	}
+
+	return ", vacancies " + strings.Join(vacancies, " and ")
+}
+
+// diffOrgCharts returns the events turning one revision of the chart into another, employees
+// before teams and each ordered by id
+func diffOrgCharts(from, to *OrgChart) []chartEvent {
+
+	events := []chartEvent{}
+
+	for _, e := range sortedEmployees(to) {
+		previous, ok := from.EmployeesByID[e.ID]
+
+		if !ok {
+			events = append(events, chartEvent{Type: eventEmployeeAdded, ID: e.ID, Name: e.Name, Team: e.MemberOf})
+			continue
+		}
+
+		if previous.Name != e.Name {
+			events = append(events, chartEvent{Type: eventEmployeeRenamed, ID: e.ID, Name: e.Name, From: previous.Name, To: e.Name})
+		}
+
+		if previous.MemberOf != e.MemberOf {
+			events = append(events, chartEvent{Type: eventEmployeeMoved, ID: e.ID, Name: e.Name, From: previous.MemberOf, To: e.MemberOf})
+		}
+
+		if line, previousLine := to.reportingLine(e), from.reportingLine(previous); line != previousLine {
+			events = append(events, chartEvent{Type: eventReportingLineChanged, ID: e.ID, Name: e.Name, From: previousLine, To: line})
+		}
+	}
+
+	for _, e := range sortedEmployees(from) {
+		if _, ok := to.EmployeesByID[e.ID]; !ok {
+			events = append(events, chartEvent{Type: eventEmployeeRemoved, ID: e.ID, Name: e.Name, Team: e.MemberOf})
+		}
+	}
+
+	for _, t := range sortedTeams(to) {
+		previous, ok := from.TeamsByID[t.ID]
+
+		if !ok {
+			events = append(events, chartEvent{Type: eventTeamAdded, ID: t.ID, Name: t.Name, To: t.ParentID, Leads: presentLeads(t), Vacancies: presentVacancies(t)})
+			continue
+		}
+
+		if previous.Name != t.Name {
+			events = append(events, chartEvent{Type: eventTeamRenamed, ID: t.ID, Name: t.Name, From: previous.Name, To: t.Name})
+		}
+
+		if previous.ParentID != t.ParentID {
+			events = append(events, chartEvent{
+				Type:         eventTeamReparented,
+				ID:           t.ID,
+				Name:         t.Name,
+				From:         previous.ParentID,
+				To:           t.ParentID,
+				FromAncestry: from.teamAncestryString(previous, true),
+				ToAncestry:   to.teamAncestryString(t, true),
+			})
+		}
+
+		leads, previousLeads := teamLeads(t), teamLeads(previous)
+
+		for _, stream := range leadStreams {
+			if leads[stream] != previousLeads[stream] {
+				events = append(events, chartEvent{Type: eventLeadChanged, ID: t.ID, Name: t.Name, Stream: stream, From: previousLeads[stream], To: leads[stream]})
+			}
+		}
+
+		for _, stream := range vacancyStreams(t.Vacancies, previous.Vacancies) {
+			if t.Vacancies[stream] != previous.Vacancies[stream] {
+				events = append(events, chartEvent{
+					Type:   eventVacanciesChanged,
+					ID:     t.ID,
+					Name:   t.Name,
+					Stream: stream,
+					From:   strconv.Itoa(previous.Vacancies[stream]),
+					To:     strconv.Itoa(t.Vacancies[stream]),
+					Delta:  t.Vacancies[stream] - previous.Vacancies[stream],
+				})
+			}
+		}
+	}
+
+	for _, t := range sortedTeams(from) {
+		if _, ok := to.TeamsByID[t.ID]; !ok {
+			events = append(events, chartEvent{Type: eventTeamRemoved, ID: t.ID, Name: t.Name, From: t.ParentID, Vacancies: presentVacancies(t)})
+		}
+	}
+
+	return events
+}
+
+func sortedEmployees(chart *OrgChart) []*Employee {
+	employees := append([]*Employee{}, chart.Employees...)
+
+	sort.Slice(employees, func(i, j int) bool {
+		return employees[i].ID < employees[j].ID
+	})
+
+	return employees
+}
+
+func sortedTeams(chart *OrgChart) []*Team {
+	teams := append([]*Team{}, chart.Teams...)
+
+	sort.Slice(teams, func(i, j int) bool {
+		return teams[i].ID < teams[j].ID
+	})
+
+	return teams
+}
+
+// vacancyStreams returns the streams with vacancies in either revision of a team, in order
+func vacancyStreams(a, b map[string]int) []string {
+	streams := []string{}
+
+	for stream := range a {
+		streams = append(streams, stream)
+	}
+
+	for stream := range b {
+		if _, ok := a[stream]; !ok {
+			streams = append(streams, stream)
+		}
+	}
+
+	sort.Strings(streams)
+
+	return streams
+}
+
+// chartEventTitles orders the sections of a markdown diff
+var chartEventTitles = []struct {
+	event string
+	title string
+}{
+	{eventEmployeeAdded, "Employees added"},
+	{eventEmployeeRemoved, "Employees removed"},
+	{eventEmployeeRenamed, "Employees renamed"},
+	{eventEmployeeMoved, "Employees moved"},
+	{eventReportingLineChanged, "Reporting lines changed"},
+	{eventTeamAdded, "Teams added"},
+	{eventTeamRemoved, "Teams removed"},
+	{eventTeamRenamed, "Teams renamed"},
+	{eventTeamReparented, "Teams moved"},
+	{eventLeadChanged, "Leads changed"},
+	{eventVacanciesChanged, "Vacancies changed"},
+}
+
+func markdownCode(s string) string {
+	if s == "" {
+		return "_none_"
+	}
+	return "`" + s + "`"
+}
+
+func (e chartEvent) markdown() string {
+	subject := fmt.Sprintf("**%s** (%s)", e.Name, markdownCode(e.ID))
+
+	switch e.Type {
+	case eventEmployeeAdded, eventEmployeeRemoved:
+		return fmt.Sprintf("%s in %s", subject, markdownCode(e.Team))
+	case eventTeamAdded:
+		return fmt.Sprintf("%s under %s%s%s", subject, markdownCode(e.To), e.leadsString(markdownCode), e.vacanciesString())
+	case eventTeamRemoved:
+		return fmt.Sprintf("%s from under %s%s", subject, markdownCode(e.From), e.vacanciesString())
+	case eventEmployeeRenamed, eventTeamRenamed:
+		return fmt.Sprintf("%s: %s → %s", markdownCode(e.ID), e.From, e.To)
+	case eventTeamReparented:
+		return fmt.Sprintf("%s: %s → %s", subject, markdownCode(e.FromAncestry), markdownCode(e.ToAncestry))
+	case eventLeadChanged:
+		return fmt.Sprintf("%s %s: %s → %s", subject, e.Stream, markdownCode(e.From), markdownCode(e.To))
+	case eventVacanciesChanged:
+		return fmt.Sprintf("%s %s: %s → %s (%+d)", subject, e.Stream, e.From, e.To, e.Delta)
+	default:
+		return fmt.Sprintf("%s: %s → %s", subject, markdownCode(e.From), markdownCode(e.To))
+	}
+}
+
+// writeChartDiff writes the events between two sources of the chart as text, markdown or json
+func writeChartDiff(w io.Writer, format, from, to string, events []chartEvent) error {
+
+	switch format {
+	case "text":
+		for _, e := range events {
+			if _, err := fmt.Fprintln(w, e); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	case "markdown":
+		fmt.Fprintf(w, "# Org chart changes\n\nFrom %s to %s\n", markdownCode(from), markdownCode(to))
+
+		if len(events) == 0 {
+			_, err := fmt.Fprint(w, "\nNo changes.\n")
+			return err
+		}
+
+		for _, section := range chartEventTitles {
+			written := false
+
+			for _, e := range events {
+				if e.Type != section.event {
+					continue
+				}
+
+				if !written {
+					fmt.Fprintf(w, "\n## %s\n\n", section.title)
+					written = true
+				}
+
+				if _, err := fmt.Fprintf(w, "- %s\n", e.markdown()); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+
+		return encoder.Encode(struct {
+			From   string       `json:"from"`
+			To     string       `json:"to"`
+			Events []chartEvent `json:"events"`
+		}{from, to, events})
+	default:
+		return errors.Errorf("invalid format %s, expected text, markdown or json", format)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func diffTestChart(t *testing.T, teams []*Team, employees []*Employee) *OrgChart {
+	chart := &OrgChart{Teams: teams, Employees: employees}
+
+	if err := chart.organise(); err != nil {
+		t.Fatal(err)
+	}
+
+	return chart
+}
+
+func TestDiffOrgChartsFoldsLeadsAndVacanciesIntoAddedAndRemovedTeams(t *testing.T) {
+	from := diffTestChart(t,
+		[]*Team{
+			{ID: "tribe", Name: "Tribe"},
+			{ID: "gone", Name: "Gone", ParentID: "tribe", Vacancies: map[string]int{"product": 1, "engineering": 0}},
+		},
+		[]*Employee{{ID: "alice", Name: "Alice", MemberOf: "tribe"}},
+	)
+
+	to := diffTestChart(t,
+		[]*Team{
+			{ID: "tribe", Name: "Tribe", TeachLeadID: "alice", Vacancies: map[string]int{"engineering": 1}},
+			{ID: "squad", Name: "Squad", ParentID: "tribe", TeachLeadID: "bob", Vacancies: map[string]int{"engineering": 2}},
+		},
+		[]*Employee{
+			{ID: "alice", Name: "Alice", MemberOf: "tribe"},
+			{ID: "bob", Name: "Bob", MemberOf: "squad"},
+		},
+	)
+
+	events := diffOrgCharts(from, to)
+
+	expected := []chartEvent{
+		{Type: eventEmployeeAdded, ID: "bob", Name: "Bob", Team: "squad"},
+		{Type: eventTeamAdded, ID: "squad", Name: "Squad", To: "tribe", Leads: map[string]string{"engineering": "bob"}, Vacancies: map[string]int{"engineering": 2}},
+		{Type: eventLeadChanged, ID: "tribe", Name: "Tribe", Stream: "engineering", To: "alice"},
+		{Type: eventVacanciesChanged, ID: "tribe", Name: "Tribe", Stream: "engineering", From: "0", To: "1", Delta: 1},
+		{Type: eventTeamRemoved, ID: "gone", Name: "Gone", From: "tribe", Vacancies: map[string]int{"product": 1}},
+	}
+
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("unexpected events\n%v\nexpected\n%v", events, expected)
+	}
+
+	if got := events[1].markdown(); got != "**Squad** (`squad`) under `tribe`, led by engineering `bob`, vacancies 2 engineering" {
+		t.Errorf("unexpected markdown %s", got)
+	}
+
+	if got := events[4].String(); got != `team.removed gone (Gone): "tribe", vacancies 1 product` {
+		t.Errorf("unexpected text %s", got)
+	}
+}
+
+func diffTestMoves(t *testing.T) (*OrgChart, *OrgChart) {
+	employees := func() []*Employee {
+		return []*Employee{
+			{ID: ROOT_EMPLOYEE, Name: "Damon", MemberOf: "tribe"},
+			{ID: "alice", Name: "Alice", MemberOf: "tribe", Stream: "ENGINEERING"},
+			{ID: "bob", Name: "Bob", MemberOf: "squad", Stream: "ENGINEERING"},
+			{ID: "carol", Name: "Carol", MemberOf: "squad", Stream: "ENGINEERING"},
+			{ID: "dave", Name: "Dave", MemberOf: "other", Stream: "ENGINEERING"},
+		}
+	}
+
+	fromEmployees := append(employees(), &Employee{ID: "erin", Name: "Erin", MemberOf: "squad", Stream: "ENGINEERING"})
+
+	from := diffTestChart(t,
+		[]*Team{
+			{ID: "tribe", Name: "Tribe", TeachLeadID: "alice"},
+			{ID: "other", Name: "Other", TeachLeadID: "dave"},
+			{ID: "squad", Name: "Squad", ParentID: "tribe", TeachLeadID: "bob"},
+		},
+		fromEmployees,
+	)
+
+	toEmployees := employees()
+	toEmployees[3].MemberOf = "other"
+
+	to := diffTestChart(t,
+		[]*Team{
+			{ID: "tribe", Name: "Tribe", TeachLeadID: "alice"},
+			{ID: "other", Name: "Other", TeachLeadID: "dave"},
+			{ID: "squad", Name: "Squad", ParentID: "other", TeachLeadID: "bob"},
+		},
+		toEmployees,
+	)
+
+	return from, to
+}
+
+func TestDiffOrgChartsMovesReportingLinesAndRemovals(t *testing.T) {
+	events := diffOrgCharts(diffTestMoves(t))
+
+	expected := []chartEvent{
+		{Type: eventReportingLineChanged, ID: "bob", Name: "Bob", From: ROOT_EMPLOYEE + "::alice", To: ROOT_EMPLOYEE + "::dave"},
+		{Type: eventEmployeeMoved, ID: "carol", Name: "Carol", From: "squad", To: "other"},
+		{Type: eventReportingLineChanged, ID: "carol", Name: "Carol", From: ROOT_EMPLOYEE + "::alice::bob", To: ROOT_EMPLOYEE + "::dave"},
+		{Type: eventEmployeeRemoved, ID: "erin", Name: "Erin", Team: "squad"},
+		{Type: eventTeamReparented, ID: "squad", Name: "Squad", From: "tribe", To: "other", FromAncestry: "tribe::squad", ToAncestry: "other::squad"},
+	}
+
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("unexpected events\n%v\nexpected\n%v", events, expected)
+	}
+}
+
+func TestWriteChartDiff(t *testing.T) {
+	events := diffOrgCharts(diffTestMoves(t))
+
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{"text", `reportingLine.changed bob (Bob): "damon_petta::alice" -> "damon_petta::dave"
+employee.moved carol (Carol): "squad" -> "other"
+reportingLine.changed carol (Carol): "damon_petta::alice::bob" -> "damon_petta::dave"
+employee.removed erin (Erin) in squad
+team.reparented squad (Squad): "tribe::squad" -> "other::squad"
+`},
+		{"markdown", "# Org chart changes\n\nFrom `1-a` to `2-b`\n" +
+			"\n## Employees removed\n\n- **Erin** (`erin`) in `squad`\n" +
+			"\n## Employees moved\n\n- **Carol** (`carol`): `squad` → `other`\n" +
+			"\n## Reporting lines changed\n\n- **Bob** (`bob`): `damon_petta::alice` → `damon_petta::dave`\n" +
+			"- **Carol** (`carol`): `damon_petta::alice::bob` → `damon_petta::dave`\n" +
+			"\n## Teams moved\n\n- **Squad** (`squad`): `tribe::squad` → `other::squad`\n"},
+	}
+
+	// text follows the order of the events, markdown groups them by section
+	for _, test := range tests {
+		var b bytes.Buffer
+
+		if err := writeChartDiff(&b, test.format, "1-a", "2-b", events); err != nil {
+			t.Fatal(err)
+		}
+
+		if b.String() != test.expected {
+			t.Errorf("unexpected %s\n%s\nexpected\n%s", test.format, b.String(), test.expected)
+		}
+	}
+
+	var b bytes.Buffer
+
+	if err := writeChartDiff(&b, "markdown", "1-a", "1-a", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := "# Org chart changes\n\nFrom `1-a` to `1-a`\n\nNo changes.\n"; b.String() != expected {
+		t.Errorf("unexpected markdown without changes\n%s", b.String())
+	}
+
+	b.Reset()
+
+	if err := writeChartDiff(&b, "json", "1-a", "2-b", events); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded struct {
+		From   string       `json:"from"`
+		To     string       `json:"to"`
+		Events []chartEvent `json:"events"`
+	}
+
+	if err := json.Unmarshal(b.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.From != "1-a" || decoded.To != "2-b" || !reflect.DeepEqual(decoded.Events, events) {
+		t.Errorf("unexpected json %s", b.String())
+	}
+
+	if err := writeChartDiff(&b, "yaml", "1-a", "2-b", events); err == nil {
+		t.Error("expected an invalid format to be refused")
+	}
+}
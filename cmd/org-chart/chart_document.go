@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	couch "github.com/lancecarlson/couchgo"
+	"github.com/pkg/errors"
+)
+
+// chartDocument is the chart as stored in couchdb. It is kept as generic json, unlike OrgChart,
+// so that fields only the admin UI knows about survive being saved from here.
+type chartDocument struct {
+	raw       map[string]interface{}
+	employees []map[string]interface{}
+	teams     []map[string]interface{}
+}
+
+// chartChange is a single edit of the chart document, an empty from or to means the field,
+// or the whole record when there is no field, was added or removed
+type chartChange struct {
+	Kind  string `json:"kind"`
+	ID    string `json:"id"`
+	Field string `json:"field,omitempty"`
+	From  string `json:"from,omitempty"`
+	To    string `json:"to,omitempty"`
+}
+
+func (c chartChange) String() string {
+	switch {
+	case c.Field == "" && c.From == "":
+		return fmt.Sprintf("+ %s %s %s", c.Kind, c.ID, c.To)
+	case c.Field == "" && c.To == "":
+		return fmt.Sprintf("- %s %s %s", c.Kind, c.ID, c.From)
+	default:
+		return fmt.Sprintf("~ %s %s %s: %q -> %q", c.Kind, c.ID, c.Field, c.From, c.To)
+	}
+}
+
+func couchClient(location string) (*couch.Client, error) {
+	URL, err := url.Parse(location)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return couch.NewClient(URL), nil
+}
+
+func loadChartDocument(location string) (*chartDocument, error) {
+
+	couchdb, err := couchClient(location)
+
+	if err != nil {
+		return nil, err
+	}
+
+	raw := map[string]interface{}{}
+
+	if err := couchdb.Get("chart", &raw); err != nil {
+		return nil, err
+	}
+
+	doc := &chartDocument{
+		raw:       raw,
+		employees: []map[string]interface{}{},
+		teams:     []map[string]interface{}{},
+	}
+
+	for key, records := range map[string]*[]map[string]interface{}{"employees": &doc.employees, "teams": &doc.teams} {
+		list, _ := raw[key].([]interface{})
+
+		for _, record := range list {
+			m, ok := record.(map[string]interface{})
+
+			if !ok {
+				return nil, errors.Errorf("unexpected %s record %v", key, record)
+			}
+
+			*records = append(*records, m)
+		}
+	}
+
+	return doc, nil
+}
+
+// getCouchDocument reads a document with query parameters, which couchgo doesn't take
+func getCouchDocument(couchdb *couch.Client, id string, values url.Values, doc interface{}) error {
+
+	req, err := couchdb.NewRequest("GET", couchdb.UrlString(couchdb.DocPath(id), &values), nil, nil)
+
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = couchdb.HandleResponse(resp, doc)
+
+	return err
+}
+
+// rev is the revision the document was loaded at, couchdb refuses to save over a newer one
+func (d *chartDocument) rev() string {
+	rev, _ := d.raw["_rev"].(string)
+	return rev
+}
+
+// errChartConflict is returned when the chart was saved by someone else since it was loaded
+var errChartConflict = errors.New("org chart was changed since it was loaded")
+
+// save writes the document back at the revision it was loaded at, returning the new revision
+func (d *chartDocument) save(location string) (string, error) {
+
+	couchdb, err := couchClient(location)
+
+	if err != nil {
+		return "", err
+	}
+
+	d.raw["_id"] = "chart"
+	d.raw["updatedAt"] = time.Now().UTC().Format(time.RFC3339)
+	d.raw["employees"] = d.employees
+	d.raw["teams"] = d.teams
+
+	body, err := json.Marshal(d.raw)
+
+	if err != nil {
+		return "", err
+	}
+
+	req, err := couchdb.NewRequest("PUT", couchdb.UrlString(couchdb.DocPath("chart"), nil), bytes.NewReader(body), nil)
+
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		return "", err
+	}
+
+	var res couch.Response
+
+	code, err := couchdb.HandleResponse(resp, &res)
+
+	if code == http.StatusConflict {
+		return "", errChartConflict
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	d.raw["_rev"] = res.Rev
+
+	return res.Rev, nil
+}
+
+// orgChart reads the document the way loadOrgChartData does, to check edits leave it usable
+func (d *chartDocument) orgChart() (*OrgChart, error) {
+	d.raw["employees"] = d.employees
+	d.raw["teams"] = d.teams
+
+	var chart OrgChart
+
+	if err := couch.Remarshal(d.raw, &chart); err != nil {
+		return nil, err
+	}
+
+	if err := chart.organise(); err != nil {
+		return nil, err
+	}
+
+	return &chart, nil
+}
+
+func docString(record map[string]interface{}, field string) string {
+	switch v := record[field].(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func (d *chartDocument) employee(id string) map[string]interface{} {
+	for _, e := range d.employees {
+		if docString(e, "id") == id {
+			return e
+		}
+	}
+	return nil
+}
+
+// set changes a field of a record, returning the change or nil when the value is the same
+func setField(kind string, record map[string]interface{}, field, value string) *chartChange {
+	from := docString(record, field)
+
+	if from == value {
+		return nil
+	}
+
+	if value == "" {
+		record[field] = nil
+	} else {
+		record[field] = value
+	}
+
+	return &chartChange{Kind: kind, ID: docString(record, "id"), Field: field, From: from, To: value}
+}
+
+// removeEmployee drops an employee along with the references teams and colleagues hold to them
+func (d *chartDocument) removeEmployee(id string) []chartChange {
+
+	changes := []chartChange{}
+
+	employees := []map[string]interface{}{}
+
+	for _, e := range d.employees {
+		if docString(e, "id") == id {
+			changes = append(changes, chartChange{Kind: "employee", ID: id, From: docString(e, "name")})
+			continue
+		}
+
+		employees = append(employees, e)
+	}
+
+	d.employees = employees
+
+	for _, e := range d.employees {
+		if docString(e, "reportsTo") == id {
+			changes = append(changes, *setField("employee", e, "reportsTo", ""))
+		}
+	}
+
+	// the admin UI keeps a lead per stream, as engineeringLead, productLead and so on
+	for _, t := range d.teams {
+		fields := []string{}
+
+		for field := range t {
+			if strings.HasSuffix(field, "Lead") && docString(t, field) == id {
+				fields = append(fields, field)
+			}
+		}
+
+		sort.Strings(fields)
+
+		for _, field := range fields {
+			changes = append(changes, *setField("team", t, field, ""))
+		}
+	}
+
+	return changes
+}
+
+var nonAlphanumeric = regexp.MustCompile("[^a-z0-9]+")
+
+// newEmployeeID derives an id from a name the way the admin UI does, made unique
+func (d *chartDocument) newEmployeeID(name string) string {
+	base := strings.Trim(nonAlphanumeric.ReplaceAllString(strings.ToLower(name), "_"), "_")
+	id := base
+
+	for i := 2; d.employee(id) != nil; i++ {
+		id = fmt.Sprintf("%s_%d", base, i)
+	}
+
+	return id
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// chartRepository saves edits of the chart document with optimistic concurrency. When someone
+// else saved the chart in the meantime the edit is applied again to the latest revision.
+type chartRepository struct {
+	location string
+	attempts int
+}
+
+// chartEdit changes a freshly loaded chart document, returning the changes it made
+type chartEdit func(doc *chartDocument) ([]chartChange, error)
+
+// update applies edit and saves the result when preview approves of the changes, it returns
+// the changes and the new revision, empty when nothing was saved
+func (r *chartRepository) update(edit chartEdit, preview func([]chartChange) bool) ([]chartChange, string, error) {
+
+	for attempt := 1; ; attempt++ {
+		doc, err := loadChartDocument(r.location)
+
+		if err != nil {
+			return nil, "", errors.Wrap(err, "retrieving org chart data")
+		}
+
+		changes, err := edit(doc)
+
+		if err != nil {
+			return nil, "", err
+		}
+
+		if len(changes) == 0 {
+			return changes, "", nil
+		}
+
+		if _, err := doc.orgChart(); err != nil {
+			return nil, "", errors.Wrap(err, "edited org chart is invalid")
+		}
+
+		if !preview(changes) {
+			return changes, "", nil
+		}
+
+		rev, err := doc.save(r.location)
+
+		if err == errChartConflict && attempt < r.attempts {
+			logrus.Warnf("org chart changed since revision %s, applying the edit again", doc.rev())
+			continue
+		}
+
+		if err != nil {
+			return nil, "", errors.Wrap(err, "saving org chart")
+		}
+
+		return changes, rev, nil
+	}
+}
+
+func (d *chartDocument) team(id string) map[string]interface{} {
+	for _, t := range d.teams {
+		if docString(t, "id") == id {
+			return t
+		}
+	}
+	return nil
+}
+
+// moveTeam nests a team under a new parent, or at the top level when parentID is empty
+func (d *chartDocument) moveTeam(teamID, parentID string) ([]chartChange, error) {
+
+	team := d.team(teamID)
+
+	if team == nil {
+		return nil, errors.Errorf("could not find team %s", teamID)
+	}
+
+	for id := parentID; id != ""; id = docString(d.team(id), "parent") {
+		if id == teamID {
+			return nil, errors.Errorf("team %s cannot be moved under itself", teamID)
+		}
+
+		if d.team(id) == nil {
+			return nil, errors.Errorf("could not find team %s", id)
+		}
+	}
+
+	if change := setField("team", team, "parent", parentID); change != nil {
+		return []chartChange{*change}, nil
+	}
+
+	return []chartChange{}, nil
+}
+
+// moveEmployee makes an employee a member of another team
+func (d *chartDocument) moveEmployee(employeeID, teamID string) ([]chartChange, error) {
+
+	employee := d.employee(employeeID)
+
+	if employee == nil {
+		return nil, errors.Errorf("could not find employee %s", employeeID)
+	}
+
+	if d.team(teamID) == nil {
+		return nil, errors.Errorf("could not find team %s", teamID)
+	}
+
+	if change := setField("employee", employee, "memberOf", teamID); change != nil {
+		return []chartChange{*change}, nil
+	}
+
+	return []chartChange{}, nil
+}
+
+// leadField names the field holding the lead of a stream. The engineering lead is kept as
+// techLead, which the admin UI also reads.
+func leadField(stream string) string {
+	if strings.EqualFold(stream, "engineering") || strings.EqualFold(stream, "tech") {
+		return "techLead"
+	}
+	return strings.ToLower(stream) + "Lead"
+}
+
+// setLead makes an employee the lead of a stream in a team, an empty employee clears it
+func (d *chartDocument) setLead(teamID, stream, employeeID string) ([]chartChange, error) {
+
+	team := d.team(teamID)
+
+	if team == nil {
+		return nil, errors.Errorf("could not find team %s", teamID)
+	}
+
+	if stream == "" {
+		return nil, errors.New("a stream is required")
+	}
+
+	if employeeID != "" && d.employee(employeeID) == nil {
+		return nil, errors.Errorf("could not find employee %s", employeeID)
+	}
+
+	fields := []string{leadField(stream)}
+
+	// teams last saved by the admin UI may still carry the engineering lead under its own name
+	if _, ok := team["engineeringLead"]; ok && fields[0] == "techLead" {
+		fields = append(fields, "engineeringLead")
+	}
+
+	changes := []chartChange{}
+
+	for _, field := range fields {
+		if change := setField("team", team, field, employeeID); change != nil {
+			changes = append(changes, *change)
+		}
+	}
+
+	return changes, nil
+}
+
+var chartEditFlags = []cli.Flag{
+	cli.StringFlag{
+		Name: "data-url",
+	},
+	cli.BoolFlag{
+		Name:  "apply",
+		Usage: "save the changes to the org chart, they are only shown otherwise",
+	},
+	cli.IntFlag{
+		Name:  "attempts",
+		Value: 3,
+		Usage: "how many times to apply the edit when the org chart is saved by someone else meanwhile",
+	},
+}
+
+// runChartEdit shows the changes an edit makes to the org chart, saving them with --apply
+func runChartEdit(c *cli.Context, edit chartEdit) error {
+
+	repository := &chartRepository{
+		location: c.String("data-url"),
+		attempts: c.Int("attempts"),
+	}
+
+	changes, rev, err := repository.update(edit, func(changes []chartChange) bool {
+		for _, change := range changes {
+			fmt.Println(change)
+		}
+		return c.Bool("apply")
+	})
+
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(changes) == 0:
+		logrus.Info("nothing to change in the org chart")
+	case rev == "":
+		logrus.Infof("%d changes not saved, run with --apply to save them", len(changes))
+	default:
+		logrus.Infof("saved %d changes to the org chart, revision %s", len(changes), rev)
+	}
+
+	return nil
+}
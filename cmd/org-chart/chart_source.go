@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	couch "github.com/lancecarlson/couchgo"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// loadOrgChartSource loads the chart from a file holding its json, as a path or file:// url, a
+// url serving it or the url of a couchdb database or its chart document, at a past revision
+// when the url has a rev parameter, or a snapshot archive. A source of only ?rev=... is a
+// revision of the chart at dataURL.
+func loadOrgChartSource(source, dataURL string) (*OrgChart, error) {
+
+	if strings.HasPrefix(source, "?") {
+		source = strings.TrimSuffix(dataURL, "/") + source
+	}
+
+	if isSnapshotLocation(source) {
+		return loadOrgChartSnapshot(source)
+	}
+
+	u, err := url.Parse(source)
+
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		path := source
+
+		if err == nil && u.Scheme == "file" {
+			path = u.Path
+		}
+
+		f, err := os.Open(path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer f.Close()
+
+		return decodeOrgChart(f)
+	}
+
+	if rev := u.Query().Get("rev"); rev != "" {
+		query := u.Query()
+		query.Del("rev")
+		u.RawQuery = query.Encode()
+
+		// the url of the chart document itself is as good as that of its database
+		u.Path = strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "/chart")
+
+		return loadOrgChartRevision(u.String(), rev)
+	}
+
+	resp, err := http.Get(source)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, errors.Errorf("%s returned %s: %s", source, resp.Status, b)
+	}
+
+	raw := map[string]interface{}{}
+
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return nil, errors.Wrapf(err, "decoding %s", source)
+	}
+
+	// a couchdb database describes itself, the chart is a document within it
+	if _, ok := raw["db_name"]; ok {
+		return loadOrgChartData(source)
+	}
+
+	var chart OrgChart
+
+	if err := couch.Remarshal(raw, &chart); err != nil {
+		return nil, err
+	}
+
+	return organisedOrgChart(&chart)
+}
+
+func decodeOrgChart(r io.Reader) (*OrgChart, error) {
+	var chart OrgChart
+
+	if err := json.NewDecoder(r).Decode(&chart); err != nil {
+		return nil, err
+	}
+
+	return organisedOrgChart(&chart)
+}
+
+func organisedOrgChart(chart *OrgChart) (*OrgChart, error) {
+	if err := chart.organise(); err != nil {
+		return nil, err
+	}
+
+	for _, err := range chart.validationErrors {
+		logrus.Warn(err)
+	}
+
+	return chart, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const codeownersHeader = "# generated by org-chart codeowners from the org chart, do not edit by hand\n"
+
+// codeownersRule assigns the files matching a path glob to org teams
+type codeownersRule struct {
+	Pattern string
+	TeamIDs []string
+}
+
+// parseCodeownersMapping reads a CODEOWNERS-like mapping where every line holds a path glob
+// followed by org team ids, blank lines and lines starting with # are ignored
+func parseCodeownersMapping(r io.Reader) ([]*codeownersRule, error) {
+
+	rules := []*codeownersRule{}
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+
+	for scanner.Scan() {
+		line++
+
+		text := strings.TrimSpace(scanner.Text())
+
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+
+		if len(fields) < 2 {
+			return nil, errors.Errorf("line %d: expected a path pattern followed by at least one team id", line)
+		}
+
+		rules = append(rules, &codeownersRule{
+			Pattern: fields[0],
+			TeamIDs: fields[1:],
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// codeownersTeam resolves the team owning code assigned to a team id. Teams removed from the
+// org chart fall back to their closest remaining ancestor, as recorded in the github state file.
+func (oc *OrgChart) codeownersTeam(teamID string, mapping *githubTeamMapping) (*Team, error) {
+
+	seen := map[string]bool{}
+	id := teamID
+
+	for {
+		if t, ok := oc.TeamsByID[id]; ok {
+			if id != teamID {
+				logrus.Warnf("team %s is not in the org chart, using its ancestor %s instead", teamID, id)
+			}
+			return t, nil
+		}
+
+		if mapping == nil {
+			return nil, errors.Errorf("team %s not found in org chart", teamID)
+		}
+
+		entry, ok := mapping.entry(id)
+
+		if !ok || entry.ParentID == "" || seen[id] {
+			return nil, errors.Errorf("team %s not found in org chart and no remaining ancestor is known", teamID)
+		}
+
+		seen[id] = true
+		id = entry.ParentID
+	}
+}
+
+// renderCodeowners writes a CODEOWNERS file referencing the github team of each mapped team
+func renderCodeowners(w io.Writer, chart *OrgChart, organisation string, rules []*codeownersRule, mapping *githubTeamMapping) error {
+
+	buf := &bytes.Buffer{}
+	buf.WriteString(codeownersHeader)
+
+	for _, rule := range rules {
+
+		owners := []string{}
+		seen := map[string]bool{}
+
+		for _, teamID := range rule.TeamIDs {
+			team, err := chart.codeownersTeam(teamID, mapping)
+
+			if err != nil {
+				return errors.Wrapf(err, "resolving owners of %s", rule.Pattern)
+			}
+
+			owner := fmt.Sprintf("@%s/%s", organisation, team.Github)
+
+			if !seen[owner] {
+				seen[owner] = true
+				owners = append(owners, owner)
+			}
+		}
+
+		fmt.Fprintf(buf, "%s %s\n", rule.Pattern, strings.Join(owners, " "))
+	}
+
+	_, err := w.Write(buf.Bytes())
+
+	return err
+}
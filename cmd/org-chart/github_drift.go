@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// githubDriftKinds are the kinds of differences between the org chart and github
+var githubDriftKinds = []string{"team", "parent", "team_attribute", "membership", "role", "repository"}
+
+// drift counts, per kind, the changes a sync made or would have made in a dry run
+func (r *githubOrgReport) drift() map[string]int {
+	attributes := 0
+
+	for _, change := range r.TeamChanges {
+		if change.Subject != "parent" {
+			attributes++
+		}
+	}
+
+	return map[string]int{
+		"team":           len(r.CreatedTeams) + len(r.RemovedTeams),
+		"parent":         len(r.ReparentedTeams),
+		"team_attribute": attributes,
+		"membership":     len(r.MembershipAdditions) + len(r.MembershipRemovals),
+		"role":           len(r.RoleChanges),
+		"repository":     len(r.RepositoryChanges),
+	}
+}
+
+// githubDriftMetrics exposes the outcome of the latest drift check in the prometheus text format
+type githubDriftMetrics struct {
+	mu        sync.Mutex
+	report    *githubSyncReport
+	lastCheck time.Time
+}
+
+func (m *githubDriftMetrics) update(report *githubSyncReport) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.report = report
+	m.lastCheck = time.Now()
+}
+
+func (m *githubDriftMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	if m.report == nil {
+		return
+	}
+
+	orgs := make([]*githubOrgReport, len(m.report.Orgs))
+	copy(orgs, m.report.Orgs)
+
+	sort.Slice(orgs, func(i, j int) bool {
+		return orgs[i].Organisation < orgs[j].Organisation
+	})
+
+	fmt.Fprintln(w, "# HELP orgchart_github_drift Changes needed to bring github in line with the org chart.")
+	fmt.Fprintln(w, "# TYPE orgchart_github_drift gauge")
+
+	for _, org := range orgs {
+		drift := org.drift()
+
+		for _, kind := range githubDriftKinds {
+			fmt.Fprintf(w, "orgchart_github_drift{org=%q,kind=%q} %d\n", org.Organisation, kind, drift[kind])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP orgchart_github_drift_check_success Whether the latest drift check of an organisation succeeded.")
+	fmt.Fprintln(w, "# TYPE orgchart_github_drift_check_success gauge")
+
+	for _, org := range orgs {
+		success := 1
+
+		if org.Error != "" {
+			success = 0
+		}
+
+		fmt.Fprintf(w, "orgchart_github_drift_check_success{org=%q} %d\n", org.Organisation, success)
+	}
+
+	fmt.Fprintln(w, "# HELP orgchart_github_drift_last_check_timestamp_seconds When drift was last checked.")
+	fmt.Fprintln(w, "# TYPE orgchart_github_drift_last_check_timestamp_seconds gauge")
+	fmt.Fprintf(w, "orgchart_github_drift_last_check_timestamp_seconds %d\n", m.lastCheck.Unix())
+}
+
+// serveGithubDrift checks for drift every interval, without changing github, and serves the
+// outcome as prometheus metrics
+func serveGithubDrift(dataURL string, targets []*githubSyncTarget, token string, address string, interval time.Duration) error {
+
+	metrics := &githubDriftMetrics{}
+
+	check := func() {
+		orgChart, err := loadOrgChartData(dataURL)
+
+		if err != nil {
+			logrus.Errorf("retrieving org chart data: %v", err)
+			return
+		}
+
+		metrics.update(runGithubSync(orgChart, targets, token, true))
+	}
+
+	go func() {
+		for {
+			check()
+			time.Sleep(interval)
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+
+	logrus.Infof("serving github drift metrics on %s", address)
+
+	return http.ListenAndServe(address, mux)
+}
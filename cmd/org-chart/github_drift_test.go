@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGithubDriftCountsEachTeamEditOnce(t *testing.T) {
+	chart := generateOrgChart(240, 0)
+	gh := generateGithubState(chart)
+	gh.orgTeams = chart.TeamsByID
+	gh.resetSyncResult()
+
+	// every squad of the tribe reaches it again as their parent
+	chart.TeamsByID["tribe_0"].Description = "changed"
+
+	for _, team := range chart.Teams {
+		if _, err := gh.createTeamByIDIfNotExists(team.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report := newGithubOrgReport("example")
+	report.addSyncResult(gh.syncResult)
+	report.finish(nil)
+
+	metrics := &githubDriftMetrics{}
+	metrics.update(&githubSyncReport{Orgs: []*githubOrgReport{report}})
+
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := recorder.Body.String()
+
+	for _, line := range []string{
+		"# TYPE orgchart_github_drift gauge",
+		`orgchart_github_drift{org="example",kind="team_attribute"} 1`,
+		`orgchart_github_drift{org="example",kind="team"} 0`,
+		`orgchart_github_drift_check_success{org="example"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("expected %q in\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+)
+
+// githubMemberFilter decides which employees are synced to their github team. Excluded
+// employees are routed to the excluded team when there is one, dropped employees are never
+// synced at all.
+type githubMemberFilter struct {
+	IncludeTypes     []string `json:"includeTypes"`
+	ExcludeTypes     []string `json:"excludeTypes"`
+	IncludeStreams   []string `json:"includeStreams"`
+	ExcludeStreams   []string `json:"excludeStreams"`
+	IncludeTeamKinds []string `json:"includeTeamKinds"`
+	ExcludeTeamKinds []string `json:"excludeTeamKinds"`
+	DropTypes        []string `json:"dropTypes"`
+
+	// ExcludedTeam is the slug of the github team excluded employees are routed to
+	ExcludedTeam string `json:"excludedTeam"`
+}
+
+func matchesAny(value string, values []string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *githubMemberFilter) dropped(e *Employee) bool {
+	return matchesAny(e.Type, f.DropTypes)
+}
+
+func (f *githubMemberFilter) excluded(e *Employee) bool {
+	kind := ""
+
+	if e.Team != nil {
+		kind = e.Team.Kind
+	}
+
+	switch {
+	case len(f.IncludeTypes) > 0 && !matchesAny(e.Type, f.IncludeTypes):
+		return true
+	case len(f.IncludeStreams) > 0 && !matchesAny(e.Stream, f.IncludeStreams):
+		return true
+	case len(f.IncludeTeamKinds) > 0 && !matchesAny(kind, f.IncludeTeamKinds):
+		return true
+	}
+
+	return matchesAny(e.Type, f.ExcludeTypes) || matchesAny(e.Stream, f.ExcludeStreams) || matchesAny(kind, f.ExcludeTeamKinds)
+}
+
+// synced tells whether an employee belongs in github at all, in their own team or routed
+func (f *githubMemberFilter) synced(e *Employee) bool {
+	if f == nil {
+		return true
+	}
+
+	if f.dropped(e) {
+		return false
+	}
+
+	return !f.excluded(e) || f.ExcludedTeam != ""
+}
+
+// inOwnTeam tells whether an employee is synced to the github team of their org team
+func (f *githubMemberFilter) inOwnTeam(e *Employee) bool {
+	if f == nil {
+		return true
+	}
+
+	return !f.dropped(e) && !f.excluded(e)
+}
+
+// excludedTeam returns a synthetic org team backing the github team excluded employees are
+// routed to, so it is created and reconciled like any other team
+func (f *githubMemberFilter) excludedTeam(prefix string) *Team {
+	if f == nil || f.ExcludedTeam == "" {
+		return nil
+	}
+
+	return &Team{
+		ID:          f.ExcludedTeam,
+		Name:        strings.TrimPrefix(f.ExcludedTeam, prefix),
+		Description: "people excluded from their own team by the org chart sync",
+		Github:      f.ExcludedTeam,
+	}
+}
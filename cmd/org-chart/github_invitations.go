@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/google/go-querystring/query"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// githubFailedInvitation is an organisation invitation which expired or failed, not
+// available in the github client
+type githubFailedInvitation struct {
+	Login        string    `json:"login"`
+	FailedAt     time.Time `json:"failed_at"`
+	FailedReason string    `json:"failed_reason"`
+}
+
+// githubInvitationFailure is an employee this run failed to invite, an unknown login or an
+// invitation github refused
+type githubInvitationFailure struct {
+	employee *Employee
+	err      error
+}
+
+type githubInvitationResult struct {
+	invited []*Employee
+	pending []*Employee
+	expired []*githubFailedInvitation
+	failed  []*githubInvitationFailure
+}
+
+// loadInvitations retrieves pending and failed organisation invitations
+func (gh *GithubState) loadInvitations() error {
+
+	ctx := context.Background()
+
+	gh.invitations = map[string]*github.Invitation{}
+	gh.failedInvitations = []*githubFailedInvitation{}
+
+	opt := &github.ListOptions{PerPage: 100}
+
+	for {
+		invitations, res, err := gh.client.Organizations.ListPendingOrgInvitations(ctx, gh.organisation, opt)
+
+		if err != nil {
+			return errors.Wrap(err, "listing pending invitations")
+		}
+
+		for _, invitation := range invitations {
+			if invitation.GetLogin() != "" {
+				gh.invitations[normalisedLogin(invitation.GetLogin())] = invitation
+			}
+		}
+
+		if res.NextPage == 0 {
+			break
+		}
+
+		opt.Page = res.NextPage
+	}
+
+	opt = &github.ListOptions{PerPage: 100}
+
+	for {
+		u, err := url.Parse(fmt.Sprintf("orgs/%s/failed_invitations", gh.organisation))
+
+		if err != nil {
+			return err
+		}
+
+		q, err := query.Values(opt)
+
+		if err != nil {
+			return err
+		}
+
+		u.RawQuery = q.Encode()
+
+		req, err := gh.client.NewRequest("GET", u.String(), nil)
+
+		if err != nil {
+			return err
+		}
+
+		var failed []*githubFailedInvitation
+		res, err := gh.client.Do(ctx, req, &failed)
+
+		if err != nil {
+			return errors.Wrap(err, "listing failed invitations")
+		}
+
+		gh.failedInvitations = append(gh.failedInvitations, failed...)
+
+		if res.NextPage == 0 {
+			break
+		}
+
+		opt.Page = res.NextPage
+	}
+
+	return nil
+}
+
+// InviteMembers invites employees with a github handle who are not members of the
+// organisation, unless an invitation is already pending. Employees who can't be invited are
+// recorded as failed rather than stopping the sync of everyone else.
+func (gh *GithubState) InviteMembers(chart *OrgChart) (*githubInvitationResult, error) {
+
+	result := &githubInvitationResult{
+		invited: []*Employee{},
+		pending: []*Employee{},
+		expired: []*githubFailedInvitation{},
+		failed:  []*githubInvitationFailure{},
+	}
+
+	if err := gh.loadInvitations(); err != nil {
+		return result, err
+	}
+
+	notInGithub := employeesNotInGithub(chart, gh)
+
+	missing := map[string]bool{}
+
+	for _, e := range notInGithub {
+		missing[e.Github] = true
+	}
+
+	latestFailures := map[string]*githubFailedInvitation{}
+
+	for _, failed := range gh.failedInvitations {
+		login := normalisedLogin(failed.Login)
+
+		if !missing[login] {
+			continue
+		}
+		if latest, ok := latestFailures[login]; !ok || failed.FailedAt.After(latest.FailedAt) {
+			latestFailures[login] = failed
+		}
+	}
+
+	ctx := context.Background()
+	role := "direct_member"
+
+	for _, e := range notInGithub {
+
+		if !gh.memberFilter.synced(e) {
+			continue
+		}
+
+		if _, ok := gh.invitations[e.Github]; ok {
+			result.pending = append(result.pending, e)
+			continue
+		}
+
+		if failed, ok := latestFailures[e.Github]; ok {
+			result.expired = append(result.expired, failed)
+		}
+
+		logrus.Debugf("inviting %s (%s) to %s", e.Name, e.Github, gh.organisation)
+
+		if gh.dry {
+			result.invited = append(result.invited, e)
+			continue
+		}
+
+		user, _, err := gh.client.Users.Get(ctx, e.Github)
+
+		if err != nil {
+			result.failed = append(result.failed, &githubInvitationFailure{e, errors.Wrapf(err, "retrieving github user %s", e.Github)})
+			continue
+		}
+
+		invitation, _, err := gh.client.Organizations.CreateOrgInvitation(ctx, gh.organisation, &github.CreateOrgInvitationOptions{
+			InviteeID: user.ID,
+			Role:      &role,
+		})
+
+		if err != nil {
+			result.failed = append(result.failed, &githubInvitationFailure{e, errors.Wrapf(err, "inviting %s", e.Github)})
+			continue
+		}
+
+		gh.invitations[e.Github] = invitation
+		result.invited = append(result.invited, e)
+	}
+
+	return result, nil
+}
+
+// getPendingTeamInvitations lists users invited to a team who haven't joined the organisation yet
+func (gh *GithubState) getPendingTeamInvitations(team *github.Team) ([]*github.Invitation, error) {
+
+	ctx := context.Background()
+
+	opt := &github.ListOptions{PerPage: 100}
+
+	allInvitations := []*github.Invitation{}
+
+	for {
+		invitations, res, err := gh.client.Teams.ListPendingTeamInvitations(ctx, team.GetID(), opt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		allInvitations = append(allInvitations, invitations...)
+
+		if res.NextPage == 0 {
+			break
+		}
+
+		opt.Page = res.NextPage
+	}
+
+	return allInvitations, nil
+}
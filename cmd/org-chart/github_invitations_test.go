@@ -0,0 +1,110 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+func TestInviteMembers(t *testing.T) {
+	chart := &OrgChart{
+		Teams: []*Team{{ID: "squad", Name: "Squad"}},
+		Employees: []*Employee{
+			{ID: "alice", Name: "Alice", Github: "alice", MemberOf: "squad"},
+			{ID: "bob", Name: "Bob", Github: "bob", MemberOf: "squad"},
+			{ID: "carol", Name: "Carol", Github: "carol", MemberOf: "squad"},
+			{ID: "dave", Name: "Dave", Github: "dave", MemberOf: "squad"},
+			{ID: "erin", Name: "Erin", Github: "erin", MemberOf: "squad"},
+			{ID: "frank", Name: "Frank", Github: "frank", MemberOf: "squad"},
+			{ID: "grace", Name: "Grace", MemberOf: "squad"},
+		},
+	}
+
+	if err := chart.organise(); err != nil {
+		t.Fatal(err)
+	}
+
+	expiredAt := time.Date(2020, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	// alice is a member, bob was invited already and carol's invitation expired, dave
+	// renamed his account and github refuses to invite erin
+	fake := &fakeGithub{
+		users: map[string]*github.User{
+			"bob":   {ID: github.Int64(2), Login: github.String("bob")},
+			"carol": {ID: github.Int64(3), Login: github.String("carol")},
+			"erin":  {ID: github.Int64(5), Login: github.String("erin")},
+			"frank": {ID: github.Int64(6), Login: github.String("frank")},
+		},
+		invitations: []*github.Invitation{{Login: github.String("Bob")}},
+		failed: []*githubFailedInvitation{
+			{Login: "carol", FailedAt: expiredAt.AddDate(0, 0, -7), FailedReason: "Invitation expired"},
+			{Login: "Carol", FailedAt: expiredAt, FailedReason: "Invitation expired"},
+		},
+		refused: map[int64]bool{5: true},
+	}
+
+	client, server := newFakeGithubClient(fake)
+	defer server.Close()
+
+	gh := &GithubState{
+		organisation: "example",
+		client:       client,
+		teams:        map[string]*github.Team{},
+		members:      map[string]*github.User{},
+	}
+
+	gh.AddMembers(&github.User{Login: github.String("alice")})
+
+	result, err := gh.InviteMembers(chart)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := func(employees []*Employee) []string {
+		ids := []string{}
+
+		for _, e := range employees {
+			ids = append(ids, e.ID)
+		}
+
+		return ids
+	}
+
+	if got := ids(result.invited); !reflect.DeepEqual(got, []string{"carol", "frank"}) {
+		t.Errorf("unexpected invitations %v", got)
+	}
+
+	if got := ids(result.pending); !reflect.DeepEqual(got, []string{"bob"}) {
+		t.Errorf("unexpected pending invitations %v", got)
+	}
+
+	if len(result.expired) != 1 || result.expired[0].Login != "Carol" || !result.expired[0].FailedAt.Equal(expiredAt) {
+		t.Errorf("expected the latest expired invitation of carol, got %v", result.expired)
+	}
+
+	failed := []string{}
+
+	for _, failure := range result.failed {
+		failed = append(failed, failure.employee.ID)
+	}
+
+	if !reflect.DeepEqual(failed, []string{"dave", "erin"}) {
+		t.Fatalf("unexpected failed invitations %v", failed)
+	}
+
+	if !strings.Contains(result.failed[1].err.Error(), "seat") {
+		t.Errorf("expected why erin could not be invited, got %v", result.failed[1].err)
+	}
+
+	report := newGithubOrgReport("example")
+	report.addInvitations(result)
+	report.finish(nil)
+
+	if report.Counts.FailedInvitations != 2 || report.FailedInvitations[0].ID != "dave" || report.FailedInvitations[0].Error == "" {
+		t.Errorf("expected the failed invitations to be reported, got %v", report.FailedInvitations)
+	}
+}
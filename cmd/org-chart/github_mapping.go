@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/google/go-github/github"
+	"github.com/pkg/errors"
+)
+
+// githubTeamMapping persists which github team backs each org team, so that a team keeps
+// its github identity, and with it its repository permissions, when its org id changes.
+// It also remembers every github handle synced from the org chart, to recognise leavers.
+type githubTeamMapping struct {
+	Organisation string                      `json:"organisation"`
+	Teams        []*githubTeamMappingEntry   `json:"teams"`
+	Members      []*githubMemberMappingEntry `json:"members,omitempty"`
+
+	teamsByID      map[string]*githubTeamMappingEntry
+	membersByLogin map[string]*githubMemberMappingEntry
+}
+
+type githubMemberMappingEntry struct {
+	Login      string `json:"login"`
+	EmployeeID string `json:"employeeId"`
+	Name       string `json:"name"`
+	Left       bool   `json:"left,omitempty"`
+}
+
+type githubTeamMappingEntry struct {
+	TeamID       string `json:"teamId"`
+	TeamName     string `json:"teamName"`
+	ParentID     string `json:"parentId,omitempty"`
+	GithubTeamID int64  `json:"githubTeamId"`
+	GithubSlug   string `json:"githubSlug"`
+	Removed      bool   `json:"removed,omitempty"`
+}
+
+type githubTeamRename struct {
+	from string
+	to   string
+	team *github.Team
+}
+
+func loadGithubTeamMapping(path string) (*githubTeamMapping, error) {
+	mapping := &githubTeamMapping{Teams: []*githubTeamMappingEntry{}}
+
+	b, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return mapping, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, mapping); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", path)
+	}
+
+	mapping.index()
+
+	return mapping, nil
+}
+
+// index looks the mapping up by org team id and github handle
+func (m *githubTeamMapping) index() {
+	m.teamsByID = make(map[string]*githubTeamMappingEntry, len(m.Teams))
+	m.membersByLogin = make(map[string]*githubMemberMappingEntry, len(m.Members))
+
+	for _, entry := range m.Teams {
+		m.teamsByID[entry.TeamID] = entry
+	}
+
+	for _, entry := range m.Members {
+		m.membersByLogin[entry.Login] = entry
+	}
+}
+
+func (m *githubTeamMapping) save(path string) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// update records the github team currently backing every org team. Teams removed from the
+// org chart are kept, flagged as removed, so their last known parent can still be resolved.
+func (m *githubTeamMapping) update(chart *OrgChart, gh *GithubState) {
+	previous := m.Teams
+	m.Teams = []*githubTeamMappingEntry{}
+
+	for _, entry := range previous {
+		if _, ok := chart.TeamsByID[entry.TeamID]; !ok {
+			entry.Removed = true
+			entry.GithubTeamID = 0
+			m.Teams = append(m.Teams, entry)
+		}
+	}
+
+	for _, t := range chart.Teams {
+		ghTeam, ok := gh.teams[t.Github]
+
+		if !ok {
+			continue
+		}
+
+		m.Teams = append(m.Teams, &githubTeamMappingEntry{
+			TeamID:       t.ID,
+			TeamName:     t.Name,
+			ParentID:     t.ParentID,
+			GithubTeamID: ghTeam.GetID(),
+			GithubSlug:   t.Github,
+		})
+	}
+
+	sort.Slice(m.Teams, func(i, j int) bool {
+		return m.Teams[i].TeamID < m.Teams[j].TeamID
+	})
+
+	m.updateMembers(chart)
+	m.index()
+}
+
+// updateMembers records the github handle of every employee, handles no longer in the org
+// chart are kept and flagged as having left
+func (m *githubTeamMapping) updateMembers(chart *OrgChart) {
+	previous := m.Members
+	m.Members = []*githubMemberMappingEntry{}
+
+	current := map[string]bool{}
+
+	for _, e := range chart.Employees {
+		if e.Github == "" {
+			continue
+		}
+
+		current[e.Github] = true
+
+		m.Members = append(m.Members, &githubMemberMappingEntry{
+			Login:      e.Github,
+			EmployeeID: e.ID,
+			Name:       e.Name,
+		})
+	}
+
+	for _, entry := range previous {
+		if !current[entry.Login] {
+			entry.Left = true
+			m.Members = append(m.Members, entry)
+		}
+	}
+
+	sort.Slice(m.Members, func(i, j int) bool {
+		return m.Members[i].Login < m.Members[j].Login
+	})
+}
+
+// applyTeamMapping registers mapped github teams under the slug their org team expects, so
+// that the sync edits them in place instead of removing and recreating them. Org teams that
+// lost their mapping because their id changed are matched to the orphaned mapping by the
+// github team id annotated in the chart, or failing that by name.
+func (gh *GithubState) applyTeamMapping(chart *OrgChart, m *githubTeamMapping) []*githubTeamRename {
+
+	ghTeamsByID := map[int64]*github.Team{}
+
+	for _, ghTeam := range gh.teams {
+		ghTeamsByID[ghTeam.GetID()] = ghTeam
+	}
+
+	mapped := map[string]*githubTeamMappingEntry{}
+	orphaned := map[int64]*githubTeamMappingEntry{}
+	orphanedByName := map[string][]*githubTeamMappingEntry{}
+
+	for _, entry := range m.Teams {
+		if entry.Removed {
+			continue
+		}
+		if _, ok := chart.TeamsByID[entry.TeamID]; ok {
+			mapped[entry.TeamID] = entry
+			continue
+		}
+		orphaned[entry.GithubTeamID] = entry
+		orphanedByName[entry.TeamName] = append(orphanedByName[entry.TeamName], entry)
+	}
+
+	// orphans are matched by id first, so that a team keeping the name of another one
+	// renamed by id doesn't take its github team
+	unmapped := []*Team{}
+
+	for _, t := range chart.Teams {
+		if _, ok := mapped[t.ID]; ok {
+			continue
+		}
+
+		if entry, ok := orphaned[t.GithubTeamIDs[gh.organisation]]; ok && entry.GithubTeamID != 0 {
+			mapped[t.ID] = entry
+			delete(orphaned, entry.GithubTeamID)
+			continue
+		}
+
+		unmapped = append(unmapped, t)
+	}
+
+	for _, t := range unmapped {
+		candidates := []*githubTeamMappingEntry{}
+
+		for _, entry := range orphanedByName[t.Name] {
+			if _, ok := orphaned[entry.GithubTeamID]; ok {
+				candidates = append(candidates, entry)
+			}
+		}
+
+		// a name shared by several removed teams is too ambiguous to be treated as a rename
+		if len(candidates) != 1 {
+			continue
+		}
+
+		mapped[t.ID] = candidates[0]
+		delete(orphaned, candidates[0].GithubTeamID)
+	}
+
+	renames := []*githubTeamRename{}
+
+	for _, t := range chart.Teams {
+
+		entry, ok := mapped[t.ID]
+
+		if !ok {
+			continue
+		}
+
+		ghTeam, ok := ghTeamsByID[entry.GithubTeamID]
+
+		if !ok {
+			continue
+		}
+
+		if entry.TeamID != t.ID {
+			renames = append(renames, &githubTeamRename{
+				from: entry.TeamID,
+				to:   t.ID,
+				team: ghTeam,
+			})
+		}
+
+		if ghTeam.GetSlug() == t.Github {
+			continue
+		}
+
+		if _, ok := gh.teams[t.Github]; ok {
+			// the expected slug is taken by another github team, leave both alone
+			continue
+		}
+
+		delete(gh.teams, ghTeam.GetSlug())
+		gh.teams[t.Github] = ghTeam
+	}
+
+	return renames
+}
+
+// annotateGithubTeams records the github team backing every org team in the chart document,
+// by organisation, so that a team changing both its id and its name is still matched to it
+func annotateGithubTeams(location string, report *githubSyncReport) error {
+
+	doc, err := loadChartDocument(location)
+
+	if err != nil {
+		return err
+	}
+
+	changed := false
+
+	for _, t := range doc.teams {
+		ids, _ := t["githubTeamIds"].(map[string]interface{})
+
+		for _, orgReport := range report.Orgs {
+			id, ok := orgReport.githubTeamIDs[docString(t, "id")]
+
+			if !ok {
+				continue
+			}
+
+			if current, ok := ids[orgReport.Organisation].(float64); ok && int64(current) == id {
+				continue
+			}
+
+			if ids == nil {
+				ids = map[string]interface{}{}
+			}
+
+			ids[orgReport.Organisation] = id
+			t["githubTeamIds"] = ids
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	_, err = doc.save(location)
+
+	return err
+}
+
+// member returns the employee last recorded for a github handle
+func (m *githubTeamMapping) member(login string) (*githubMemberMappingEntry, bool) {
+	entry, ok := m.membersByLogin[login]
+	return entry, ok
+}
+
+// entry returns the mapping recorded for an org team id
+func (m *githubTeamMapping) entry(teamID string) (*githubTeamMappingEntry, bool) {
+	entry, ok := m.teamsByID[teamID]
+	return entry, ok
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+func mappingTestChart(t *testing.T, teams ...*Team) *OrgChart {
+	chart := &OrgChart{
+		Teams:     append([]*Team{{ID: "tribe", Name: "Tribe"}}, teams...),
+		Employees: []*Employee{},
+	}
+
+	if err := chart.organise(); err != nil {
+		t.Fatal(err)
+	}
+
+	chart.assignGithubTeams("org-")
+
+	return chart
+}
+
+// mappingTestGithub has a github team for the tribe and each of the squads
+func mappingTestGithub(squads ...string) *GithubState {
+	gh := &GithubState{
+		organisation: "example",
+		teamPrefix:   "org-",
+		teams:        map[string]*github.Team{},
+		members:      map[string]*github.User{},
+		dry:          true,
+	}
+
+	tribe := &github.Team{ID: github.Int64(1), Name: github.String("org-Tribe"), Slug: github.String("org-tribe"), Privacy: github.String("closed")}
+	gh.AddTeam(tribe)
+
+	for i, slug := range squads {
+		gh.AddTeam(&github.Team{
+			ID:      github.Int64(int64(i + 2)),
+			Name:    github.String(slug),
+			Slug:    github.String(slug),
+			Privacy: github.String("closed"),
+			Parent:  tribe,
+		})
+	}
+
+	return gh
+}
+
+func mappingTestEntries(entries ...*githubTeamMappingEntry) *githubTeamMapping {
+	return &githubTeamMapping{
+		Organisation: "example",
+		Teams:        append([]*githubTeamMappingEntry{{TeamID: "tribe", TeamName: "Tribe", GithubTeamID: 1, GithubSlug: "org-tribe"}}, entries...),
+	}
+}
+
+func renamesOf(renames []*githubTeamRename) []string {
+	got := []string{}
+
+	for _, rename := range renames {
+		got = append(got, rename.from+" "+rename.to+" "+rename.team.GetSlug())
+	}
+
+	return got
+}
+
+func TestApplyTeamMapping(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		team    *Team
+		entries []*githubTeamMappingEntry
+		renames []string
+	}{
+		{
+			name:    "id rename",
+			team:    &Team{ID: "squad_uno", Name: "Squad One", ParentID: "tribe"},
+			entries: []*githubTeamMappingEntry{{TeamID: "squad_one", TeamName: "Squad One", ParentID: "tribe", GithubTeamID: 2, GithubSlug: "org-squad-one"}},
+			renames: []string{"squad_one squad_uno org-squad-one"},
+		},
+		{
+			name:    "id and name rename",
+			team:    &Team{ID: "squad_uno", Name: "Squad Uno", ParentID: "tribe", GithubTeamIDs: map[string]int64{"example": 2}},
+			entries: []*githubTeamMappingEntry{{TeamID: "squad_one", TeamName: "Squad One", ParentID: "tribe", GithubTeamID: 2, GithubSlug: "org-squad-one"}},
+			renames: []string{"squad_one squad_uno org-squad-one"},
+		},
+		{
+			name:    "id and name rename without the github team id",
+			team:    &Team{ID: "squad_uno", Name: "Squad Uno", ParentID: "tribe"},
+			entries: []*githubTeamMappingEntry{{TeamID: "squad_one", TeamName: "Squad One", ParentID: "tribe", GithubTeamID: 2, GithubSlug: "org-squad-one"}},
+			renames: []string{},
+		},
+		{
+			name: "ambiguous name",
+			team: &Team{ID: "squad_new", Name: "Squad", ParentID: "tribe"},
+			entries: []*githubTeamMappingEntry{
+				{TeamID: "squad_one", TeamName: "Squad", ParentID: "tribe", GithubTeamID: 2, GithubSlug: "org-squad-one"},
+				{TeamID: "squad_two", TeamName: "Squad", ParentID: "tribe", GithubTeamID: 3, GithubSlug: "org-squad-two"},
+			},
+			renames: []string{},
+		},
+		{
+			name: "ambiguous name resolved by the github team id",
+			team: &Team{ID: "squad_new", Name: "Squad", ParentID: "tribe", GithubTeamIDs: map[string]int64{"example": 3}},
+			entries: []*githubTeamMappingEntry{
+				{TeamID: "squad_one", TeamName: "Squad", ParentID: "tribe", GithubTeamID: 2, GithubSlug: "org-squad-one"},
+				{TeamID: "squad_two", TeamName: "Squad", ParentID: "tribe", GithubTeamID: 3, GithubSlug: "org-squad-two"},
+			},
+			renames: []string{"squad_two squad_new org-squad-two"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			chart := mappingTestChart(t, test.team)
+			gh := mappingTestGithub("org-squad-one", "org-squad-two")
+
+			applied := gh.applyTeamMapping(chart, mappingTestEntries(test.entries...))
+			renames := renamesOf(applied)
+
+			if !reflect.DeepEqual(renames, test.renames) {
+				t.Fatalf("expected renames %v, got %v", test.renames, renames)
+			}
+
+			result, err := gh.SyncTeams(chart, true)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// a rename edits the github team in place, anything else replaces it
+			renamed := len(test.renames) > 0
+
+			if renamed != (len(result.createdTeams) == 0) {
+				t.Errorf("unexpected created teams %v", result.createdTeams)
+			}
+
+			if renamed && len(result.editedTeams) != 1 {
+				t.Errorf("expected the renamed team to be edited, got %v", result.editedTeams)
+			}
+
+			if renamed && gh.teams[test.team.Github].GetID() != applied[0].team.GetID() {
+				t.Errorf("expected %s to be backed by github team %s", test.team.Github, applied[0].team.GetSlug())
+			}
+		})
+	}
+}
+
+func TestGithubTeamMappingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mapping")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state.json")
+
+	mapping, err := loadGithubTeamMapping(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mapping.Teams) != 0 {
+		t.Fatalf("expected a missing state file to be an empty mapping, got %v", mapping.Teams)
+	}
+
+	chart := mappingTestChart(t, &Team{ID: "squad_one", Name: "Squad One", ParentID: "tribe"})
+	chart.Employees = []*Employee{{ID: "alice", Name: "Alice", Github: "alice", MemberOf: "squad_one"}}
+
+	mapping.update(chart, mappingTestGithub("org-squad-one"))
+
+	if err := mapping.save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// the squad and alice are gone by the next run
+	mapping, err = loadGithubTeamMapping(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mapping.update(mappingTestChart(t), mappingTestGithub())
+
+	expected := []*githubTeamMappingEntry{
+		{TeamID: "squad_one", TeamName: "Squad One", ParentID: "tribe", GithubSlug: "org-squad-one", Removed: true},
+		{TeamID: "tribe", TeamName: "Tribe", GithubTeamID: 1, GithubSlug: "org-tribe"},
+	}
+
+	if !reflect.DeepEqual(mapping.Teams, expected) {
+		t.Errorf("unexpected teams %v", mapping.Teams)
+	}
+
+	if entry, ok := mapping.member("alice"); !ok || !entry.Left || entry.EmployeeID != "alice" {
+		t.Errorf("expected alice to be recorded as having left, got %v", entry)
+	}
+
+	if entry, ok := mapping.entry("squad_one"); !ok || !entry.Removed {
+		t.Errorf("expected squad_one to be recorded as removed, got %v", entry)
+	}
+}
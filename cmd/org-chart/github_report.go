@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+)
+
+// githubSyncReport is the machine readable outcome of a gh-sync run, field names are part
+// of its contract with the jobs consuming it and must stay stable
+type githubSyncReport struct {
+	StartedAt       time.Time          `json:"startedAt"`
+	FinishedAt      time.Time          `json:"finishedAt"`
+	DurationSeconds float64            `json:"durationSeconds"`
+	DryRun          bool               `json:"dryRun"`
+	Orgs            []*githubOrgReport `json:"orgs"`
+}
+
+type githubOrgReport struct {
+	Organisation    string    `json:"organisation"`
+	Error           string    `json:"error,omitempty"`
+	StartedAt       time.Time `json:"startedAt"`
+	FinishedAt      time.Time `json:"finishedAt"`
+	DurationSeconds float64   `json:"durationSeconds"`
+
+	Counts githubReportCounts `json:"counts"`
+
+	CreatedTeams             []string                 `json:"createdTeams"`
+	ReparentedTeams          []string                 `json:"reparentedTeams"`
+	RemovedTeams             []string                 `json:"removedTeams"`
+	RenamedTeams             []githubReportRename     `json:"renamedTeams"`
+	TeamChanges              []githubReportChange     `json:"teamChanges"`
+	MembershipAdditions      []githubReportMembership `json:"membershipAdditions"`
+	MembershipRemovals       []githubReportMembership `json:"membershipRemovals"`
+	RoleChanges              []githubReportChange     `json:"roleChanges"`
+	RepositoryChanges        []githubReportChange     `json:"repositoryChanges"`
+	Invitations              []githubReportEmployee   `json:"invitations"`
+	PendingInvitations       []githubReportEmployee   `json:"pendingInvitations"`
+	ExpiredInvitations       []githubReportInvitation `json:"expiredInvitations"`
+	FailedInvitations        []githubReportFailure    `json:"failedInvitations"`
+	UnableToCreateMembership []githubReportEmployee   `json:"unableToCreateMembership"`
+	UnableToCreateMaintainer []githubReportEmployee   `json:"unableToCreateMaintainer"`
+	MembersNotInOrgChart     []string                 `json:"membersNotInOrgChart"`
+	EmployeesNotInGithub     []githubReportEmployee   `json:"employeesNotInGithub"`
+
+	// githubTeamIDs are the github teams backing org teams once synced, by org team id
+	githubTeamIDs map[string]int64
+}
+
+type githubReportCounts struct {
+	CreatedTeams             int `json:"createdTeams"`
+	ReparentedTeams          int `json:"reparentedTeams"`
+	RemovedTeams             int `json:"removedTeams"`
+	RenamedTeams             int `json:"renamedTeams"`
+	TeamChanges              int `json:"teamChanges"`
+	MembershipAdditions      int `json:"membershipAdditions"`
+	MembershipRemovals       int `json:"membershipRemovals"`
+	RoleChanges              int `json:"roleChanges"`
+	RepositoryChanges        int `json:"repositoryChanges"`
+	Invitations              int `json:"invitations"`
+	PendingInvitations       int `json:"pendingInvitations"`
+	ExpiredInvitations       int `json:"expiredInvitations"`
+	FailedInvitations        int `json:"failedInvitations"`
+	UnableToCreateMembership int `json:"unableToCreateMembership"`
+	UnableToCreateMaintainer int `json:"unableToCreateMaintainer"`
+	MembersNotInOrgChart     int `json:"membersNotInOrgChart"`
+	EmployeesNotInGithub     int `json:"employeesNotInGithub"`
+}
+
+type githubReportRename struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Team string `json:"team"`
+}
+
+// githubReportChange is an attribute of a team, or of a user or repository within it,
+// changing value, an empty from or to means added or removed
+type githubReportChange struct {
+	Team    string `json:"team"`
+	Subject string `json:"subject"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+}
+
+// githubReportMembership is a membership added or removed, with its role when the sync sets one
+type githubReportMembership struct {
+	Team  string `json:"team"`
+	Login string `json:"login"`
+	Role  string `json:"role,omitempty"`
+}
+
+type githubReportEmployee struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Team   string `json:"team"`
+	Github string `json:"github,omitempty"`
+}
+
+type githubReportInvitation struct {
+	Login    string    `json:"login"`
+	FailedAt time.Time `json:"failedAt"`
+	Reason   string    `json:"reason"`
+}
+
+// githubReportFailure is an employee the sync failed to act on, with why
+type githubReportFailure struct {
+	githubReportEmployee
+	Error string `json:"error"`
+}
+
+func newGithubOrgReport(organisation string) *githubOrgReport {
+	return &githubOrgReport{
+		Organisation:             organisation,
+		StartedAt:                time.Now(),
+		CreatedTeams:             []string{},
+		ReparentedTeams:          []string{},
+		RemovedTeams:             []string{},
+		RenamedTeams:             []githubReportRename{},
+		TeamChanges:              []githubReportChange{},
+		MembershipAdditions:      []githubReportMembership{},
+		MembershipRemovals:       []githubReportMembership{},
+		RoleChanges:              []githubReportChange{},
+		RepositoryChanges:        []githubReportChange{},
+		Invitations:              []githubReportEmployee{},
+		PendingInvitations:       []githubReportEmployee{},
+		ExpiredInvitations:       []githubReportInvitation{},
+		FailedInvitations:        []githubReportFailure{},
+		UnableToCreateMembership: []githubReportEmployee{},
+		UnableToCreateMaintainer: []githubReportEmployee{},
+		MembersNotInOrgChart:     []string{},
+		EmployeesNotInGithub:     []githubReportEmployee{},
+	}
+}
+
+func reportEmployees(employees []*Employee) []githubReportEmployee {
+	report := make([]githubReportEmployee, 0, len(employees))
+
+	for _, e := range employees {
+		report = append(report, githubReportEmployee{
+			ID:     e.ID,
+			Name:   e.Name,
+			Team:   e.MemberOf,
+			Github: e.Github,
+		})
+	}
+
+	return report
+}
+
+func (r *githubOrgReport) addSyncResult(result *githubSyncResult) {
+	for _, team := range result.createdTeams {
+		r.CreatedTeams = append(r.CreatedTeams, team.GetSlug())
+	}
+
+	for _, team := range result.reparentedTeams {
+		r.ReparentedTeams = append(r.ReparentedTeams, team.GetSlug())
+	}
+
+	for _, team := range result.removedTeams {
+		r.RemovedTeams = append(r.RemovedTeams, team.GetSlug())
+	}
+
+	for _, edit := range result.editedTeams {
+		for _, change := range edit.changes {
+			r.TeamChanges = append(r.TeamChanges, githubReportChange{edit.team.GetSlug(), change.attribute, change.from, change.to})
+		}
+	}
+
+	for _, change := range result.membershipAdditions {
+		r.MembershipAdditions = append(r.MembershipAdditions, githubReportMembership{change.team.GetSlug(), change.login, change.role})
+	}
+
+	for _, change := range result.membershipRemovals {
+		r.MembershipRemovals = append(r.MembershipRemovals, githubReportMembership{change.team.GetSlug(), change.login, change.role})
+	}
+
+	for _, change := range result.roleChanges {
+		r.RoleChanges = append(r.RoleChanges, githubReportChange{change.team.GetSlug(), change.login, change.from, change.to})
+	}
+
+	r.UnableToCreateMembership = append(r.UnableToCreateMembership, reportEmployees(result.unableToCreateMembership)...)
+	r.UnableToCreateMaintainer = append(r.UnableToCreateMaintainer, reportEmployees(result.unableToCreateMaintainer)...)
+}
+
+func (r *githubOrgReport) addRepositoryChanges(changes []*githubRepositoryChange) {
+	for _, change := range changes {
+		r.RepositoryChanges = append(r.RepositoryChanges, githubReportChange{change.team.GetSlug(), change.repository, change.from, change.to})
+	}
+}
+
+func (r *githubOrgReport) addInvitations(result *githubInvitationResult) {
+	r.Invitations = append(r.Invitations, reportEmployees(result.invited)...)
+	r.PendingInvitations = append(r.PendingInvitations, reportEmployees(result.pending)...)
+
+	for _, failed := range result.expired {
+		r.ExpiredInvitations = append(r.ExpiredInvitations, githubReportInvitation{failed.Login, failed.FailedAt, failed.FailedReason})
+	}
+
+	for _, failure := range result.failed {
+		r.FailedInvitations = append(r.FailedInvitations, githubReportFailure{reportEmployees([]*Employee{failure.employee})[0], failure.err.Error()})
+	}
+}
+
+func (r *githubOrgReport) finish(err error) {
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	r.FinishedAt = time.Now()
+	r.DurationSeconds = r.FinishedAt.Sub(r.StartedAt).Seconds()
+
+	r.Counts = githubReportCounts{
+		CreatedTeams:             len(r.CreatedTeams),
+		ReparentedTeams:          len(r.ReparentedTeams),
+		RemovedTeams:             len(r.RemovedTeams),
+		RenamedTeams:             len(r.RenamedTeams),
+		TeamChanges:              len(r.TeamChanges),
+		MembershipAdditions:      len(r.MembershipAdditions),
+		MembershipRemovals:       len(r.MembershipRemovals),
+		RoleChanges:              len(r.RoleChanges),
+		RepositoryChanges:        len(r.RepositoryChanges),
+		Invitations:              len(r.Invitations),
+		PendingInvitations:       len(r.PendingInvitations),
+		ExpiredInvitations:       len(r.ExpiredInvitations),
+		FailedInvitations:        len(r.FailedInvitations),
+		UnableToCreateMembership: len(r.UnableToCreateMembership),
+		UnableToCreateMaintainer: len(r.UnableToCreateMaintainer),
+		MembersNotInOrgChart:     len(r.MembersNotInOrgChart),
+		EmployeesNotInGithub:     len(r.EmployeesNotInGithub),
+	}
+}
+
+func (r *githubSyncReport) finish() {
+	r.FinishedAt = time.Now()
+	r.DurationSeconds = r.FinishedAt.Sub(r.StartedAt).Seconds()
+}
+
+// failed counts the organisations which failed to sync
+func (r *githubSyncReport) failed() int {
+	failed := 0
+
+	for _, org := range r.Orgs {
+		if org.Error != "" {
+			failed++
+		}
+	}
+
+	return failed
+}
+
+func (r *githubSyncReport) save(path string) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, b, 0644)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"sort"
+
+	"github.com/google/go-github/github"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// githubRepoPermissions lists repository permissions from the weakest to the strongest
+var githubRepoPermissions = []string{"pull", "triage", "push", "maintain", "admin"}
+
+type githubRepositoryChange struct {
+	team       *github.Team
+	repository string
+	from       string
+	to         string
+}
+
+func validRepoPermission(permission string) bool {
+	for _, p := range githubRepoPermissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// repositoryErrors lists the repositories of a team declared with an invalid permission
+func repositoryErrors(t *Team) []error {
+	repos := make([]string, 0, len(t.Repositories))
+
+	for repo := range t.Repositories {
+		repos = append(repos, repo)
+	}
+
+	sort.Strings(repos)
+
+	errs := []error{}
+
+	for _, repo := range repos {
+		if !validRepoPermission(t.Repositories[repo]) {
+			errs = append(errs, errors.Errorf("team %s has invalid permission %q for repository %s", t.ID, t.Repositories[repo], repo))
+		}
+	}
+
+	return errs
+}
+
+// inheritedRepositories resolves the repository permissions a team gets from its ancestors,
+// the closest ancestor declaring a repository wins. A nil map means no ancestor manages
+// repositories.
+func (oc *OrgChart) inheritedRepositories(t *Team) map[string]string {
+
+	parent, ok := oc.TeamsByID[t.ParentID]
+
+	if !ok {
+		return nil
+	}
+
+	inherited := oc.inheritedRepositories(parent)
+
+	if inherited == nil && parent.Repositories == nil {
+		return nil
+	}
+
+	repos := map[string]string{}
+
+	for repo, permission := range inherited {
+		repos[repo] = permission
+	}
+
+	for repo, permission := range parent.Repositories {
+		repos[repo] = permission
+	}
+
+	return repos
+}
+
+// strongerPermission returns the stronger of two repository permissions, either can be empty
+func strongerPermission(a, b string) string {
+	if a == "" {
+		return b
+	}
+
+	if b == "" {
+		return a
+	}
+
+	for _, p := range githubRepoPermissions {
+		if p == a {
+			return b
+		}
+		if p == b {
+			return a
+		}
+	}
+	return a
+}
+
+// repositoryPermission returns the strongest permission a team has on a repository
+func repositoryPermission(repo *github.Repository) string {
+	permission := ""
+
+	for _, p := range githubRepoPermissions {
+		if repo.GetPermissions()[p] {
+			permission = p
+		}
+	}
+
+	return permission
+}
+
+func (gh *GithubState) getTeamRepositories(team *github.Team) (map[string]string, error) {
+
+	ctx := context.Background()
+
+	opt := &github.ListOptions{PerPage: 100}
+
+	repos := map[string]string{}
+
+	for {
+		page, res, err := gh.client.Teams.ListTeamRepos(ctx, team.GetID(), opt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, repo := range page {
+			repos[repo.GetName()] = repositoryPermission(repo)
+		}
+
+		if res.NextPage == 0 {
+			break
+		}
+
+		opt.Page = res.NextPage
+	}
+
+	return repos, nil
+}
+
+// SyncRepositories reconciles the repository permissions of every team which, directly or
+// through an ancestor, declares its repositories in the org chart. Github passes the access of
+// a team on to its child teams, so only the repositories a team declares itself are granted to
+// it, and those it inherits are left alone rather than revoked.
+func (gh *GithubState) SyncRepositories(chart *OrgChart) ([]*githubRepositoryChange, error) {
+
+	changes := []*githubRepositoryChange{}
+
+	for _, t := range chart.Teams {
+
+		inherited := chart.inheritedRepositories(t)
+
+		if inherited == nil && t.Repositories == nil {
+			continue
+		}
+
+		desired := t.Repositories
+
+		team, ok := gh.teams[t.Github]
+
+		if !ok {
+			return changes, errors.Errorf("team %s not found in github", t.Github)
+		}
+
+		current := map[string]string{}
+
+		// teams created during a dry run don't exist in github yet
+		if !gh.dry || !gh.createdTeams[team.GetID()] {
+			var err error
+
+			current, err = gh.getTeamRepositories(team)
+
+			if err != nil {
+				return changes, errors.Wrapf(err, "listing repositories of %s", team.GetSlug())
+			}
+		}
+
+		teamChanges := []*githubRepositoryChange{}
+
+		// github reports the access inherited from ancestors too, so a permission weaker than
+		// the inherited one is already met by it
+		for repo, permission := range desired {
+			if current[repo] != strongerPermission(permission, inherited[repo]) {
+				teamChanges = append(teamChanges, &githubRepositoryChange{team, repo, current[repo], permission})
+			}
+		}
+
+		for repo, permission := range current {
+			if _, ok := desired[repo]; ok {
+				continue
+			}
+
+			if inherited[repo] == permission {
+				continue
+			}
+
+			teamChanges = append(teamChanges, &githubRepositoryChange{team, repo, permission, ""})
+		}
+
+		sort.Slice(teamChanges, func(i, j int) bool {
+			return teamChanges[i].repository < teamChanges[j].repository
+		})
+
+		for _, change := range teamChanges {
+			if err := gh.applyRepositoryChange(change); err != nil {
+				return changes, errors.Wrapf(err, "changing %s access to %s", team.GetSlug(), change.repository)
+			}
+			changes = append(changes, change)
+		}
+	}
+
+	return changes, nil
+}
+
+func (gh *GithubState) applyRepositoryChange(change *githubRepositoryChange) error {
+
+	if change.to == "" {
+		logrus.Debugf("removing %s from %s", change.repository, change.team.GetSlug())
+	} else {
+		logrus.Debugf("granting %s %s access to %s", change.team.GetSlug(), change.to, change.repository)
+	}
+
+	if gh.dry {
+		return nil
+	}
+
+	ctx := context.Background()
+
+	if change.to == "" {
+		_, err := gh.client.Teams.RemoveTeamRepo(ctx, change.team.GetID(), gh.organisation, change.repository)
+		return err
+	}
+
+	_, err := gh.client.Teams.AddTeamRepo(ctx, change.team.GetID(), gh.organisation, change.repository, &github.TeamAddTeamRepoOptions{
+		Permission: change.to,
+	})
+
+	return err
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+func reposTestChart(t *testing.T, teams ...*Team) *OrgChart {
+	chart := &OrgChart{
+		Teams: append([]*Team{
+			{ID: "tribe", Name: "Tribe", Repositories: map[string]string{"api": "push", "web": "pull"}},
+			{ID: "squad", Name: "Squad", ParentID: "tribe", Repositories: map[string]string{"api": "pull", "tools": "admin"}},
+			{ID: "unmanaged", Name: "Unmanaged"},
+		}, teams...),
+		Employees: []*Employee{},
+	}
+
+	if err := chart.organise(); err != nil {
+		t.Fatal(err)
+	}
+
+	chart.assignGithubTeams("org-")
+
+	return chart
+}
+
+// reposTestGithub has the tribe, its squad and a team without repositories in the chart,
+// whose access in github has drifted from the chart
+func reposTestGithub(t *testing.T, dry bool) (*GithubState, *fakeGithub, func()) {
+	fake := &fakeGithub{
+		repos: map[int64]map[string]string{
+			1: {"api": "push", "legacy": "admin"},
+			2: {"tools": "push", "old": "pull"},
+			3: {"anything": "admin"},
+		},
+		parents: map[int64]int64{2: 1},
+	}
+
+	client, server := newFakeGithubClient(fake)
+
+	gh := &GithubState{
+		organisation: "example",
+		teamPrefix:   "org-",
+		client:       client,
+		teams:        map[string]*github.Team{},
+		members:      map[string]*github.User{},
+		dry:          dry,
+	}
+
+	tribe := &github.Team{ID: github.Int64(1), Name: github.String("org-Tribe"), Slug: github.String("org-tribe"), Privacy: github.String("closed")}
+
+	gh.AddTeam(tribe)
+	gh.AddTeam(&github.Team{ID: github.Int64(2), Name: github.String("org-Squad"), Slug: github.String("org-squad"), Privacy: github.String("closed"), Parent: tribe})
+	gh.AddTeam(&github.Team{ID: github.Int64(3), Name: github.String("org-Unmanaged"), Slug: github.String("org-unmanaged"), Privacy: github.String("closed")})
+
+	gh.resetSyncResult()
+
+	return gh, fake, server.Close
+}
+
+func repositoryChanges(changes []*githubRepositoryChange) []string {
+	got := []string{}
+
+	for _, change := range changes {
+		got = append(got, change.team.GetSlug()+" "+change.repository+" "+change.from+" -> "+change.to)
+	}
+
+	return got
+}
+
+func TestSyncRepositories(t *testing.T) {
+	chart := reposTestChart(t)
+	gh, fake, done := reposTestGithub(t, false)
+	defer done()
+
+	changes, err := gh.SyncRepositories(chart)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the squad declares pull on api but gets push from the tribe, which is left alone
+	expected := []string{
+		"org-tribe legacy admin -> ",
+		"org-tribe web  -> pull",
+		"org-squad old pull -> ",
+		"org-squad tools push -> admin",
+	}
+
+	if got := repositoryChanges(changes); !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected changes %v", got)
+	}
+
+	calls := append([]string{}, fake.calls...)
+	sort.Strings(calls)
+
+	expectedCalls := []string{
+		"DELETE /teams/1/repos/example/legacy",
+		"DELETE /teams/2/repos/example/old",
+		"PUT /teams/1/repos/example/web",
+		"PUT /teams/2/repos/example/tools",
+	}
+
+	if !reflect.DeepEqual(calls, expectedCalls) {
+		t.Errorf("unexpected calls %v", calls)
+	}
+
+	if !reflect.DeepEqual(fake.repos[3], map[string]string{"anything": "admin"}) {
+		t.Errorf("expected a team without repositories in the chart to be left alone, got %v", fake.repos[3])
+	}
+
+	changes, err = gh.SyncRepositories(chart)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(changes) > 0 {
+		t.Errorf("expected a second sync to change nothing, got %v", repositoryChanges(changes))
+	}
+}
+
+func TestSyncRepositoriesDryRun(t *testing.T) {
+	chart := reposTestChart(t, &Team{ID: "new_squad", Name: "New Squad", ParentID: "tribe", Repositories: map[string]string{"tools": "push"}})
+	gh, fake, done := reposTestGithub(t, true)
+	defer done()
+
+	if _, err := gh.SyncTeams(chart, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(gh.syncResult.createdTeams) != 1 {
+		t.Fatalf("expected new_squad to be created, got %v", gh.syncResult.createdTeams)
+	}
+
+	changes, err := gh.SyncRepositories(chart)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created := []string{}
+
+	for _, change := range repositoryChanges(changes) {
+		if strings.HasPrefix(change, "org-new-squad ") {
+			created = append(created, change)
+		}
+	}
+
+	// the team created by the dry run isn't listed, it has no access yet
+	if !reflect.DeepEqual(created, []string{"org-new-squad tools  -> push"}) {
+		t.Errorf("unexpected changes of the created team %v", created)
+	}
+
+	if len(fake.calls) > 0 {
+		t.Errorf("unexpected changes in a dry run %v", fake.calls)
+	}
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// githubSyncTarget describes a github organisation synced from the org chart, several can
+// be synced from a single chart through a gh-sync config file
+type githubSyncTarget struct {
+	Organisation string `json:"organisation"`
+	// TokenEnv names the environment variable holding the token for this organisation,
+	// the --github-token is used when empty
+	TokenEnv           string              `json:"tokenEnv"`
+	TeamPrefix         string              `json:"teamPrefix"`
+	TeamPrivacy        string              `json:"teamPrivacy"`
+	MembershipStrategy string              `json:"membershipStrategy"`
+	Roots              []string            `json:"roots"`
+	TeamKinds          []string            `json:"teamKinds"`
+	Filter             *githubMemberFilter `json:"filter"`
+	StateFile          string              `json:"stateFile"`
+	MaxTeamRemovals    int                 `json:"maxTeamRemovals"`
+	SkipMembers        bool                `json:"skipMembers"`
+	MaintainerRoles    bool                `json:"maintainerRoles"`
+	InviteMembers      bool                `json:"inviteMembers"`
+	Repos              bool                `json:"repos"`
+}
+
+type githubSyncConfig struct {
+	Orgs []*githubSyncTarget `json:"orgs"`
+}
+
+func loadGithubSyncConfig(path string) ([]*githubSyncTarget, error) {
+	b, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var config githubSyncConfig
+
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", path)
+	}
+
+	if len(config.Orgs) == 0 {
+		return nil, errors.Errorf("no github organisations configured in %s", path)
+	}
+
+	for _, target := range config.Orgs {
+		if target.Organisation == "" {
+			return nil, errors.Errorf("github organisation without a name in %s", path)
+		}
+		if target.TeamPrefix == "" {
+			target.TeamPrefix = "org-"
+		}
+		if target.TeamPrivacy == "" {
+			target.TeamPrivacy = "closed"
+		}
+		if target.MembershipStrategy == "" {
+			target.MembershipStrategy = membershipDirect
+		}
+	}
+
+	return config.Orgs, nil
+}
+
+func githubSyncTargetFromFlags(c *cli.Context) *githubSyncTarget {
+	return &githubSyncTarget{
+		Organisation:       c.String("github-org"),
+		TeamPrefix:         c.String("github-team-prefix"),
+		TeamPrivacy:        c.String("github-team-privacy"),
+		MembershipStrategy: c.String("membership-strategy"),
+		Filter: &githubMemberFilter{
+			IncludeTypes:     c.StringSlice("include-type"),
+			ExcludeTypes:     c.StringSlice("exclude-type"),
+			IncludeStreams:   c.StringSlice("include-stream"),
+			ExcludeStreams:   c.StringSlice("exclude-stream"),
+			IncludeTeamKinds: c.StringSlice("include-team-kind"),
+			ExcludeTeamKinds: c.StringSlice("exclude-team-kind"),
+			DropTypes:        c.StringSlice("drop-type"),
+			ExcludedTeam:     c.String("excluded-team"),
+		},
+		StateFile:       c.String("github-state-file"),
+		MaxTeamRemovals: c.Int("max-team-removals"),
+		SkipMembers:     c.Bool("skip-members"),
+		MaintainerRoles: c.Bool("maintainer-roles"),
+		InviteMembers:   c.Bool("invite-members"),
+		Repos:           c.Bool("repos"),
+	}
+}
+
+// subset copies the part of the org chart made of the subtrees under roots, restricted to
+// teams of the given kinds. Teams whose parent is left out are attached to their closest
+// included ancestor, and so are the employees of teams left out for their kind, a subset
+// leaving such employees without any team is refused. Leads outside of the subset can still
+// be looked up by id.
+func (oc *OrgChart) subset(roots []string, kinds []string) (*OrgChart, error) {
+
+	inRoots := map[string]bool{}
+
+	if len(roots) == 0 {
+		for _, t := range oc.Teams {
+			inRoots[t.ID] = true
+		}
+	}
+
+	for _, root := range roots {
+		t, ok := oc.TeamsByID[root]
+
+		if !ok {
+			return nil, errors.Errorf("could not find root team %s", root)
+		}
+
+		for _, descendant := range oc.subtree(t) {
+			inRoots[descendant.ID] = true
+		}
+	}
+
+	included := map[string]bool{}
+
+	for id := range inRoots {
+		if len(kinds) == 0 || matchesAny(oc.TeamsByID[id].Kind, kinds) {
+			included[id] = true
+		}
+	}
+
+	closestIncluded := func(t *Team) *Team {
+		for t != nil && !included[t.ID] {
+			t = oc.TeamsByID[t.ParentID]
+		}
+		return t
+	}
+
+	sub := &OrgChart{
+		Employees: []*Employee{},
+		Teams:     []*Team{},
+	}
+
+	for _, t := range oc.Teams {
+		if !included[t.ID] {
+			continue
+		}
+
+		team := *t
+		team.ParentID = ""
+
+		if parent := closestIncluded(oc.TeamsByID[t.ParentID]); parent != nil {
+			team.ParentID = parent.ID
+		}
+
+		sub.Teams = append(sub.Teams, &team)
+	}
+
+	for _, e := range oc.Employees {
+		if !inRoots[e.MemberOf] {
+			continue
+		}
+
+		team := closestIncluded(oc.TeamsByID[e.MemberOf])
+
+		if team == nil {
+			return nil, errors.Errorf("employee %s would be left without a team, %s and all of its ancestors are left out by their kind", e.ID, e.MemberOf)
+		}
+
+		employee := *e
+		employee.MemberOf = team.ID
+		sub.Employees = append(sub.Employees, &employee)
+	}
+
+	if err := sub.organise(); err != nil {
+		return nil, err
+	}
+
+	for id, e := range oc.EmployeesByID {
+		if _, ok := sub.EmployeesByID[id]; !ok {
+			sub.EmployeesByID[id] = e
+		}
+	}
+
+	return sub, nil
+}
+
+// runGithubSync syncs every target organisation, carrying on when one of them fails
+func runGithubSync(orgChart *OrgChart, targets []*githubSyncTarget, token string, dry bool) *githubSyncReport {
+
+	report := &githubSyncReport{
+		StartedAt: time.Now(),
+		DryRun:    dry,
+		Orgs:      []*githubOrgReport{},
+	}
+
+	for _, target := range targets {
+		log := logrus.WithField("org", target.Organisation)
+
+		orgReport := newGithubOrgReport(target.Organisation)
+		report.Orgs = append(report.Orgs, orgReport)
+
+		err := syncGithubTarget(orgChart, target, token, dry, log, orgReport)
+
+		orgReport.finish(err)
+
+		if err != nil {
+			log.Errorf("sync failed: %v", err)
+			continue
+		}
+
+		log.Info("sync completed")
+	}
+
+	report.finish()
+
+	return report
+}
+
+// syncGithubTarget reconciles a github organisation with its part of the org chart,
+// recording the outcome in report
+func syncGithubTarget(chart *OrgChart, target *githubSyncTarget, token string, dry bool, log *logrus.Entry, report *githubOrgReport) error {
+
+	orgChart, err := chart.subset(target.Roots, target.TeamKinds)
+
+	if err != nil {
+		return errors.Wrap(err, "selecting org chart teams")
+	}
+
+	orgChart.assignGithubTeams(target.TeamPrefix)
+
+	if target.TokenEnv != "" {
+		token = os.Getenv(target.TokenEnv)
+	}
+
+	if !validMembershipStrategy(target.MembershipStrategy) {
+		return errors.Errorf("invalid membership strategy %s", target.MembershipStrategy)
+	}
+
+	// membership strategies are checked before anything changes in github
+	for _, t := range orgChart.Teams {
+		if t.GithubMembership != "" && !validMembershipStrategy(t.GithubMembership) {
+			return errors.Errorf("invalid membership strategy %s for team %s", t.GithubMembership, t.ID)
+		}
+	}
+
+	if target.TeamPrivacy != "" && !validGithubPrivacy(target.TeamPrivacy) {
+		return errors.Errorf("invalid team privacy %s, expected secret or closed", target.TeamPrivacy)
+	}
+
+	// repository permissions are checked before anything changes in github
+	if target.Repos {
+		for _, t := range orgChart.Teams {
+			if errs := repositoryErrors(t); len(errs) > 0 {
+				return errs[0]
+			}
+		}
+	}
+
+	if target.Filter != nil {
+		if excluded := target.Filter.ExcludedTeam; excluded != "" && !strings.HasPrefix(excluded, target.TeamPrefix) {
+			return errors.Errorf("excluded team %s must start with the team prefix %s", excluded, target.TeamPrefix)
+		}
+	}
+
+	gh, err := newGithubState(token, target.Organisation, target.TeamPrefix)
+
+	if err != nil {
+		return errors.Wrap(err, "retrieving github data")
+	}
+
+	gh.dry = dry
+	gh.defaultPrivacy = target.TeamPrivacy
+	gh.maxTeamRemovals = target.MaxTeamRemovals
+	gh.maintainerRoles = target.MaintainerRoles
+	gh.membershipStrategyDefault = target.MembershipStrategy
+	gh.memberFilter = target.Filter
+
+	if gh.dry {
+		log.Info("running in DRY mode")
+	}
+
+	var teamMapping *githubTeamMapping
+
+	if target.StateFile != "" {
+		teamMapping, err = loadGithubTeamMapping(target.StateFile)
+
+		if err != nil {
+			return errors.Wrap(err, "loading github state file")
+		}
+
+		if teamMapping.Organisation != "" && teamMapping.Organisation != target.Organisation {
+			return errors.Errorf("github state file belongs to organisation %s", teamMapping.Organisation)
+		}
+
+		for _, rename := range gh.applyTeamMapping(orgChart, teamMapping) {
+			log.Infof("team %s was renamed to %s, github team %s will be renamed in place", rename.from, rename.to, rename.team.GetSlug())
+			report.RenamedTeams = append(report.RenamedTeams, githubReportRename{rename.from, rename.to, rename.team.GetSlug()})
+		}
+	}
+
+	if target.SkipMembers {
+		log.Infof("skipping members sync")
+	}
+
+	for _, m := range githubMembersNotInOrgchart(orgChart, gh) {
+		log.Infof("github user %s not found in orgchart", m.GetLogin())
+		report.MembersNotInOrgChart = append(report.MembersNotInOrgChart, m.GetLogin())
+	}
+
+	notInGithub := employeesNotInGithub(orgChart, gh)
+
+	for _, m := range notInGithub {
+		log.Infof("employee %s (%s) not found in github", m.Name, m.Github)
+	}
+
+	report.EmployeesNotInGithub = reportEmployees(notInGithub)
+
+	if target.InviteMembers {
+		invitations, err := gh.InviteMembers(orgChart)
+
+		report.addInvitations(invitations)
+
+		for _, e := range invitations.pending {
+			log.Infof("employee %s (%s) has a pending invitation to github", e.Name, e.Github)
+		}
+
+		for _, failed := range invitations.expired {
+			log.Infof("invitation of %s to github failed at %s: %s", failed.Login, failed.FailedAt.Format(time.RFC3339), failed.FailedReason)
+		}
+
+		for _, e := range invitations.invited {
+			log.Infof("invited employee %s (%s) to github", e.Name, e.Github)
+		}
+
+		for _, failure := range invitations.failed {
+			log.Warnf("could not invite employee %s (%s) to github: %v", failure.employee.Name, failure.employee.Github, failure.err)
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "inviting members")
+		}
+	}
+
+	for _, t := range githubTeamsNotInOrgchart(orgChart, gh) {
+		log.Infof("github team %s not found in orgchart, will be removed", t.GetName())
+	}
+
+	for _, m := range teamsNotInGithub(orgChart, gh) {
+		log.Infof("team %s (%s) not found in github, will be added", m.Name, m.Github)
+	}
+
+	result, err := gh.SyncTeams(orgChart, target.SkipMembers)
+
+	report.addSyncResult(result)
+
+	if err != nil {
+		return errors.Wrap(err, "syncing teams")
+	}
+
+	for _, team := range result.createdTeams {
+		log.Infof("created %s in github", team.GetName())
+	}
+
+	for _, team := range result.reparentedTeams {
+		log.Infof("reparented %s in github", team.GetName())
+	}
+
+	for _, edit := range result.editedTeams {
+		for _, change := range edit.changes {
+			log.Infof("changed %s of %s in github from %q to %q", change.attribute, edit.team.GetSlug(), change.from, change.to)
+		}
+	}
+
+	for _, team := range result.removedTeams {
+		log.Infof("removed %s from github", team.GetName())
+	}
+
+	for _, employee := range result.unableToCreateMembership {
+		log.Infof("unable to add member %s to %s team, github handle not provided", employee.Name, employee.MemberOf)
+	}
+
+	for _, employee := range result.unableToCreateMaintainer {
+		log.Infof("unable to add maintainer %s to %s team, github handle not provided", employee.Name, employee.MemberOf)
+	}
+
+	if target.Repos {
+		changes, err := gh.SyncRepositories(orgChart)
+
+		report.addRepositoryChanges(changes)
+
+		for _, change := range changes {
+			switch {
+			case change.from == "":
+				log.Infof("granted %s %s access to %s in github", change.team.GetSlug(), change.to, change.repository)
+			case change.to == "":
+				log.Infof("removed %s access to %s in github", change.team.GetSlug(), change.repository)
+			default:
+				log.Infof("changed %s access to %s in github from %s to %s", change.team.GetSlug(), change.repository, change.from, change.to)
+			}
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "syncing repositories")
+		}
+	}
+
+	if !gh.dry {
+		report.githubTeamIDs = map[string]int64{}
+
+		for _, t := range orgChart.Teams {
+			if ghTeam, ok := gh.teams[t.Github]; ok {
+				report.githubTeamIDs[t.ID] = ghTeam.GetID()
+			}
+		}
+	}
+
+	if teamMapping != nil && !gh.dry {
+		teamMapping.Organisation = target.Organisation
+		teamMapping.update(orgChart, gh)
+
+		if err := teamMapping.save(target.StateFile); err != nil {
+			return errors.Wrap(err, "saving github state file")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+)
+
+func subsetTestChart(t *testing.T) *OrgChart {
+	chart := &OrgChart{
+		Teams: []*Team{
+			{ID: "company", Kind: "Company"},
+			{ID: "tribe", Kind: "Tribe", ParentID: "company"},
+			{ID: "squad", Kind: "Squad", ParentID: "tribe"},
+			{ID: "chapter", Kind: "Chapter", ParentID: "squad"},
+			{ID: "other", Kind: "Tribe", ParentID: "company"},
+		},
+		Employees: []*Employee{
+			{ID: "a", MemberOf: "squad"},
+			{ID: "b", MemberOf: "chapter"},
+			{ID: "c", MemberOf: "other"},
+		},
+	}
+
+	if err := chart.organise(); err != nil {
+		t.Fatal(err)
+	}
+
+	return chart
+}
+
+func TestSubsetRollsUpEmployeesOfExcludedKinds(t *testing.T) {
+	chart := subsetTestChart(t)
+
+	sub, err := chart.subset([]string{"tribe"}, []string{"tribe", "squad"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	teams := map[string]string{}
+
+	for _, team := range sub.Teams {
+		teams[team.ID] = team.ParentID
+	}
+
+	if len(teams) != 2 || teams["tribe"] != "" || teams["squad"] != "tribe" {
+		t.Errorf("unexpected teams %v", teams)
+	}
+
+	members := map[string]string{}
+
+	for _, e := range sub.Employees {
+		members[e.ID] = e.MemberOf
+	}
+
+	if len(members) != 2 || members["a"] != "squad" || members["b"] != "squad" {
+		t.Errorf("unexpected members %v", members)
+	}
+}
+
+func TestSubsetRefusesToOrphanEmployees(t *testing.T) {
+	chart := subsetTestChart(t)
+
+	if _, err := chart.subset([]string{"tribe"}, []string{"chapter"}); err == nil {
+		t.Error("expected employee a to be left without a team")
+	}
+}
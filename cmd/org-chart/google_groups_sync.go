@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2/google"
+	admin "google.golang.org/api/admin/directory/v1"
+	"google.golang.org/api/option"
+)
+
+const (
+	googleRoleOwner   = "OWNER"
+	googleRoleManager = "MANAGER"
+	googleRoleMember  = "MEMBER"
+)
+
+// GoogleGroupsState holds the Google Workspace groups the org chart is synced to
+type GoogleGroupsState struct {
+	service      *admin.Service
+	customer     string
+	emailPattern string
+	strategy     string
+	groups       map[string]*admin.Group
+	dry          bool
+
+	maxGroupRemovals  int
+	maxMemberRemovals int
+}
+
+// newDirectoryService connects to the Admin SDK Directory API. Groups can only be managed by
+// a service account acting as a workspace admin through domain wide delegation, without
+// credentials requests are sent unauthenticated, which is only of use against a fake API.
+func newDirectoryService(ctx context.Context, credentialsFile, subject, apiURL string) (*admin.Service, error) {
+
+	opts := []option.ClientOption{}
+
+	if apiURL != "" {
+		opts = append(opts, option.WithEndpoint(apiURL))
+	}
+
+	if credentialsFile == "" {
+		return admin.NewService(ctx, append(opts, option.WithoutAuthentication())...)
+	}
+
+	b, err := ioutil.ReadFile(credentialsFile)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "reading credentials")
+	}
+
+	config, err := google.JWTConfigFromJSON(b, admin.AdminDirectoryGroupScope)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing credentials")
+	}
+
+	config.Subject = subject
+
+	return admin.NewService(ctx, append(opts, option.WithTokenSource(config.TokenSource(ctx)))...)
+}
+
+// groupEmail is the address of the group of an org team, its id in place of {id} in the pattern
+func (g *GoogleGroupsState) groupEmail(t *Team) string {
+	return strings.ToLower(strings.Replace(g.emailPattern, "{id}", t.ID, -1))
+}
+
+// managed tells whether a group address follows the pattern, only those groups are removed
+func (g *GoogleGroupsState) managed(email string) bool {
+	parts := strings.SplitN(strings.ToLower(g.emailPattern), "{id}", 2)
+
+	return len(email) > len(parts[0])+len(parts[1]) &&
+		strings.HasPrefix(email, parts[0]) &&
+		strings.HasSuffix(email, parts[1])
+}
+
+func (g *GoogleGroupsState) load(ctx context.Context) error {
+
+	g.groups = map[string]*admin.Group{}
+
+	return g.service.Groups.List().Customer(g.customer).MaxResults(200).Pages(ctx, func(page *admin.Groups) error {
+		for _, group := range page.Groups {
+			if email := strings.ToLower(group.Email); g.managed(email) {
+				g.groups[email] = group
+			}
+		}
+		return nil
+	})
+}
+
+// members returns the users in a group by address, groups and other kinds of member aren't
+// managed by the sync
+func (g *GoogleGroupsState) members(ctx context.Context, groupEmail string) (map[string]*admin.Member, error) {
+
+	members := map[string]*admin.Member{}
+
+	err := g.service.Members.List(groupEmail).MaxResults(200).Pages(ctx, func(page *admin.Members) error {
+		for _, m := range page.Members {
+			if m.Type == "" || m.Type == "USER" {
+				members[strings.ToLower(m.Email)] = m
+			}
+		}
+		return nil
+	})
+
+	return members, err
+}
+
+// googleGroupPlan is the group an org team should have, with the role of each member by address
+type googleGroupPlan struct {
+	team    *Team
+	email   string
+	members map[string]string
+}
+
+// googleGroupsSyncReport is the machine readable outcome of a google-groups-sync run
+type googleGroupsSyncReport struct {
+	StartedAt           time.Time                `json:"startedAt"`
+	FinishedAt          time.Time                `json:"finishedAt"`
+	DryRun              bool                     `json:"dryRun"`
+	Error               string                   `json:"error,omitempty"`
+	Customer            string                   `json:"customer"`
+	CreatedGroups       []string                 `json:"createdGroups"`
+	RemovedGroups       []string                 `json:"removedGroups"`
+	GroupChanges        []googleReportChange     `json:"groupChanges"`
+	MembershipAdditions []googleReportMember     `json:"membershipAdditions"`
+	MembershipRemovals  []googleReportMember     `json:"membershipRemovals"`
+	RoleChanges         []googleReportRoleChange `json:"roleChanges"`
+	UnmatchedEmployees  []syncReportEmployee     `json:"unmatchedEmployees"`
+}
+
+type googleReportChange struct {
+	Group   string `json:"group"`
+	Subject string `json:"subject"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+}
+
+type googleReportMember struct {
+	Group  string `json:"group"`
+	Member string `json:"member"`
+	Role   string `json:"role"`
+}
+
+type googleReportRoleChange struct {
+	Group  string `json:"group"`
+	Member string `json:"member"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+}
+
+func newGoogleGroupsSyncReport(customer string, dry bool) *googleGroupsSyncReport {
+	return &googleGroupsSyncReport{
+		StartedAt:           time.Now(),
+		DryRun:              dry,
+		Customer:            customer,
+		CreatedGroups:       []string{},
+		RemovedGroups:       []string{},
+		GroupChanges:        []googleReportChange{},
+		MembershipAdditions: []googleReportMember{},
+		MembershipRemovals:  []googleReportMember{},
+		RoleChanges:         []googleReportRoleChange{},
+		UnmatchedEmployees:  []syncReportEmployee{},
+	}
+}
+
+func (r *googleGroupsSyncReport) finish(err error) {
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	r.FinishedAt = time.Now()
+}
+
+func (r *googleGroupsSyncReport) save(path string) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// teamMembers returns the employees of a team other than its leads according to a membership
+// strategy, rolling up includes the members and leads of descendant teams
+func (oc *OrgChart) teamMembers(t *Team, strategy string) ([]*Employee, error) {
+
+	members := []*Employee{}
+
+	switch strategy {
+	case membershipDirect:
+		members = append(members, oc.teamEmployees[t.ID]...)
+	case membershipRolledUp:
+		for _, descendant := range oc.subtree(t) {
+			members = append(members, oc.teamEmployees[descendant.ID]...)
+
+			if descendant == t {
+				continue
+			}
+
+			leads, err := oc.leads(descendant)
+
+			if err != nil {
+				return nil, err
+			}
+
+			members = append(members, leads...)
+		}
+	case membershipLeadsOnly:
+	default:
+		return nil, errors.Errorf("invalid membership strategy %s for team %s", strategy, t.ID)
+	}
+
+	return members, nil
+}
+
+// Sync reconciles a group per team, with leads as managers and the employees the membership
+// strategy selects as members, removing groups following the pattern of teams no longer in
+// the chart. Owners are left as they are, they are usually the admins of the group.
+func (g *GoogleGroupsState) Sync(ctx context.Context, chart *OrgChart, report *googleGroupsSyncReport) error {
+
+	unmatched := []*Employee{}
+
+	for _, e := range chart.Employees {
+		if strings.TrimSpace(e.Email) == "" {
+			unmatched = append(unmatched, e)
+		}
+	}
+
+	sort.Slice(unmatched, func(i, j int) bool {
+		return unmatched[i].ID < unmatched[j].ID
+	})
+
+	report.UnmatchedEmployees = unmatchedEmployees(unmatched, false)
+
+	plans := map[string]*googleGroupPlan{}
+
+	for _, t := range chart.Teams {
+		plan := &googleGroupPlan{
+			team:    t,
+			email:   g.groupEmail(t),
+			members: map[string]string{},
+		}
+
+		members, err := chart.teamMembers(t, g.strategy)
+
+		if err != nil {
+			return err
+		}
+
+		for _, e := range members {
+			if email := strings.ToLower(strings.TrimSpace(e.Email)); email != "" {
+				plan.members[email] = googleRoleMember
+			}
+		}
+
+		leads, err := chart.leads(t)
+
+		if err != nil {
+			return err
+		}
+
+		for _, lead := range leads {
+			if email := strings.ToLower(strings.TrimSpace(lead.Email)); email != "" {
+				plan.members[email] = googleRoleManager
+			}
+		}
+
+		plans[plan.email] = plan
+	}
+
+	toRemove := []string{}
+
+	for email := range g.groups {
+		if _, ok := plans[email]; !ok {
+			toRemove = append(toRemove, email)
+		}
+	}
+
+	sort.Strings(toRemove)
+
+	current := map[string]map[string]*admin.Member{}
+	memberRemovals := 0
+
+	for email, plan := range plans {
+		if _, ok := g.groups[email]; !ok {
+			continue
+		}
+
+		members, err := g.members(ctx, email)
+
+		if err != nil {
+			return errors.Wrapf(err, "listing members of %s", email)
+		}
+
+		current[email] = members
+
+		for address, m := range members {
+			if _, ok := plan.members[address]; !ok && m.Role != googleRoleOwner {
+				memberRemovals++
+			}
+		}
+	}
+
+	for _, err := range []error{
+		checkRemovalThreshold("google groups", len(toRemove), g.maxGroupRemovals),
+		checkRemovalThreshold("google group members", memberRemovals, g.maxMemberRemovals),
+	} {
+		if err == nil {
+			continue
+		}
+
+		if !g.dry {
+			return err
+		}
+
+		logrus.Warn(err)
+	}
+
+	emails := []string{}
+
+	for email := range plans {
+		emails = append(emails, email)
+	}
+
+	sort.Strings(emails)
+
+	for _, email := range emails {
+		if err := g.syncGroup(ctx, plans[email], current[email], report); err != nil {
+			return errors.Wrapf(err, "syncing group %s", email)
+		}
+	}
+
+	for _, email := range toRemove {
+		if !g.dry {
+			if err := g.service.Groups.Delete(email).Context(ctx).Do(); err != nil {
+				return errors.Wrapf(err, "removing group %s", email)
+			}
+		}
+
+		report.RemovedGroups = append(report.RemovedGroups, email)
+	}
+
+	return nil
+}
+
+func (g *GoogleGroupsState) syncGroup(ctx context.Context, plan *googleGroupPlan, current map[string]*admin.Member, report *googleGroupsSyncReport) error {
+
+	group, ok := g.groups[plan.email]
+
+	if !ok {
+		if !g.dry {
+			_, err := g.service.Groups.Insert(&admin.Group{
+				Email:       plan.email,
+				Name:        plan.team.Name,
+				Description: plan.team.Description,
+			}).Context(ctx).Do()
+
+			if err != nil {
+				return err
+			}
+		}
+
+		report.CreatedGroups = append(report.CreatedGroups, plan.email)
+		current = map[string]*admin.Member{}
+	} else {
+		patch := &admin.Group{}
+
+		if group.Name != plan.team.Name {
+			patch.Name = plan.team.Name
+			report.GroupChanges = append(report.GroupChanges, googleReportChange{plan.email, "name", group.Name, plan.team.Name})
+		}
+
+		if group.Description != plan.team.Description {
+			patch.Description = plan.team.Description
+			patch.ForceSendFields = []string{"Description"}
+			report.GroupChanges = append(report.GroupChanges, googleReportChange{plan.email, "description", group.Description, plan.team.Description})
+		}
+
+		if (patch.Name != "" || patch.ForceSendFields != nil) && !g.dry {
+			if _, err := g.service.Groups.Patch(plan.email, patch).Context(ctx).Do(); err != nil {
+				return err
+			}
+		}
+	}
+
+	addresses := []string{}
+
+	for address := range plan.members {
+		addresses = append(addresses, address)
+	}
+
+	sort.Strings(addresses)
+
+	for _, address := range addresses {
+		role := plan.members[address]
+		member, ok := current[address]
+
+		switch {
+		case !ok:
+			if !g.dry {
+				if _, err := g.service.Members.Insert(plan.email, &admin.Member{Email: address, Role: role}).Context(ctx).Do(); err != nil {
+					return errors.Wrapf(err, "adding %s", address)
+				}
+			}
+
+			report.MembershipAdditions = append(report.MembershipAdditions, googleReportMember{plan.email, address, role})
+		case member.Role != role && member.Role != googleRoleOwner:
+			if !g.dry {
+				if _, err := g.service.Members.Patch(plan.email, address, &admin.Member{Role: role}).Context(ctx).Do(); err != nil {
+					return errors.Wrapf(err, "changing role of %s", address)
+				}
+			}
+
+			report.RoleChanges = append(report.RoleChanges, googleReportRoleChange{plan.email, address, member.Role, role})
+		}
+	}
+
+	removals := []string{}
+
+	for address, member := range current {
+		if _, ok := plan.members[address]; !ok && member.Role != googleRoleOwner {
+			removals = append(removals, address)
+		}
+	}
+
+	sort.Strings(removals)
+
+	for _, address := range removals {
+		if !g.dry {
+			if err := g.service.Members.Delete(plan.email, address).Context(ctx).Do(); err != nil {
+				return errors.Wrapf(err, "removing %s", address)
+			}
+		}
+
+		report.MembershipRemovals = append(report.MembershipRemovals, googleReportMember{plan.email, address, current[address].Role})
+	}
+
+	return nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	admin "google.golang.org/api/admin/directory/v1"
+)
+
+// fakeDirectory stands in for the groups and members of the admin sdk directory api
+type fakeDirectory struct {
+	groups  map[string]*admin.Group
+	members map[string]map[string]*admin.Member
+	calls   []string
+}
+
+func (f *fakeDirectory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	if r.Method != http.MethodGet {
+		f.calls = append(f.calls, r.Method+" "+strings.Join(parts, "/"))
+	}
+
+	reply := func(body interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(body)
+	}
+
+	decode := func(v interface{}) bool {
+		if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return false
+		}
+		return true
+	}
+
+	if parts[0] != "groups" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		groups := []*admin.Group{}
+
+		for _, g := range f.groups {
+			groups = append(groups, g)
+		}
+
+		sort.Slice(groups, func(i, j int) bool {
+			return groups[i].Email < groups[j].Email
+		})
+
+		reply(&admin.Groups{Groups: groups})
+	case len(parts) == 1 && r.Method == http.MethodPost:
+		var g admin.Group
+
+		if decode(&g) {
+			f.groups[g.Email] = &g
+			f.members[g.Email] = map[string]*admin.Member{}
+			reply(&g)
+		}
+	case len(parts) == 2 && r.Method == http.MethodPatch:
+		var patch admin.Group
+
+		if decode(&patch) {
+			g := f.groups[parts[1]]
+
+			if patch.Name != "" {
+				g.Name = patch.Name
+			}
+
+			g.Description = patch.Description
+			reply(g)
+		}
+	case len(parts) == 2 && r.Method == http.MethodDelete:
+		delete(f.groups, parts[1])
+		delete(f.members, parts[1])
+	case len(parts) == 3 && r.Method == http.MethodGet:
+		members := []*admin.Member{}
+
+		for _, m := range f.members[parts[1]] {
+			members = append(members, m)
+		}
+
+		reply(&admin.Members{Members: members})
+	case len(parts) == 3 && r.Method == http.MethodPost:
+		var m admin.Member
+
+		if decode(&m) {
+			f.members[parts[1]][m.Email] = &m
+			reply(&m)
+		}
+	case len(parts) == 4 && r.Method == http.MethodPatch:
+		var patch admin.Member
+
+		if decode(&patch) {
+			m := f.members[parts[1]][parts[3]]
+			m.Role = patch.Role
+			reply(m)
+		}
+	case len(parts) == 4 && r.Method == http.MethodDelete:
+		delete(f.members[parts[1]], parts[3])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newGoogleGroupsTestFixture(t *testing.T) (*OrgChart, *fakeDirectory) {
+	chart := &OrgChart{
+		Teams: []*Team{
+			{ID: "tribe", Name: "Tribe", Kind: "Tribe", TeachLeadID: "lead"},
+			{ID: "squad_one", Name: "Squad One", Description: "the first", Kind: "Squad", ParentID: "tribe", TeachLeadID: "alice"},
+		},
+		Employees: []*Employee{
+			{ID: "lead", Name: "Lead", MemberOf: "tribe", Email: "lead@example.com", Stream: "ENGINEERING"},
+			{ID: "alice", Name: "Alice", MemberOf: "squad_one", Email: "Alice@Example.com", Stream: "ENGINEERING"},
+			{ID: "bob", Name: "Bob", MemberOf: "squad_one", Email: "bob@example.com", Stream: "ENGINEERING"},
+			{ID: "carol", Name: "Carol", MemberOf: "squad_one", Stream: "ENGINEERING", Slack: "U0CAROL"},
+		},
+	}
+
+	if err := chart.organise(); err != nil {
+		t.Fatal(err)
+	}
+
+	fake := &fakeDirectory{
+		groups: map[string]*admin.Group{
+			"team-squad_one@example.com": {Email: "team-squad_one@example.com", Name: "Squad 1", Description: "the first"},
+			"team-gone@example.com":      {Email: "team-gone@example.com", Name: "Gone"},
+			"everyone@example.com":       {Email: "everyone@example.com", Name: "Everyone"},
+		},
+		members: map[string]map[string]*admin.Member{
+			"team-squad_one@example.com": {
+				"alice@example.com":  {Email: "alice@example.com", Role: googleRoleMember, Type: "USER"},
+				"leaver@example.com": {Email: "leaver@example.com", Role: googleRoleMember, Type: "USER"},
+				"admin@example.com":  {Email: "admin@example.com", Role: googleRoleOwner, Type: "USER"},
+				"all@example.com":    {Email: "all@example.com", Role: googleRoleMember, Type: "GROUP"},
+			},
+			"team-gone@example.com": {},
+			"everyone@example.com":  {},
+		},
+	}
+
+	return chart, fake
+}
+
+func syncGoogleGroups(t *testing.T, chart *OrgChart, fake *fakeDirectory, dry bool, maxMemberRemovals int) (*googleGroupsSyncReport, error) {
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	ctx := context.Background()
+
+	service, err := newDirectoryService(ctx, "", "", server.URL+"/")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groups := &GoogleGroupsState{
+		service:           service,
+		customer:          "my_customer",
+		emailPattern:      "team-{id}@example.com",
+		strategy:          membershipDirect,
+		dry:               dry,
+		maxGroupRemovals:  1,
+		maxMemberRemovals: maxMemberRemovals,
+	}
+
+	if err := groups.load(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	report := newGoogleGroupsSyncReport(groups.customer, dry)
+
+	return report, groups.Sync(ctx, chart, report)
+}
+
+func TestGoogleGroupsSync(t *testing.T) {
+	chart, fake := newGoogleGroupsTestFixture(t)
+
+	report, err := syncGoogleGroups(t, chart, fake, false, 5)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roles := func(group string) map[string]string {
+		roles := map[string]string{}
+
+		for address, m := range fake.members[group] {
+			roles[address] = m.Role
+		}
+
+		return roles
+	}
+
+	// alice leads the squad, the owner and the nested group are left alone
+	expected := map[string]string{
+		"alice@example.com": googleRoleManager,
+		"bob@example.com":   googleRoleMember,
+		"admin@example.com": googleRoleOwner,
+		"all@example.com":   googleRoleMember,
+	}
+
+	if got := roles("team-squad_one@example.com"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected members of team-squad_one %v", got)
+	}
+
+	if got := roles("team-tribe@example.com"); !reflect.DeepEqual(got, map[string]string{"lead@example.com": googleRoleManager}) {
+		t.Errorf("unexpected members of team-tribe %v", got)
+	}
+
+	if got := fake.groups["team-squad_one@example.com"].Name; got != "Squad One" {
+		t.Errorf("expected team-squad_one to be renamed, got %s", got)
+	}
+
+	if _, ok := fake.groups["team-gone@example.com"]; ok {
+		t.Error("expected team-gone to be removed")
+	}
+
+	if _, ok := fake.groups["everyone@example.com"]; !ok {
+		t.Error("expected a group outside of the pattern to be left alone")
+	}
+
+	if !reflect.DeepEqual(report.CreatedGroups, []string{"team-tribe@example.com"}) {
+		t.Errorf("unexpected created groups %v", report.CreatedGroups)
+	}
+
+	if !reflect.DeepEqual(report.GroupChanges, []googleReportChange{{"team-squad_one@example.com", "name", "Squad 1", "Squad One"}}) {
+		t.Errorf("unexpected group changes %v", report.GroupChanges)
+	}
+
+	if !reflect.DeepEqual(report.RoleChanges, []googleReportRoleChange{{"team-squad_one@example.com", "alice@example.com", googleRoleMember, googleRoleManager}}) {
+		t.Errorf("unexpected role changes %v", report.RoleChanges)
+	}
+
+	if !reflect.DeepEqual(report.MembershipRemovals, []googleReportMember{{"team-squad_one@example.com", "leaver@example.com", googleRoleMember}}) {
+		t.Errorf("unexpected removals %v", report.MembershipRemovals)
+	}
+
+	// a slack id is nothing to match on here
+	if len(report.UnmatchedEmployees) != 1 || report.UnmatchedEmployees[0].ID != "carol" || report.UnmatchedEmployees[0].Reason != unmatchedNoEmail {
+		t.Errorf("expected carol to be unmatched for having no email, got %v", report.UnmatchedEmployees)
+	}
+}
+
+func TestGoogleGroupsSyncDryRunChangesNothing(t *testing.T) {
+	chart, fake := newGoogleGroupsTestFixture(t)
+
+	report, err := syncGoogleGroups(t, chart, fake, true, 5)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fake.calls) > 0 {
+		t.Errorf("unexpected changes in a dry run %v", fake.calls)
+	}
+
+	if len(report.CreatedGroups) != 1 || len(report.RemovedGroups) != 1 || len(report.MembershipAdditions) != 2 {
+		t.Errorf("expected the changes to be reported, got %+v", report)
+	}
+}
+
+func TestGoogleGroupsSyncRefusesTooManyRemovals(t *testing.T) {
+	chart, fake := newGoogleGroupsTestFixture(t)
+
+	if _, err := syncGoogleGroups(t, chart, fake, false, 0); err != nil {
+		t.Fatalf("expected no limit on member removals, got %v", err)
+	}
+
+	chart, fake = newGoogleGroupsTestFixture(t)
+	fake.groups["team-gone-too@example.com"] = &admin.Group{Email: "team-gone-too@example.com"}
+
+	if _, err := syncGoogleGroups(t, chart, fake, false, 5); err == nil {
+		t.Error("expected the sync to refuse removing 2 groups")
+	}
+
+	chart, fake = newGoogleGroupsTestFixture(t)
+	fake.members["team-squad_one@example.com"]["leaver2@example.com"] = &admin.Member{Email: "leaver2@example.com", Role: googleRoleMember}
+
+	if _, err := syncGoogleGroups(t, chart, fake, false, 1); err == nil {
+		t.Error("expected the sync to refuse removing 2 members")
+	}
+
+	if len(fake.calls) > 0 {
+		t.Errorf("unexpected changes after refusing %v", fake.calls)
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// chartHistoryEntry is a revision of the chart along with the events since the previous one
+type chartHistoryEntry struct {
+	Revision         string     `json:"revision"`
+	PreviousRevision string     `json:"previousRevision,omitempty"`
+	Timestamp        *time.Time `json:"timestamp,omitempty"`
+	// MissingRevisions counts the revisions before this one lost to compaction, the events
+	// cover them all
+	MissingRevisions int          `json:"missingRevisions,omitempty"`
+	Headcount        int          `json:"headcount"`
+	Events           []chartEvent `json:"events"`
+
+	chart *OrgChart
+}
+
+type couchRevsInfo struct {
+	RevsInfo []struct {
+		Rev    string `json:"rev"`
+		Status string `json:"status"`
+	} `json:"_revs_info"`
+}
+
+// chartRevisions lists the revisions of the chart couchdb knows of, oldest first, with whether
+// each is still available
+func chartRevisions(location string) ([]string, map[string]bool, error) {
+
+	couchdb, err := couchClient(location)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var info couchRevsInfo
+
+	if err := getCouchDocument(couchdb, "chart", url.Values{"revs_info": []string{"true"}}, &info); err != nil {
+		return nil, nil, err
+	}
+
+	revs := make([]string, 0, len(info.RevsInfo))
+	available := map[string]bool{}
+
+	for i := len(info.RevsInfo) - 1; i >= 0; i-- {
+		revs = append(revs, info.RevsInfo[i].Rev)
+		available[info.RevsInfo[i].Rev] = info.RevsInfo[i].Status == "available"
+	}
+
+	return revs, available, nil
+}
+
+// chartHistory loads every available revision of the chart and diffs each with the one before
+func chartHistory(location string) ([]*chartHistoryEntry, error) {
+
+	revs, available, err := chartRevisions(location)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "listing revisions")
+	}
+
+	history := []*chartHistoryEntry{}
+	missing := 0
+
+	var previous *chartHistoryEntry
+
+	for _, rev := range revs {
+		if !available[rev] {
+			missing++
+			continue
+		}
+
+		chart, err := loadOrgChartRevision(location, rev)
+
+		if err != nil {
+			return nil, errors.Wrapf(err, "loading revision %s", rev)
+		}
+
+		entry := &chartHistoryEntry{
+			Revision:         rev,
+			MissingRevisions: missing,
+			Headcount:        len(chart.Employees),
+			Events:           []chartEvent{},
+			chart:            chart,
+		}
+
+		if !chart.UpdatedAt.IsZero() {
+			timestamp := chart.UpdatedAt.UTC()
+			entry.Timestamp = &timestamp
+		}
+
+		if previous != nil {
+			entry.PreviousRevision = previous.Revision
+			entry.Events = diffOrgCharts(previous.chart, chart)
+		}
+
+		history = append(history, entry)
+		previous = entry
+		missing = 0
+	}
+
+	return history, nil
+}
+
+// writeChartHistory writes the timeline of the chart as text or json
+func writeChartHistory(w io.Writer, format string, history []*chartHistoryEntry) error {
+
+	switch format {
+	case "text":
+		for _, entry := range history {
+			timestamp := "unknown time"
+
+			if entry.Timestamp != nil {
+				timestamp = entry.Timestamp.Format(time.RFC3339)
+			}
+
+			fmt.Fprintf(w, "%s at %s, %d employees\n", entry.Revision, timestamp, entry.Headcount)
+
+			if entry.MissingRevisions > 0 {
+				fmt.Fprintf(w, "  %d earlier revisions compacted away\n", entry.MissingRevisions)
+			}
+
+			for _, e := range entry.Events {
+				if _, err := fmt.Fprintf(w, "  %s\n", e); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+
+		return encoder.Encode(history)
+	default:
+		return errors.Errorf("invalid format %s, expected text or json", format)
+	}
+}
+
+// parseRevisionDates reads lines of a revision and the time it was saved, as RFC 3339 or a
+// 2006-01-02 date, for revisions saved before the chart kept updatedAt. Blank lines and
+// lines starting with # are skipped.
+func parseRevisionDates(r io.Reader) (map[string]time.Time, error) {
+
+	dates := map[string]time.Time{}
+	scanner := bufio.NewScanner(r)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+
+		if len(fields) != 2 {
+			return nil, errors.Errorf("line %d: expected a revision and a time", line)
+		}
+
+		date, err := time.Parse(time.RFC3339, fields[1])
+
+		if err != nil {
+			if date, err = time.Parse("2006-01-02", fields[1]); err != nil {
+				return nil, errors.Errorf("line %d: invalid time %s, expected RFC 3339 or 2006-01-02", line, fields[1])
+			}
+		}
+
+		dates[fields[0]] = date.UTC()
+	}
+
+	return dates, scanner.Err()
+}
+
+// addRevisionDates gives revisions without a timestamp of their own the time listed in dates
+func addRevisionDates(history []*chartHistoryEntry, dates map[string]time.Time) {
+
+	known := map[string]bool{}
+
+	for _, entry := range history {
+		known[entry.Revision] = true
+
+		if date, ok := dates[entry.Revision]; ok && entry.Timestamp == nil {
+			entry.Timestamp = &date
+		}
+	}
+
+	for rev := range dates {
+		if !known[rev] {
+			logrus.Warnf("revision %s has a date but isn't available in couchdb", rev)
+		}
+	}
+}
+
+// historyDays returns the chart as it stood at the end of each day from the first revision
+// with a timestamp up to the day before until, revisions without one can't be placed. Only
+// revisions saved since the chart kept updatedAt have one unless given dates otherwise.
+func historyDays(history []*chartHistoryEntry, until time.Time) ([]time.Time, []*OrgChart, error) {
+
+	days := []time.Time{}
+	charts := []*OrgChart{}
+
+	timed := []*chartHistoryEntry{}
+
+	for _, entry := range history {
+		if entry.Timestamp == nil {
+			logrus.Warnf("revision %s has no timestamp, leaving it out of the backfill", entry.Revision)
+			continue
+		}
+
+		if len(timed) > 0 && entry.Timestamp.Before(*timed[len(timed)-1].Timestamp) {
+			return nil, nil, errors.Errorf("revision %s is timed before the revision %s preceding it", entry.Revision, timed[len(timed)-1].Revision)
+		}
+
+		timed = append(timed, entry)
+	}
+
+	if len(timed) == 0 {
+		return nil, nil, errors.New("no revision has a timestamp, give the times revisions were saved with --revision-dates")
+	}
+
+	first := timed[0].Timestamp
+	day := time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, time.UTC)
+	i := 0
+
+	for ; day.Before(until); day = day.AddDate(0, 0, 1) {
+		end := day.AddDate(0, 0, 1)
+
+		for i+1 < len(timed) && timed[i+1].Timestamp.Before(end) {
+			i++
+		}
+
+		days = append(days, day)
+		charts = append(charts, timed[i].chart)
+	}
+
+	return days, charts, nil
+}
+
+// backfillHistory replaces the partitions of the history tables for each day before until
+// with the chart as it stood at the end of that day, the way a daily bq-import would have
+func backfillHistory(ctx context.Context, dataset *bigquery.Dataset, history []*chartHistoryEntry, until time.Time, dry bool) error {
+
+	days, charts, err := historyDays(history, until)
+
+	if err != nil {
+		return err
+	}
+
+	for i, day := range days {
+		chart := charts[i]
+
+		tables := []struct {
+			name string
+			rows interface{}
+		}{
+			{"employees_history", chart.employeeExports()},
+			{"teams_history", chart.teamExports()},
+			{"vacancies_history", chart.vacanciesExports()},
+		}
+
+		for _, table := range tables {
+			partition := fmt.Sprintf("%s$%s", table.name, day.Format("20060102"))
+
+			if dry {
+				logrus.Infof("would load revision %s into %s", chart.Rev, partition)
+				continue
+			}
+
+			if err := loadPartition(ctx, dataset.Table(partition), table.rows); err != nil {
+				return errors.Wrapf(err, "loading %s", partition)
+			}
+
+			logrus.Infof("loaded revision %s into %s", chart.Rev, partition)
+		}
+	}
+
+	return nil
+}
+
+// loadPartition replaces the rows of a table partition with rows, streaming inserts can't
+// reach partitions more than a month old so a load job is used
+func loadPartition(ctx context.Context, table *bigquery.Table, rows interface{}) error {
+
+	b, err := json.Marshal(rows)
+
+	if err != nil {
+		return err
+	}
+
+	var records []json.RawMessage
+
+	if err := json.Unmarshal(b, &records); err != nil {
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+
+	for _, record := range records {
+		buf.Write(record)
+		buf.WriteByte('\n')
+	}
+
+	source := bigquery.NewReaderSource(buf)
+	source.SourceFormat = bigquery.JSON
+
+	loader := table.LoaderFrom(source)
+	loader.WriteDisposition = bigquery.WriteTruncate
+
+	job, err := loader.Run(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	status, err := job.Wait(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	return status.Err()
+}
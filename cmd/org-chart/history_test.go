@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func historyTestEntries() []*chartHistoryEntry {
+	history := []*chartHistoryEntry{}
+
+	for _, rev := range []string{"1-a", "2-b", "3-c"} {
+		history = append(history, &chartHistoryEntry{Revision: rev, chart: &OrgChart{Rev: rev}})
+	}
+
+	return history
+}
+
+func TestHistoryDaysRefusesUntimedRevisions(t *testing.T) {
+	if _, _, err := historyDays(historyTestEntries(), time.Date(2020, 10, 10, 0, 0, 0, 0, time.UTC)); err == nil {
+		t.Error("expected a history without timestamps to be refused")
+	}
+}
+
+func TestHistoryDaysFromRevisionDates(t *testing.T) {
+	dates, err := parseRevisionDates(strings.NewReader(`
+# revisions from before updatedAt
+1-a 2020-10-01
+2-b 2020-10-03T17:30:00+01:00
+`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	history := historyTestEntries()
+
+	// the last revision was saved with updatedAt, which is kept
+	saved := time.Date(2020, 10, 3, 18, 0, 0, 0, time.UTC)
+	history[2].Timestamp = &saved
+	dates["3-c"] = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	addRevisionDates(history, dates)
+
+	days, charts, err := historyDays(history, time.Date(2020, 10, 5, 0, 0, 0, 0, time.UTC))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revs := []string{}
+
+	for i, day := range days {
+		revs = append(revs, day.Format("2006-01-02")+" "+charts[i].Rev)
+	}
+
+	expected := "2020-10-01 1-a, 2020-10-02 1-a, 2020-10-03 3-c, 2020-10-04 3-c"
+
+	if got := strings.Join(revs, ", "); got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+}
+
+func TestHistoryDaysRefusesRevisionsOutOfOrder(t *testing.T) {
+	history := historyTestEntries()
+
+	addRevisionDates(history, map[string]time.Time{
+		"1-a": time.Date(2020, 10, 2, 0, 0, 0, 0, time.UTC),
+		"2-b": time.Date(2020, 10, 1, 0, 0, 0, 0, time.UTC),
+	})
+
+	if _, _, err := historyDays(history, time.Date(2020, 10, 5, 0, 0, 0, 0, time.UTC)); err == nil {
+		t.Error("expected a revision timed before the one preceding it to be refused")
+	}
+}
+
+func TestParseRevisionDatesRejectsInvalidLines(t *testing.T) {
+	for _, input := range []string{"1-a", "1-a 01/10/2020", "1-a 2020-10-01 extra"} {
+		if _, err := parseRevisionDates(strings.NewReader(input)); err == nil {
+			t.Errorf("expected %q to be rejected", input)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// hrImportFields are the employee fields which can be read from the HR export
+var hrImportFields = []string{"number", "email", "name", "title", "startDate", "type", "stream", "team"}
+
+// hrImportUpdatedFields are the fields of existing employees kept in line with the HR export
+var hrImportUpdatedFields = []string{"email", "title", "startDate", "type"}
+
+// chartDefaultTypes are the employee types the admin UI knows when the chart lists none
+var chartDefaultTypes = []string{"EMPLOYEE", "TEMP", "CONTRACTOR", "AGENCY_CONTRACTOR"}
+
+// chartDateLayout is how the admin UI writes start dates, as in 20th Oct 2020
+const chartDateLayout = "Jan 2006"
+
+type hrRow map[string]string
+
+// parseHRColumns reads field=column pairs overriding the default column of a field, which is
+// the name of the field itself
+func parseHRColumns(pairs []string) (map[string]string, error) {
+	columns := map[string]string{}
+
+	for _, field := range hrImportFields {
+		columns[field] = field
+	}
+
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+
+		if len(parts) != 2 || !matchesAny(parts[0], hrImportFields) {
+			return nil, errors.Errorf("invalid column mapping %s, expected one of %s=column", pair, strings.Join(hrImportFields, "|"))
+		}
+
+		for _, field := range hrImportFields {
+			if strings.EqualFold(field, parts[0]) {
+				columns[field] = strings.TrimSpace(parts[1])
+			}
+		}
+	}
+
+	return columns, nil
+}
+
+// parseHRTypes reads HR=chart pairs translating HR employment types into chart types
+func parseHRTypes(pairs []string) (map[string]string, error) {
+	types := map[string]string{}
+
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid type mapping %s, expected hr=chart", pair)
+		}
+
+		types[strings.ToLower(strings.TrimSpace(parts[0]))] = strings.TrimSpace(parts[1])
+	}
+
+	return types, nil
+}
+
+// chartDate formats a date the way the admin UI does, with an ordinal day
+func chartDate(t time.Time) string {
+	suffix := "th"
+
+	switch day := t.Day(); {
+	case day == 1 || day == 21 || day == 31:
+		suffix = "st"
+	case day == 2 || day == 22:
+		suffix = "nd"
+	case day == 3 || day == 23:
+		suffix = "rd"
+	}
+
+	return fmt.Sprintf("%d%s %s", t.Day(), suffix, t.Format(chartDateLayout))
+}
+
+// parseHRExport reads the rows of an HR CSV export into chart fields, columns are matched
+// case insensitively and missing columns leave their field empty. Start dates are read with
+// dateLayout and written the way the admin UI does.
+func parseHRExport(r io.Reader, columns map[string]string, types map[string]string, dateLayout string) ([]hrRow, error) {
+
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+
+	if err != nil {
+		return nil, errors.Wrap(err, "reading header")
+	}
+
+	indexes := map[string]int{}
+
+	for field, column := range columns {
+		for i, name := range header {
+			if strings.EqualFold(strings.TrimSpace(name), column) {
+				indexes[field] = i
+			}
+		}
+	}
+
+	if _, ok := indexes["number"]; !ok {
+		if _, ok := indexes["email"]; !ok {
+			return nil, errors.Errorf("neither the %s nor the %s column was found, rows can't be matched to employees", columns["number"], columns["email"])
+		}
+	}
+
+	rows := []hrRow{}
+
+	for {
+		record, err := reader.Read()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		row := hrRow{}
+
+		for field, i := range indexes {
+			if i < len(record) {
+				row[field] = strings.TrimSpace(record[i])
+			}
+		}
+
+		if t, ok := types[strings.ToLower(row["type"])]; ok {
+			row["type"] = t
+		}
+
+		if row["number"] == "" && row["email"] == "" {
+			continue
+		}
+
+		if row["startDate"] != "" {
+			date, err := time.Parse(dateLayout, row["startDate"])
+
+			if err != nil {
+				return nil, errors.Errorf("invalid start date %s of %s %s, expected the layout %s", row["startDate"], row["number"], row["email"], dateLayout)
+			}
+
+			row["startDate"] = chartDate(date)
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// types are the employee types the chart lists, as the admin UI spells them
+func (d *chartDocument) types() []string {
+	list, _ := d.raw["types"].([]interface{})
+	types := []string{}
+
+	for _, t := range list {
+		if name, ok := t.(string); ok {
+			types = append(types, strings.ToUpper(name))
+		}
+	}
+
+	if len(types) == 0 {
+		return chartDefaultTypes
+	}
+
+	return types
+}
+
+// checkHRTypes spells the type of every row as the chart does, rejecting types the chart
+// doesn't list as they would only show up in the admin UI once saved
+func (d *chartDocument) checkHRTypes(rows []hrRow) error {
+
+	types := d.types()
+	invalid := map[string]bool{}
+
+	for _, row := range rows {
+		if row["type"] == "" {
+			continue
+		}
+
+		known := false
+
+		for _, t := range types {
+			if strings.EqualFold(t, row["type"]) {
+				row["type"] = t
+				known = true
+			}
+		}
+
+		if !known {
+			invalid[row["type"]] = true
+		}
+	}
+
+	if len(invalid) == 0 {
+		return nil
+	}
+
+	names := []string{}
+
+	for name := range invalid {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return errors.Errorf("types %s aren't among the chart types %s, translate them with --type-map", strings.Join(names, ", "), strings.Join(types, ", "))
+}
+
+type hrImport struct {
+	changes  []chartChange
+	removals int
+	skipped  []hrRow
+}
+
+// importHR applies an HR export to the chart document. Rows are matched to employees by
+// number, then email. Employees with a number or email missing from the export are removed,
+// others are assumed not to be managed by HR and left alone. New starters join the team
+// named in their row or defaultTeam.
+func (d *chartDocument) importHR(rows []hrRow, defaultTeam string) (*hrImport, error) {
+
+	if err := d.checkHRTypes(rows); err != nil {
+		return nil, err
+	}
+
+	result := &hrImport{changes: []chartChange{}, skipped: []hrRow{}}
+
+	byNumber := map[string]map[string]interface{}{}
+	byEmail := map[string]map[string]interface{}{}
+
+	for _, e := range d.employees {
+		if number := docString(e, "number"); number != "" {
+			byNumber[number] = e
+		}
+		if email := docString(e, "email"); email != "" {
+			byEmail[strings.ToLower(email)] = e
+		}
+	}
+
+	teams := map[string]string{}
+
+	for _, t := range d.teams {
+		teams[strings.ToLower(docString(t, "id"))] = docString(t, "id")
+		teams[strings.ToLower(docString(t, "name"))] = docString(t, "id")
+	}
+
+	seen := map[string]bool{}
+
+	for _, row := range rows {
+		var employee map[string]interface{}
+		var ok bool
+
+		if row["number"] != "" {
+			employee, ok = byNumber[row["number"]]
+		}
+
+		if !ok && row["email"] != "" {
+			employee, ok = byEmail[strings.ToLower(row["email"])]
+		}
+
+		if ok {
+			seen[docString(employee, "id")] = true
+
+			for _, field := range hrImportUpdatedFields {
+				if row[field] == "" {
+					continue
+				}
+
+				if change := setField("employee", employee, field, row[field]); change != nil {
+					result.changes = append(result.changes, *change)
+				}
+			}
+
+			continue
+		}
+
+		team := defaultTeam
+
+		if id, found := teams[strings.ToLower(row["team"])]; found {
+			team = id
+		}
+
+		if team == "" || row["name"] == "" {
+			result.skipped = append(result.skipped, row)
+			continue
+		}
+
+		employee = map[string]interface{}{
+			"id":        d.newEmployeeID(row["name"]),
+			"name":      row["name"],
+			"title":     row["title"],
+			"reportsTo": nil,
+			"memberOf":  team,
+			"stream":    row["stream"],
+			"number":    row["number"],
+			"github":    "",
+			"startDate": nil,
+			"type":      row["type"],
+		}
+
+		if row["startDate"] != "" {
+			employee["startDate"] = row["startDate"]
+		}
+
+		if row["email"] != "" {
+			employee["email"] = row["email"]
+		}
+
+		d.employees = append(d.employees, employee)
+		seen[docString(employee, "id")] = true
+
+		result.changes = append(result.changes, chartChange{
+			Kind: "employee",
+			ID:   docString(employee, "id"),
+			To:   row["name"] + " in " + team,
+		})
+	}
+
+	leavers := []string{}
+
+	for _, e := range d.employees {
+		id := docString(e, "id")
+
+		if !seen[id] && (docString(e, "number") != "" || docString(e, "email") != "") {
+			leavers = append(leavers, id)
+		}
+	}
+
+	for _, id := range leavers {
+		result.changes = append(result.changes, d.removeEmployee(id)...)
+		result.removals++
+	}
+
+	return result, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChartDate(t *testing.T) {
+	for date, expected := range map[string]string{
+		"2020-10-01": "1st Oct 2020",
+		"2020-10-02": "2nd Oct 2020",
+		"2020-10-03": "3rd Oct 2020",
+		"2020-10-11": "11th Oct 2020",
+		"2020-10-12": "12th Oct 2020",
+		"2020-10-13": "13th Oct 2020",
+		"2020-10-20": "20th Oct 2020",
+		"2020-10-21": "21st Oct 2020",
+		"2020-10-22": "22nd Oct 2020",
+		"2020-10-23": "23rd Oct 2020",
+		"2020-10-31": "31st Oct 2020",
+	} {
+		parsed, err := time.Parse("2006-01-02", date)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := chartDate(parsed); got != expected {
+			t.Errorf("expected %s to be written %s, got %s", date, expected, got)
+		}
+	}
+}
+
+func hrTestDocument() *chartDocument {
+	return &chartDocument{
+		raw: map[string]interface{}{"types": []interface{}{"Employee", "Contractor"}},
+		employees: []map[string]interface{}{
+			{"id": "alice", "name": "Alice", "number": "1", "title": "Engineer", "startDate": "20th Oct 2020", "type": "EMPLOYEE"},
+			{"id": "bob", "name": "Bob", "number": "2", "email": "bob@example.com", "title": "Engineer", "type": "EMPLOYEE"},
+		},
+		teams: []map[string]interface{}{
+			{"id": "squad", "name": "Squad"},
+		},
+	}
+}
+
+func parseHRTestExport(t *testing.T, export string) []hrRow {
+	columns, err := parseHRColumns([]string{"number=Employee No", "startDate=Start"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := parseHRExport(strings.NewReader(export), columns, map[string]string{"permanent": "EMPLOYEE"}, "02/01/2006")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rows
+}
+
+func TestImportHR(t *testing.T) {
+	doc := hrTestDocument()
+
+	rows := parseHRTestExport(t, `Employee No,Email,Name,Title,Start,Type,Team
+1,alice@example.com,Alice,Engineer,20/10/2020,Permanent,
+2,bob@example.com,Bob,Senior Engineer,,contractor,
+3,carol@example.com,Carol,Designer,01/11/2020,Permanent,squad
+`)
+
+	result, err := doc.importHR(rows, "")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []chartChange{
+		{Kind: "employee", ID: "alice", Field: "email", To: "alice@example.com"},
+		{Kind: "employee", ID: "bob", Field: "title", From: "Engineer", To: "Senior Engineer"},
+		{Kind: "employee", ID: "bob", Field: "type", From: "EMPLOYEE", To: "CONTRACTOR"},
+		{Kind: "employee", ID: "carol", To: "Carol in squad"},
+	}
+
+	if !reflect.DeepEqual(result.changes, expected) {
+		t.Errorf("unexpected changes %v", result.changes)
+	}
+
+	if got := docString(doc.employee("carol"), "startDate"); got != "1st Nov 2020" {
+		t.Errorf("expected the start date of carol to be written as the admin UI does, got %s", got)
+	}
+}
+
+func TestImportHRRejectsUnknownTypes(t *testing.T) {
+	doc := hrTestDocument()
+
+	rows := parseHRTestExport(t, `Employee No,Name,Type
+1,Alice,Permanent
+2,Bob,Fixed Term
+`)
+
+	_, err := doc.importHR(rows, "squad")
+
+	if err == nil || !strings.Contains(err.Error(), "Fixed Term") {
+		t.Errorf("expected the unknown type to be rejected, got %v", err)
+	}
+}
+
+func TestParseHRExportRejectsInvalidDates(t *testing.T) {
+	columns, err := parseHRColumns(nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = parseHRExport(strings.NewReader("number,startDate\n1,20th Oct 2020\n"), columns, nil, "2006-01-02")
+
+	if err == nil {
+		t.Error("expected a start date not in the layout to be rejected")
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// rbacMapping grants kubernetes roles to org teams, every grant also applies to the
+// descendants of the team
+type rbacMapping struct {
+	Grants []*rbacGrant `yaml:"grants"`
+}
+
+type rbacGrant struct {
+	Team       string   `yaml:"team"`
+	Namespaces []string `yaml:"namespaces"`
+	// Roles are bound in each namespace, they name a ClusterRole unless prefixed with Role/
+	Roles []string `yaml:"roles"`
+	// ClusterRoles are bound cluster wide
+	ClusterRoles []string `yaml:"clusterRoles"`
+}
+
+const (
+	rbacSubjectsGroups  = "github-teams"
+	rbacSubjectsMembers = "members"
+)
+
+// rbacGeneratedHeader marks the files written by k8s-rbac, only those are removed when stale
+const rbacGeneratedHeader = "# generated by org-chart k8s-rbac, do not edit\n"
+
+// rbacSubjects sets who a binding names as its subjects, either the github teams of the
+// granted teams as OIDC group claims or the identities of their members
+type rbacSubjects struct {
+	kind         string
+	groupPrefix  string
+	userIdentity string
+	userPrefix   string
+	warned       map[string]bool
+}
+
+type rbacBinding struct {
+	APIVersion string        `yaml:"apiVersion"`
+	Kind       string        `yaml:"kind"`
+	Metadata   rbacMetadata  `yaml:"metadata"`
+	Subjects   []rbacSubject `yaml:"subjects"`
+	RoleRef    rbacRoleRef   `yaml:"roleRef"`
+}
+
+type rbacMetadata struct {
+	Name      string            `yaml:"name"`
+	Namespace string            `yaml:"namespace,omitempty"`
+	Labels    map[string]string `yaml:"labels"`
+}
+
+type rbacSubject struct {
+	Kind     string `yaml:"kind"`
+	APIGroup string `yaml:"apiGroup"`
+	Name     string `yaml:"name"`
+}
+
+type rbacRoleRef struct {
+	APIGroup string `yaml:"apiGroup"`
+	Kind     string `yaml:"kind"`
+	Name     string `yaml:"name"`
+}
+
+func parseRBACMapping(r io.Reader) (*rbacMapping, error) {
+	mapping := &rbacMapping{}
+
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+
+	if err := decoder.Decode(mapping); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	for _, grant := range mapping.Grants {
+		if grant.Team == "" {
+			return nil, errors.New("a grant has no team")
+		}
+
+		if len(grant.Roles) > 0 && len(grant.Namespaces) == 0 {
+			return nil, errors.Errorf("grant of team %s binds roles but names no namespaces", grant.Team)
+		}
+	}
+
+	return mapping, nil
+}
+
+var nonKubernetesName = regexp.MustCompile("[^a-z0-9.-]+")
+
+// kubernetesName turns parts into a valid object name
+func kubernetesName(parts ...string) string {
+	return strings.Trim(nonKubernetesName.ReplaceAllString(strings.ToLower(strings.Join(parts, "-")), "-"), "-.")
+}
+
+// subjects returns the subjects of a grant to a team, which cover its descendants too
+func (s *rbacSubjects) subjects(chart *OrgChart, t *Team) ([]rbacSubject, error) {
+
+	names := map[string]bool{}
+
+	switch s.kind {
+	case rbacSubjectsGroups:
+		for _, team := range chart.subtree(t) {
+			names[s.groupPrefix+team.Github] = true
+		}
+	case rbacSubjectsMembers:
+		members, err := chart.teamMembers(t, membershipRolledUp)
+
+		if err != nil {
+			return nil, err
+		}
+
+		leads, err := chart.leads(t)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range append(members, leads...) {
+			identity := e.Email
+
+			if s.userIdentity == "github" {
+				identity = e.Github
+			}
+
+			if identity == "" {
+				if !s.warned[e.ID] {
+					logrus.Warnf("employee %s (%s) has no %s, not granting them any roles", e.Name, e.ID, s.userIdentity)
+					s.warned[e.ID] = true
+				}
+				continue
+			}
+
+			names[s.userPrefix+identity] = true
+		}
+	default:
+		return nil, errors.Errorf("invalid subjects %s, expected %s or %s", s.kind, rbacSubjectsGroups, rbacSubjectsMembers)
+	}
+
+	kind := "Group"
+
+	if s.kind == rbacSubjectsMembers {
+		kind = "User"
+	}
+
+	subjects := []rbacSubject{}
+
+	for name := range names {
+		subjects = append(subjects, rbacSubject{kind, "rbac.authorization.k8s.io", name})
+	}
+
+	sort.Slice(subjects, func(i, j int) bool {
+		return subjects[i].Name < subjects[j].Name
+	})
+
+	return subjects, nil
+}
+
+// renderRBAC returns the manifests of the bindings granted by the mapping by file name
+func renderRBAC(chart *OrgChart, mapping *rbacMapping, s *rbacSubjects) (map[string][]byte, error) {
+
+	files := map[string][]byte{}
+
+	add := func(file string, binding *rbacBinding) error {
+		if _, ok := files[file]; ok {
+			return errors.Errorf("%s %s is granted more than once", binding.Kind, binding.Metadata.Name)
+		}
+
+		buf := &bytes.Buffer{}
+		buf.WriteString(rbacGeneratedHeader)
+
+		encoder := yaml.NewEncoder(buf)
+		encoder.SetIndent(2)
+
+		if err := encoder.Encode(binding); err != nil {
+			return err
+		}
+
+		files[file] = buf.Bytes()
+
+		return nil
+	}
+
+	for _, grant := range mapping.Grants {
+		t, ok := chart.TeamsByID[grant.Team]
+
+		if !ok {
+			return nil, errors.Errorf("could not find team %s", grant.Team)
+		}
+
+		subjects, err := s.subjects(chart, t)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(subjects) == 0 {
+			logrus.Warnf("team %s has no subjects, not granting it any roles", t.ID)
+			continue
+		}
+
+		labels := map[string]string{
+			"app.kubernetes.io/managed-by": "org-chart",
+			"org-chart/team":               kubernetesName(t.ID),
+		}
+
+		for _, namespace := range grant.Namespaces {
+			for _, role := range grant.Roles {
+				roleKind := "ClusterRole"
+
+				if strings.HasPrefix(role, "Role/") {
+					roleKind = "Role"
+					role = strings.TrimPrefix(role, "Role/")
+				}
+
+				name := kubernetesName("org-chart", t.ID, role)
+
+				err := add(kubernetesName("rolebinding", namespace, name)+".yaml", &rbacBinding{
+					APIVersion: "rbac.authorization.k8s.io/v1",
+					Kind:       "RoleBinding",
+					Metadata:   rbacMetadata{Name: name, Namespace: namespace, Labels: labels},
+					Subjects:   subjects,
+					RoleRef:    rbacRoleRef{"rbac.authorization.k8s.io", roleKind, role},
+				})
+
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		for _, role := range grant.ClusterRoles {
+			name := kubernetesName("org-chart", t.ID, role)
+
+			err := add(kubernetesName("clusterrolebinding", name)+".yaml", &rbacBinding{
+				APIVersion: "rbac.authorization.k8s.io/v1",
+				Kind:       "ClusterRoleBinding",
+				Metadata:   rbacMetadata{Name: name, Labels: labels},
+				Subjects:   subjects,
+				RoleRef:    rbacRoleRef{"rbac.authorization.k8s.io", "ClusterRole", role},
+			})
+
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return files, nil
+}
+
+// generatedRBACFiles lists the files of a directory written by an earlier k8s-rbac run
+func generatedRBACFiles(dir string) ([]string, error) {
+
+	infos, err := ioutil.ReadDir(dir)
+
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	generated := []string{}
+
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".yaml") {
+			continue
+		}
+
+		f, err := os.Open(filepath.Join(dir, info.Name()))
+
+		if err != nil {
+			return nil, err
+		}
+
+		header, err := bufio.NewReader(f).ReadString('\n')
+		f.Close()
+
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		if header == rbacGeneratedHeader {
+			generated = append(generated, info.Name())
+		}
+	}
+
+	return generated, nil
+}
+
+// writeRBAC brings a directory in line with the rendered manifests, removing the files of
+// bindings no longer granted. Every file is checked before anything is written, so that a
+// hand-written file in the way leaves the directory as it was. With check it only returns the
+// files which would change.
+func writeRBAC(dir string, files map[string][]byte, check bool) ([]string, error) {
+
+	existing, err := generatedRBACFiles(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+
+	for name := range files {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	writes := []string{}
+
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+
+		current, err := ioutil.ReadFile(path)
+
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		if err == nil && bytes.Equal(current, files[name]) {
+			continue
+		}
+
+		if err == nil && !bytes.HasPrefix(current, []byte(rbacGeneratedHeader)) {
+			return nil, errors.Errorf("%s was not generated by k8s-rbac, refusing to overwrite it", path)
+		}
+
+		writes = append(writes, name)
+	}
+
+	removals := []string{}
+
+	for _, name := range existing {
+		if _, ok := files[name]; !ok {
+			removals = append(removals, name)
+		}
+	}
+
+	changed := append(removals, writes...)
+	sort.Strings(changed)
+
+	if check {
+		return changed, nil
+	}
+
+	for _, name := range removals {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	for _, name := range writes {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), files[name], 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	return changed, nil
+}
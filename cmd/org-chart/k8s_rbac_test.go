@@ -0,0 +1,264 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+const rbacTestMapping = `
+grants:
+  - team: tribe
+    namespaces: [payments]
+    roles: [view, Role/deployer]
+    clusterRoles: [node-reader]
+`
+
+func rbacTestChart(t *testing.T) *OrgChart {
+	chart := &OrgChart{
+		Teams: []*Team{
+			{ID: "tribe", Name: "Tribe", TeachLeadID: "lead"},
+			{ID: "squad", Name: "Squad", ParentID: "tribe"},
+			{ID: "other", Name: "Other"},
+		},
+		Employees: []*Employee{
+			{ID: "lead", Name: "Lead", MemberOf: "tribe", Email: "lead@example.com", Github: "lead", Stream: "ENGINEERING"},
+			{ID: "alice", Name: "Alice", MemberOf: "squad", Email: "alice@example.com", Github: "alice", Stream: "ENGINEERING"},
+			{ID: "bob", Name: "Bob", MemberOf: "squad", Github: "bob", Stream: "ENGINEERING"},
+			{ID: "carol", Name: "Carol", MemberOf: "other", Email: "carol@example.com", Stream: "ENGINEERING"},
+		},
+	}
+
+	if err := chart.organise(); err != nil {
+		t.Fatal(err)
+	}
+
+	chart.assignGithubTeams("org-")
+
+	return chart
+}
+
+func renderRBACTest(t *testing.T, mapping string, subjects *rbacSubjects) (map[string][]byte, error) {
+	parsed, err := parseRBACMapping(strings.NewReader(mapping))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subjects.warned = map[string]bool{}
+
+	return renderRBAC(rbacTestChart(t), parsed, subjects)
+}
+
+func rbacTestBinding(t *testing.T, files map[string][]byte, name string) *rbacBinding {
+	b, ok := files[name]
+
+	if !ok {
+		t.Fatalf("expected %s to be rendered", name)
+	}
+
+	var binding rbacBinding
+
+	if err := yaml.Unmarshal(b, &binding); err != nil {
+		t.Fatal(err)
+	}
+
+	return &binding
+}
+
+func subjectNames(binding *rbacBinding) []string {
+	names := []string{}
+
+	for _, subject := range binding.Subjects {
+		names = append(names, subject.Kind+" "+subject.Name)
+	}
+
+	return names
+}
+
+func TestParseRBACMapping(t *testing.T) {
+	for _, mapping := range []string{
+		"grants:\n  - namespaces: [payments]\n    roles: [view]\n",
+		"grants:\n  - team: tribe\n    roles: [view]\n",
+		"grants:\n  - team: tribe\n    namespace: payments\n",
+	} {
+		if _, err := parseRBACMapping(strings.NewReader(mapping)); err == nil {
+			t.Errorf("expected %q to be rejected", mapping)
+		}
+	}
+
+	if mapping, err := parseRBACMapping(strings.NewReader("")); err != nil || len(mapping.Grants) != 0 {
+		t.Errorf("expected an empty mapping to grant nothing, got %v, %v", mapping, err)
+	}
+}
+
+func TestRenderRBACGithubTeams(t *testing.T) {
+	files, err := renderRBACTest(t, rbacTestMapping, &rbacSubjects{kind: rbacSubjectsGroups, groupPrefix: "github:"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+
+	for name := range files {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	expected := []string{
+		"clusterrolebinding-org-chart-tribe-node-reader.yaml",
+		"rolebinding-payments-org-chart-tribe-deployer.yaml",
+		"rolebinding-payments-org-chart-tribe-view.yaml",
+	}
+
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("unexpected files %v", names)
+	}
+
+	// the grant to the tribe covers the squad under it
+	view := rbacTestBinding(t, files, "rolebinding-payments-org-chart-tribe-view.yaml")
+
+	if got := subjectNames(view); !reflect.DeepEqual(got, []string{"Group github:org-squad", "Group github:org-tribe"}) {
+		t.Errorf("unexpected subjects %v", got)
+	}
+
+	if view.Metadata.Namespace != "payments" || view.RoleRef != (rbacRoleRef{"rbac.authorization.k8s.io", "ClusterRole", "view"}) {
+		t.Errorf("unexpected role binding %+v", view)
+	}
+
+	deployer := rbacTestBinding(t, files, "rolebinding-payments-org-chart-tribe-deployer.yaml")
+
+	if deployer.RoleRef != (rbacRoleRef{"rbac.authorization.k8s.io", "Role", "deployer"}) {
+		t.Errorf("expected a Role/ prefix to bind a namespaced role, got %+v", deployer.RoleRef)
+	}
+
+	nodeReader := rbacTestBinding(t, files, "clusterrolebinding-org-chart-tribe-node-reader.yaml")
+
+	if nodeReader.Kind != "ClusterRoleBinding" || nodeReader.Metadata.Namespace != "" {
+		t.Errorf("unexpected cluster role binding %+v", nodeReader)
+	}
+}
+
+func TestRenderRBACMembers(t *testing.T) {
+	for identity, expected := range map[string][]string{
+		// bob has no email and is left out
+		"email":  {"User oidc:alice@example.com", "User oidc:lead@example.com"},
+		"github": {"User oidc:alice", "User oidc:bob", "User oidc:lead"},
+	} {
+		files, err := renderRBACTest(t, rbacTestMapping, &rbacSubjects{kind: rbacSubjectsMembers, userIdentity: identity, userPrefix: "oidc:"})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		binding := rbacTestBinding(t, files, "rolebinding-payments-org-chart-tribe-view.yaml")
+
+		if got := subjectNames(binding); !reflect.DeepEqual(got, expected) {
+			t.Errorf("unexpected subjects by %s %v", identity, got)
+		}
+	}
+}
+
+func TestRenderRBACRefusesDuplicateGrants(t *testing.T) {
+	_, err := renderRBACTest(t, rbacTestMapping+`
+  - team: tribe
+    namespaces: [payments]
+    roles: [view]
+`, &rbacSubjects{kind: rbacSubjectsGroups})
+
+	if err == nil || !strings.Contains(err.Error(), "more than once") {
+		t.Errorf("expected the duplicate grant to be refused, got %v", err)
+	}
+}
+
+func TestWriteRBAC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbac")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	listing := func() []string {
+		infos, err := ioutil.ReadDir(dir)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names := []string{}
+
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+
+		return names
+	}
+
+	write("stale.yaml", rbacGeneratedHeader+"kind: RoleBinding\n")
+	write("unchanged.yaml", rbacGeneratedHeader+"kind: ClusterRoleBinding\n")
+	write("kustomization.yaml", "resources: []\n")
+
+	files := map[string][]byte{
+		"unchanged.yaml": []byte(rbacGeneratedHeader + "kind: ClusterRoleBinding\n"),
+		"new.yaml":       []byte(rbacGeneratedHeader + "kind: RoleBinding\n"),
+	}
+
+	changed, err := writeRBAC(dir, files, true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(changed, []string{"new.yaml", "stale.yaml"}) {
+		t.Errorf("unexpected changes %v", changed)
+	}
+
+	before := []string{"kustomization.yaml", "stale.yaml", "unchanged.yaml"}
+
+	if got := listing(); !reflect.DeepEqual(got, before) {
+		t.Fatalf("expected a check to change nothing, got %v", got)
+	}
+
+	// a hand-written file in the way of a binding stops everything, stale files included
+	if _, err := writeRBAC(dir, map[string][]byte{"kustomization.yaml": files["new.yaml"]}, false); err == nil {
+		t.Error("expected a hand-written file not to be overwritten")
+	}
+
+	if got := listing(); !reflect.DeepEqual(got, before) {
+		t.Fatalf("expected a refusal to change nothing, got %v", got)
+	}
+
+	changed, err = writeRBAC(dir, files, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(changed, []string{"new.yaml", "stale.yaml"}) {
+		t.Errorf("unexpected changes %v", changed)
+	}
+
+	if got := listing(); !reflect.DeepEqual(got, []string{"kustomization.yaml", "new.yaml", "unchanged.yaml"}) {
+		t.Errorf("unexpected files %v", got)
+	}
+
+	if changed, err := writeRBAC(dir, files, true); err != nil || len(changed) > 0 {
+		t.Errorf("expected the directory to be up to date, got %v, %v", changed, err)
+	}
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ldapClient is the part of a directory connection the sync uses
+type ldapClient interface {
+	SearchWithPaging(searchRequest *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error)
+	Add(addRequest *ldap.AddRequest) error
+	Modify(modifyRequest *ldap.ModifyRequest) error
+	Del(delRequest *ldap.DelRequest) error
+}
+
+// LdapState holds the directory entries the org chart is synced to
+type LdapState struct {
+	conn         ldapClient
+	userBaseDN   string
+	userFilter   string
+	groupBaseDN  string
+	groupPrefix  string
+	usersByMail  map[string]*ldap.Entry
+	usersByUID   map[string]*ldap.Entry
+	groups       map[string]*ldap.Entry
+	dry          bool
+	groupClasses []string
+
+	maxGroupRemovals  int
+	maxMemberRemovals int
+}
+
+func dialLdap(ldapURL string, startTLS bool, bindDN, bindPassword string) (*ldap.Conn, error) {
+
+	conn, err := ldap.DialURL(ldapURL)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if startTLS {
+		u, err := url.Parse(ldapURL)
+
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		if err := conn.StartTLS(&tls.Config{ServerName: u.Hostname()}); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "starting tls")
+		}
+	}
+
+	if bindDN != "" {
+		if err := conn.Bind(bindDN, bindPassword); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "binding")
+		}
+	}
+
+	return conn, nil
+}
+
+func (l *LdapState) load() error {
+
+	l.usersByMail = map[string]*ldap.Entry{}
+	l.usersByUID = map[string]*ldap.Entry{}
+	l.groups = map[string]*ldap.Entry{}
+
+	users, err := l.conn.SearchWithPaging(ldap.NewSearchRequest(
+		l.userBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		l.userFilter, []string{"mail", "uid", "manager"}, nil,
+	), 500)
+
+	if err != nil {
+		return errors.Wrap(err, "searching users")
+	}
+
+	for _, entry := range users.Entries {
+		for _, mail := range entry.GetAttributeValues("mail") {
+			l.usersByMail[strings.ToLower(mail)] = entry
+		}
+
+		for _, uid := range entry.GetAttributeValues("uid") {
+			l.usersByUID[strings.ToLower(uid)] = entry
+		}
+	}
+
+	groups, err := l.conn.SearchWithPaging(ldap.NewSearchRequest(
+		l.groupBaseDN, ldap.ScopeSingleLevel, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf("(&(objectClass=groupOfNames)(cn=%s*))", ldap.EscapeFilter(l.groupPrefix)),
+		[]string{"cn", "description", "member"}, nil,
+	), 500)
+
+	if err != nil {
+		return errors.Wrap(err, "searching groups")
+	}
+
+	for _, entry := range groups.Entries {
+		l.groups[strings.ToLower(entry.GetAttributeValue("cn"))] = entry
+	}
+
+	return nil
+}
+
+// user matches an employee to their directory entry by mail, falling back to a uid equal to
+// their employee id
+func (l *LdapState) user(e *Employee) *ldap.Entry {
+	if e.Email != "" {
+		if entry, ok := l.usersByMail[strings.ToLower(strings.TrimSpace(e.Email))]; ok {
+			return entry
+		}
+	}
+
+	return l.usersByUID[strings.ToLower(e.ID)]
+}
+
+func (l *LdapState) groupDN(cn string) string {
+	return fmt.Sprintf("cn=%s,%s", ldap.EscapeDN(cn), l.groupBaseDN)
+}
+
+// normaliseDN spells a distinguished name the way the directory compares them, ignoring case,
+// spacing and the order of the values of multi-valued names
+func normaliseDN(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(dn))
+	}
+
+	rdns := make([]string, 0, len(parsed.RDNs))
+
+	for _, rdn := range parsed.RDNs {
+		values := make([]string, 0, len(rdn.Attributes))
+
+		for _, attribute := range rdn.Attributes {
+			values = append(values, strings.ToLower(attribute.Type)+"="+strings.ToLower(attribute.Value))
+		}
+
+		sort.Strings(values)
+		rdns = append(rdns, strings.Join(values, "+"))
+	}
+
+	return strings.Join(rdns, ",")
+}
+
+func sameDN(a, b string) bool {
+	return normaliseDN(a) == normaliseDN(b)
+}
+
+// dnSet indexes names by their normalised spelling, keeping the first spelling of each
+func dnSet(dns []string) map[string]string {
+	set := make(map[string]string, len(dns))
+
+	for _, dn := range dns {
+		normalised := normaliseDN(dn)
+
+		if _, ok := set[normalised]; !ok {
+			set[normalised] = dn
+		}
+	}
+
+	return set
+}
+
+func uniqueDNs(dns []string) []string {
+	unique := []string{}
+
+	for _, dn := range dnSet(dns) {
+		unique = append(unique, dn)
+	}
+
+	sort.Strings(unique)
+
+	return unique
+}
+
+// diffDNs returns the names of desired missing from current and of current missing from desired
+func diffDNs(current, desired []string) ([]string, []string) {
+	currentSet := dnSet(current)
+	desiredSet := dnSet(desired)
+
+	added := []string{}
+	removed := []string{}
+
+	for normalised, dn := range desiredSet {
+		if _, ok := currentSet[normalised]; !ok {
+			added = append(added, dn)
+		}
+	}
+
+	for normalised, dn := range currentSet {
+		if _, ok := desiredSet[normalised]; !ok {
+			removed = append(removed, dn)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+
+	return added, removed
+}
+
+// ldapSyncReport is the machine readable outcome of an ldap-sync run
+type ldapSyncReport struct {
+	StartedAt           time.Time            `json:"startedAt"`
+	FinishedAt          time.Time            `json:"finishedAt"`
+	DryRun              bool                 `json:"dryRun"`
+	Error               string               `json:"error,omitempty"`
+	ManagerChanges      []ldapReportChange   `json:"managerChanges"`
+	CreatedGroups       []string             `json:"createdGroups"`
+	RemovedGroups       []string             `json:"removedGroups"`
+	GroupChanges        []ldapReportChange   `json:"groupChanges"`
+	MembershipAdditions []ldapReportMember   `json:"membershipAdditions"`
+	MembershipRemovals  []ldapReportMember   `json:"membershipRemovals"`
+	EmptyGroups         []string             `json:"emptyGroups"`
+	UnmatchedEmployees  []syncReportEmployee `json:"unmatchedEmployees"`
+}
+
+type ldapReportChange struct {
+	DN      string `json:"dn"`
+	Subject string `json:"subject"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+}
+
+type ldapReportMember struct {
+	Group  string `json:"group"`
+	Member string `json:"member"`
+}
+
+func newLdapSyncReport(dry bool) *ldapSyncReport {
+	return &ldapSyncReport{
+		StartedAt:           time.Now(),
+		DryRun:              dry,
+		ManagerChanges:      []ldapReportChange{},
+		CreatedGroups:       []string{},
+		RemovedGroups:       []string{},
+		GroupChanges:        []ldapReportChange{},
+		MembershipAdditions: []ldapReportMember{},
+		MembershipRemovals:  []ldapReportMember{},
+		EmptyGroups:         []string{},
+		UnmatchedEmployees:  []syncReportEmployee{},
+	}
+}
+
+func (r *ldapSyncReport) finish(err error) {
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	r.FinishedAt = time.Now()
+}
+
+func (r *ldapSyncReport) save(path string) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// ldapGroupPlan is the groupOfNames an org team should have in the directory
+type ldapGroupPlan struct {
+	team        *Team
+	cn          string
+	description string
+	members     []string
+}
+
+// Sync sets the manager of every matched employee from their resolved reporting line and
+// reconciles a groupOfNames per team, removing prefixed groups of teams no longer in the chart
+func (l *LdapState) Sync(chart *OrgChart, report *ldapSyncReport) error {
+
+	unmatched := []*Employee{}
+	members := map[string][]string{}
+
+	for _, e := range chart.Employees {
+		entry := l.user(e)
+
+		if entry == nil {
+			unmatched = append(unmatched, e)
+			continue
+		}
+
+		members[e.MemberOf] = append(members[e.MemberOf], entry.DN)
+	}
+
+	sort.Slice(unmatched, func(i, j int) bool {
+		return unmatched[i].ID < unmatched[j].ID
+	})
+
+	report.UnmatchedEmployees = unmatchedEmployees(unmatched, false)
+
+	plans := map[string]*ldapGroupPlan{}
+
+	for _, t := range chart.Teams {
+		plan := &ldapGroupPlan{
+			team:        t,
+			cn:          githubTeamSlug(l.groupPrefix, t.ID),
+			description: t.Description,
+			members:     members[t.ID],
+		}
+
+		leads, err := chart.leads(t)
+
+		if err != nil {
+			return err
+		}
+
+		for _, lead := range leads {
+			if entry := l.user(lead); entry != nil {
+				plan.members = append(plan.members, entry.DN)
+			}
+		}
+
+		plan.members = uniqueDNs(plan.members)
+
+		plans[strings.ToLower(plan.cn)] = plan
+	}
+
+	toRemove := []*ldap.Entry{}
+
+	for cn, entry := range l.groups {
+		if _, ok := plans[cn]; !ok {
+			toRemove = append(toRemove, entry)
+		}
+	}
+
+	sort.Slice(toRemove, func(i, j int) bool {
+		return toRemove[i].DN < toRemove[j].DN
+	})
+
+	memberRemovals := 0
+
+	for cn, plan := range plans {
+		if entry, ok := l.groups[cn]; ok && len(plan.members) > 0 {
+			_, removed := diffDNs(entry.GetAttributeValues("member"), plan.members)
+			memberRemovals += len(removed)
+		}
+	}
+
+	for _, err := range []error{
+		checkRemovalThreshold("ldap groups", len(toRemove), l.maxGroupRemovals),
+		checkRemovalThreshold("ldap group members", memberRemovals, l.maxMemberRemovals),
+	} {
+		if err == nil {
+			continue
+		}
+
+		if !l.dry {
+			return err
+		}
+
+		logrus.Warn(err)
+	}
+
+	for _, e := range chart.Employees {
+		if err := l.syncManager(chart, e, report); err != nil {
+			return errors.Wrapf(err, "setting manager of %s", e.ID)
+		}
+	}
+
+	cns := []string{}
+
+	for cn := range plans {
+		cns = append(cns, cn)
+	}
+
+	sort.Strings(cns)
+
+	for _, cn := range cns {
+		if err := l.syncGroup(plans[cn], report); err != nil {
+			return errors.Wrapf(err, "syncing group %s", plans[cn].cn)
+		}
+	}
+
+	for _, entry := range toRemove {
+		if !l.dry {
+			if err := l.conn.Del(ldap.NewDelRequest(entry.DN, nil)); err != nil {
+				return errors.Wrapf(err, "removing group %s", entry.DN)
+			}
+		}
+
+		report.RemovedGroups = append(report.RemovedGroups, entry.DN)
+	}
+
+	return nil
+}
+
+func (l *LdapState) syncManager(chart *OrgChart, e *Employee, report *ldapSyncReport) error {
+
+	entry := l.user(e)
+
+	if entry == nil {
+		return nil
+	}
+
+	desired := ""
+
+	if manager := chart.manager(e); manager != nil {
+		managerEntry := l.user(manager)
+
+		if managerEntry == nil {
+			logrus.Debugf("manager %s of %s not found in ldap, leaving manager as it is", manager.ID, e.ID)
+			return nil
+		}
+
+		desired = managerEntry.DN
+	}
+
+	current := entry.GetAttributeValue("manager")
+
+	if sameDN(current, desired) {
+		return nil
+	}
+
+	if !l.dry {
+		modify := ldap.NewModifyRequest(entry.DN, nil)
+
+		if desired == "" {
+			modify.Delete("manager", nil)
+		} else {
+			modify.Replace("manager", []string{desired})
+		}
+
+		if err := l.conn.Modify(modify); err != nil {
+			return err
+		}
+	}
+
+	report.ManagerChanges = append(report.ManagerChanges, ldapReportChange{entry.DN, "manager", current, desired})
+
+	return nil
+}
+
+func (l *LdapState) syncGroup(plan *ldapGroupPlan, report *ldapSyncReport) error {
+
+	entry, ok := l.groups[strings.ToLower(plan.cn)]
+
+	// groupOfNames needs at least one member, groups of empty teams are left as they are
+	if len(plan.members) == 0 {
+		if ok && len(entry.GetAttributeValues("member")) > 0 {
+			logrus.Warnf("team %s has no ldap users, leaving group %s as it is", plan.team.ID, entry.DN)
+		}
+
+		report.EmptyGroups = append(report.EmptyGroups, l.groupDN(plan.cn))
+		return nil
+	}
+
+	if !ok {
+		dn := l.groupDN(plan.cn)
+
+		if !l.dry {
+			add := ldap.NewAddRequest(dn, nil)
+			add.Attribute("objectClass", l.groupClasses)
+			add.Attribute("cn", []string{plan.cn})
+			add.Attribute("member", plan.members)
+
+			if plan.description != "" {
+				add.Attribute("description", []string{plan.description})
+			}
+
+			if err := l.conn.Add(add); err != nil {
+				return err
+			}
+		}
+
+		report.CreatedGroups = append(report.CreatedGroups, dn)
+
+		for _, member := range plan.members {
+			report.MembershipAdditions = append(report.MembershipAdditions, ldapReportMember{dn, member})
+		}
+
+		return nil
+	}
+
+	modify := ldap.NewModifyRequest(entry.DN, nil)
+	changed := false
+
+	if current := entry.GetAttributeValue("description"); current != plan.description {
+		if plan.description == "" {
+			modify.Delete("description", nil)
+		} else {
+			modify.Replace("description", []string{plan.description})
+		}
+
+		changed = true
+		report.GroupChanges = append(report.GroupChanges, ldapReportChange{entry.DN, "description", current, plan.description})
+	}
+
+	added, removed := diffDNs(entry.GetAttributeValues("member"), plan.members)
+
+	// members are added before others are removed so the group is never left empty
+	if len(added) > 0 {
+		modify.Add("member", added)
+		changed = true
+	}
+
+	if len(removed) > 0 {
+		modify.Delete("member", removed)
+		changed = true
+	}
+
+	for _, member := range added {
+		report.MembershipAdditions = append(report.MembershipAdditions, ldapReportMember{entry.DN, member})
+	}
+
+	for _, member := range removed {
+		report.MembershipRemovals = append(report.MembershipRemovals, ldapReportMember{entry.DN, member})
+	}
+
+	if changed && !l.dry {
+		return l.conn.Modify(modify)
+	}
+
+	return nil
+}
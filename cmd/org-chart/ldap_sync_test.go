@@ -0,0 +1,272 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// fakeLdap is an in-memory directory of users and groups under their base dns
+type fakeLdap struct {
+	userBaseDN  string
+	groupBaseDN string
+	entries     map[string]*ldap.Entry
+	calls       []string
+}
+
+func (f *fakeLdap) SearchWithPaging(req *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error) {
+	result := &ldap.SearchResult{}
+
+	for dn, entry := range f.entries {
+		if strings.HasSuffix(dn, ","+req.BaseDN) {
+			result.Entries = append(result.Entries, entry)
+		}
+	}
+
+	return result, nil
+}
+
+func (f *fakeLdap) Add(req *ldap.AddRequest) error {
+	f.calls = append(f.calls, "add "+req.DN)
+
+	attributes := map[string][]string{}
+
+	for _, attribute := range req.Attributes {
+		attributes[attribute.Type] = attribute.Vals
+	}
+
+	f.entries[req.DN] = ldap.NewEntry(req.DN, attributes)
+
+	return nil
+}
+
+func (f *fakeLdap) Modify(req *ldap.ModifyRequest) error {
+	f.calls = append(f.calls, "modify "+req.DN)
+
+	entry := f.entries[req.DN]
+
+	for _, change := range req.Changes {
+		values := entry.GetAttributeValues(change.Modification.Type)
+
+		switch change.Operation {
+		case ldap.AddAttribute:
+			values = append(values, change.Modification.Vals...)
+		case ldap.ReplaceAttribute:
+			values = change.Modification.Vals
+		case ldap.DeleteAttribute:
+			if len(change.Modification.Vals) == 0 {
+				values = nil
+			}
+
+			for _, val := range change.Modification.Vals {
+				for i, v := range values {
+					if sameDN(v, val) {
+						values = append(values[:i], values[i+1:]...)
+						break
+					}
+				}
+			}
+		}
+
+		set := false
+
+		for _, attribute := range entry.Attributes {
+			if attribute.Name == change.Modification.Type {
+				attribute.Values = values
+				set = true
+			}
+		}
+
+		if !set {
+			entry.Attributes = append(entry.Attributes, ldap.NewEntryAttribute(change.Modification.Type, values))
+		}
+	}
+
+	return nil
+}
+
+func (f *fakeLdap) Del(req *ldap.DelRequest) error {
+	f.calls = append(f.calls, "delete "+req.DN)
+	delete(f.entries, req.DN)
+	return nil
+}
+
+func newLdapTestFixture(t *testing.T) (*OrgChart, *fakeLdap) {
+	chart := &OrgChart{
+		Teams: []*Team{
+			{ID: "tribe", Name: "Tribe", Kind: "Tribe", TeachLeadID: "lead"},
+			{ID: "squad_one", Name: "Squad One", Description: "the first", Kind: "Squad", ParentID: "tribe", TeachLeadID: "alice"},
+		},
+		Employees: []*Employee{
+			{ID: "lead", Name: "Lead", MemberOf: "tribe", Email: "lead@example.com", Stream: "ENGINEERING"},
+			{ID: "alice", Name: "Alice", MemberOf: "squad_one", Email: "Alice@Example.com", Stream: "ENGINEERING"},
+			{ID: "bob", Name: "Bob", MemberOf: "squad_one", Stream: "ENGINEERING"},
+			{ID: "carol", Name: "Carol", MemberOf: "squad_one", Stream: "ENGINEERING", Slack: "U0CAROL"},
+		},
+	}
+
+	if err := chart.organise(); err != nil {
+		t.Fatal(err)
+	}
+
+	users := "ou=people,dc=example,dc=com"
+	groups := "ou=groups,dc=example,dc=com"
+
+	fake := &fakeLdap{
+		userBaseDN:  users,
+		groupBaseDN: groups,
+		entries:     map[string]*ldap.Entry{},
+	}
+
+	for dn, attributes := range map[string]map[string][]string{
+		"uid=lead," + users:   {"mail": {"lead@example.com"}, "uid": {"lead"}},
+		"uid=alice," + users:  {"mail": {"alice@example.com"}, "uid": {"alice"}, "manager": {"uid=lead," + users}},
+		"uid=bob," + users:    {"uid": {"bob"}, "manager": {"uid=lead," + users}},
+		"uid=leaver," + users: {"uid": {"leaver"}},
+		"cn=org-squad-one," + groups: {
+			"cn":          {"org-squad-one"},
+			"description": {"the first"},
+			"member":      {"UID=Alice, OU=People,DC=example,DC=com", "uid=leaver," + users},
+		},
+		"cn=org-gone," + groups: {"cn": {"org-gone"}, "member": {"uid=leaver," + users}},
+	} {
+		fake.entries[dn] = ldap.NewEntry(dn, attributes)
+	}
+
+	return chart, fake
+}
+
+func syncLdap(t *testing.T, chart *OrgChart, fake *fakeLdap, dry bool) (*ldapSyncReport, error) {
+	directory := &LdapState{
+		conn:              fake,
+		userBaseDN:        fake.userBaseDN,
+		groupBaseDN:       fake.groupBaseDN,
+		groupPrefix:       "org-",
+		groupClasses:      []string{"top", "groupOfNames"},
+		dry:               dry,
+		maxGroupRemovals:  5,
+		maxMemberRemovals: 5,
+	}
+
+	if err := directory.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	report := newLdapSyncReport(dry)
+
+	return report, directory.Sync(chart, report)
+}
+
+func TestLdapSync(t *testing.T) {
+	chart, fake := newLdapTestFixture(t)
+
+	report, err := syncLdap(t, chart, fake, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := fake.userBaseDN
+	groups := fake.groupBaseDN
+
+	members := func(dn string) []string {
+		entry, ok := fake.entries[dn]
+
+		if !ok {
+			t.Fatalf("expected group %s", dn)
+		}
+
+		members := []string{}
+
+		for _, member := range entry.GetAttributeValues("member") {
+			members = append(members, normaliseDN(member))
+		}
+
+		sort.Strings(members)
+
+		return members
+	}
+
+	if got := members("cn=org-squad-one," + groups); !reflect.DeepEqual(got, []string{"uid=alice," + users, "uid=bob," + users}) {
+		t.Errorf("unexpected members of org-squad-one %v", got)
+	}
+
+	if got := members("cn=org-tribe," + groups); !reflect.DeepEqual(got, []string{"uid=lead," + users}) {
+		t.Errorf("unexpected members of org-tribe %v", got)
+	}
+
+	if _, ok := fake.entries["cn=org-gone,"+groups]; ok {
+		t.Error("expected org-gone to be removed")
+	}
+
+	// alice leads the squad bob is in, and reports to the lead of the tribe
+	for uid, manager := range map[string]string{"alice": "uid=lead," + users, "bob": "uid=alice," + users} {
+		if got := fake.entries["uid="+uid+","+users].GetAttributeValue("manager"); got != manager {
+			t.Errorf("expected the manager of %s to be %s, got %s", uid, manager, got)
+		}
+	}
+
+	expected := []ldapReportChange{{"uid=bob," + users, "manager", "uid=lead," + users, "uid=alice," + users}}
+
+	if !reflect.DeepEqual(report.ManagerChanges, expected) {
+		t.Errorf("unexpected manager changes %v", report.ManagerChanges)
+	}
+
+	if !reflect.DeepEqual(report.MembershipRemovals, []ldapReportMember{{"cn=org-squad-one," + groups, "uid=leaver," + users}}) {
+		t.Errorf("unexpected removals %v", report.MembershipRemovals)
+	}
+
+	// a slack id is nothing to match on here
+	if len(report.UnmatchedEmployees) != 1 || report.UnmatchedEmployees[0].ID != "carol" || report.UnmatchedEmployees[0].Reason != unmatchedNoEmail {
+		t.Errorf("expected carol to be unmatched for having no email, got %v", report.UnmatchedEmployees)
+	}
+}
+
+func TestLdapSyncDryRunChangesNothing(t *testing.T) {
+	chart, fake := newLdapTestFixture(t)
+
+	report, err := syncLdap(t, chart, fake, true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fake.calls) > 0 {
+		t.Errorf("unexpected changes in a dry run %v", fake.calls)
+	}
+
+	if len(report.CreatedGroups) != 1 || len(report.RemovedGroups) != 1 || len(report.ManagerChanges) != 1 {
+		t.Errorf("expected the changes to be reported, got %+v", report)
+	}
+}
+
+func TestLdapSyncRefusesTooManyRemovals(t *testing.T) {
+	chart, fake := newLdapTestFixture(t)
+
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		dn := "cn=org-gone-" + id + "," + fake.groupBaseDN
+		fake.entries[dn] = ldap.NewEntry(dn, map[string][]string{"cn": {"org-gone-" + id}})
+	}
+
+	if _, err := syncLdap(t, chart, fake, false); err == nil {
+		t.Fatal("expected the sync to refuse removing 6 groups")
+	}
+
+	if len(fake.calls) > 0 {
+		t.Errorf("unexpected changes after refusing %v", fake.calls)
+	}
+}
+
+func TestDiffDNs(t *testing.T) {
+	added, removed := diffDNs(
+		[]string{"uid=a,dc=example", "UID=B, DC=Example", "cn=x+uid=c,dc=example"},
+		[]string{"uid=A,dc=example", "uid=c+cn=X,dc=example", "uid=d,dc=example", "uid=d,DC=example"},
+	)
+
+	if !reflect.DeepEqual(added, []string{"uid=d,dc=example"}) || !reflect.DeepEqual(removed, []string{"UID=B, DC=Example"}) {
+		t.Errorf("unexpected diff, added %v and removed %v", added, removed)
+	}
+}
@@ -1,14 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
@@ -448,16 +451,1037 @@ func main() {
 					Name:  "github-team-prefix",
 					Value: "org-",
 				},
+				cli.StringFlag{
+					Name:  "github-team-privacy",
+					Value: "closed",
+					Usage: "default privacy (closed or secret) for teams without a githubPrivacy setting",
+				},
+				cli.StringFlag{
+					Name:  "github-state-file",
+					Usage: "file mapping org teams to github team ids, used to rename teams in place when their id changes",
+				},
+				cli.BoolFlag{
+					Name:  "annotate-chart",
+					Usage: "record the github team id of every team in the org chart document, so that teams changing both id and name keep their github team",
+				},
+				cli.BoolFlag{
+					Name:  "check",
+					Usage: "only compute the drift between the org chart and github, failing when there is any",
+				},
+				cli.StringFlag{
+					Name:  "metrics-address",
+					Usage: "keep checking for drift, serving it as prometheus metrics on this address",
+				},
+				cli.DurationFlag{
+					Name:  "check-interval",
+					Value: 15 * time.Minute,
+					Usage: "how often drift is checked when serving metrics",
+				},
+				cli.StringFlag{
+					Name:  "report",
+					Usage: "file to write a JSON report of the changes made to",
+				},
+				cli.StringFlag{
+					Name:  "config",
+					Usage: "JSON file describing several github organisations to sync, replaces the per organisation flags",
+				},
+				cli.BoolFlag{
+					Name: "dry-run",
+				},
+				cli.BoolFlag{
+					Name: "skip-members",
+				},
+				cli.StringFlag{
+					Name:  "membership-strategy",
+					Value: membershipDirect,
+					Usage: "how employees are added to github teams, direct, rolled-up to ancestor teams or leads-only, for teams without a githubMembership setting",
+				},
+				cli.StringSliceFlag{
+					Name:  "include-type",
+					Usage: "only sync employees of this type to their team, repeatable",
+				},
+				cli.StringSliceFlag{
+					Name:  "exclude-type",
+					Usage: "don't sync employees of this type to their team, repeatable",
+				},
+				cli.StringSliceFlag{
+					Name:  "include-stream",
+					Usage: "only sync employees of this stream to their team, repeatable",
+				},
+				cli.StringSliceFlag{
+					Name:  "exclude-stream",
+					Usage: "don't sync employees of this stream to their team, repeatable",
+				},
+				cli.StringSliceFlag{
+					Name:  "include-team-kind",
+					Usage: "only sync employees of teams of this kind to their team, repeatable",
+				},
+				cli.StringSliceFlag{
+					Name:  "exclude-team-kind",
+					Usage: "don't sync employees of teams of this kind to their team, repeatable",
+				},
+				cli.StringSliceFlag{
+					Name:  "drop-type",
+					Usage: "never sync employees of this type to github, not even to the excluded team, repeatable",
+				},
+				cli.StringFlag{
+					Name:  "excluded-team",
+					Usage: "github team, e.g. org-contractors, excluded employees are added to instead of their own team",
+				},
+				cli.IntFlag{
+					Name:  "max-team-removals",
+					Usage: "refuse to remove more github teams than this in one run, 0 for no limit",
+				},
+				cli.BoolFlag{
+					Name:  "maintainer-roles",
+					Usage: "make team leads maintainers of their github teams and everyone else members, changing the role of existing members",
+				},
+				cli.BoolFlag{
+					Name:  "invite-members",
+					Usage: "invite employees with a github handle who are not members of the organisation",
+				},
+				cli.BoolFlag{
+					Name:  "repos",
+					Usage: "reconcile team repository permissions with the repositories declared in the org chart",
+				},
+			},
+			Action: func(c *cli.Context) error {
+
+				logrus.SetLevel(logrus.DebugLevel)
+
+				targets := []*githubSyncTarget{githubSyncTargetFromFlags(c)}
+
+				if config := c.String("config"); config != "" {
+					var err error
+
+					targets, err = loadGithubSyncConfig(config)
+
+					if err != nil {
+						return errors.Wrap(err, "loading gh-sync config")
+					}
+				}
+
+				if address := c.String("metrics-address"); address != "" {
+					return serveGithubDrift(c.String("data-url"), targets, c.String("github-token"), address, c.Duration("check-interval"))
+				}
+
+				orgChart, err := loadOrgChartData(c.String("data-url"))
+
+				if err != nil {
+					return errors.Wrap(err, "retrieving org chart data")
+				}
+
+				report := runGithubSync(orgChart, targets, c.String("github-token"), c.Bool("dry-run") || c.Bool("check"))
+
+				if reportFile := c.String("report"); reportFile != "" {
+					if err := report.save(reportFile); err != nil {
+						return errors.Wrap(err, "writing report")
+					}
+				}
+
+				if c.Bool("annotate-chart") && !c.Bool("dry-run") && !c.Bool("check") {
+					if err := annotateGithubTeams(c.String("data-url"), report); err != nil {
+						return errors.Wrap(err, "annotating the org chart with github team ids")
+					}
+				}
+
+				if failed := report.failed(); failed > 0 {
+					return errors.Errorf("%d of %d github organisations failed to sync", failed, len(targets))
+				}
+
+				if c.Bool("check") {
+					drift := 0
+
+					for _, orgReport := range report.Orgs {
+						for kind, count := range orgReport.drift() {
+							if count > 0 {
+								logrus.WithField("org", orgReport.Organisation).Infof("%d %s changes drifted from the org chart", count, kind)
+							}
+							drift += count
+						}
+					}
+
+					if drift > 0 {
+						return errors.Errorf("github has drifted from the org chart by %d changes", drift)
+					}
+
+					logrus.Info("github is in sync with the org chart")
+				}
+
+				return nil
+
+			},
+		},
+		{
+			Name:  "codeowners",
+			Usage: "render a CODEOWNERS file from a mapping of path patterns to org teams",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name: "data-url",
+				},
+				cli.StringFlag{
+					Name:  "mapping",
+					Usage: "file with a path pattern followed by org team ids per line",
+				},
+				cli.StringFlag{
+					Name: "github-org",
+				},
+				cli.StringFlag{
+					Name:  "github-team-prefix",
+					Value: "org-",
+				},
+				cli.StringFlag{
+					Name:  "github-state-file",
+					Usage: "github state file written by gh-sync, used to find the parents of removed teams",
+				},
+				cli.StringFlag{
+					Name:  "output-file",
+					Usage: "CODEOWNERS file to write, stdout when empty",
+				},
+				cli.BoolFlag{
+					Name:  "check",
+					Usage: "fail when the output file differs from the generated CODEOWNERS instead of writing it",
+				},
+			},
+			Action: func(c *cli.Context) error {
+
+				if c.String("github-org") == "" {
+					return errors.New("a github organisation is required, owners are written as @org/team")
+				}
+
+				orgChart, err := loadOrgChartData(c.String("data-url"))
+
+				if err != nil {
+					return errors.Wrap(err, "retrieving org chart data")
+				}
+
+				orgChart.assignGithubTeams(c.String("github-team-prefix"))
+
+				mappingFile, err := os.Open(c.String("mapping"))
+
+				if err != nil {
+					return errors.Wrap(err, "opening mapping")
+				}
+
+				defer mappingFile.Close()
+
+				rules, err := parseCodeownersMapping(mappingFile)
+
+				if err != nil {
+					return errors.Wrap(err, "parsing mapping")
+				}
+
+				var teamMapping *githubTeamMapping
+
+				if stateFile := c.String("github-state-file"); stateFile != "" {
+					teamMapping, err = loadGithubTeamMapping(stateFile)
+
+					if err != nil {
+						return errors.Wrap(err, "loading github state file")
+					}
+				}
+
+				generated := &bytes.Buffer{}
+
+				if err := renderCodeowners(generated, orgChart, c.String("github-org"), rules, teamMapping); err != nil {
+					return errors.Wrap(err, "rendering CODEOWNERS")
+				}
+
+				outputFile := c.String("output-file")
+
+				if c.Bool("check") {
+					if outputFile == "" {
+						return errors.New("--check requires --output-file")
+					}
+
+					committed, err := ioutil.ReadFile(outputFile)
+
+					if err != nil {
+						return errors.Wrap(err, "reading CODEOWNERS")
+					}
+
+					if !bytes.Equal(committed, generated.Bytes()) {
+						return errors.Errorf("%s is out of date with the org chart", outputFile)
+					}
+
+					logrus.Infof("%s is up to date", outputFile)
+					return nil
+				}
+
+				if outputFile == "" {
+					_, err = os.Stdout.Write(generated.Bytes())
+					return err
+				}
+
+				return ioutil.WriteFile(outputFile, generated.Bytes(), 0644)
+			},
+		},
+		{
+			Name:  "offboarding",
+			Usage: "report github organisation members who are not in the org chart and optionally offboard leavers",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name: "data-url",
+				},
+				cli.StringFlag{
+					Name:   "github-token",
+					EnvVar: "GITHUB_TOKEN",
+				},
+				cli.StringFlag{
+					Name: "github-org",
+				},
+				cli.StringFlag{
+					Name:  "github-state-file",
+					Usage: "github state file written by gh-sync, members synced from the org chart before are leavers",
+				},
+				cli.StringFlag{
+					Name:  "allow-list",
+					Usage: "file listing the github logins of bots and service accounts",
+				},
+				cli.StringFlag{
+					Name:  "output-file",
+					Usage: "report file to write, stdout when empty",
+				},
+				cli.BoolFlag{
+					Name: "csv",
+				},
+				cli.BoolFlag{
+					Name:  "remove-leavers",
+					Usage: "remove leavers from the organisation",
+				},
+				cli.BoolFlag{
+					Name:  "convert-leavers",
+					Usage: "convert leavers to outside collaborators",
+				},
+				cli.IntFlag{
+					Name:  "max-removals",
+					Value: 5,
+					Usage: "refuse to offboard more leavers than this in one run, 0 for no limit",
+				},
+				cli.BoolFlag{
+					Name: "dry-run",
+				},
+			},
+			Action: func(c *cli.Context) error {
+
+				if c.Bool("remove-leavers") && c.Bool("convert-leavers") {
+					return errors.New("--remove-leavers and --convert-leavers are mutually exclusive")
+				}
+
+				orgChart, err := loadOrgChartData(c.String("data-url"))
+
+				if err != nil {
+					return errors.Wrap(err, "retrieving org chart data")
+				}
+
+				gh, err := newGithubState(c.String("github-token"), c.String("github-org"), "")
+
+				if err != nil {
+					return errors.Wrap(err, "retrieving github data")
+				}
+
+				gh.dry = c.Bool("dry-run")
+
+				if gh.dry {
+					logrus.Info("running in DRY mode")
+				}
+
+				collaborators, err := gh.getOutsideCollaborators()
+
+				if err != nil {
+					return errors.Wrap(err, "retrieving outside collaborators")
+				}
+
+				allowed := map[string]bool{}
+
+				if allowList := c.String("allow-list"); allowList != "" {
+					f, err := os.Open(allowList)
+
+					if err != nil {
+						return errors.Wrap(err, "opening allow list")
+					}
+
+					allowed, err = parseAllowList(f)
+					f.Close()
+
+					if err != nil {
+						return errors.Wrap(err, "parsing allow list")
+					}
+				}
+
+				var teamMapping *githubTeamMapping
+
+				if stateFile := c.String("github-state-file"); stateFile != "" {
+					teamMapping, err = loadGithubTeamMapping(stateFile)
+
+					if err != nil {
+						return errors.Wrap(err, "loading github state file")
+					}
+				} else {
+					logrus.Warn("no github state file given, leavers cannot be told apart from unknown members")
+				}
+
+				report := offboardingReport(orgChart, gh, collaborators, allowed, teamMapping)
+
+				// the report is written even when offboarding fails part way, it tells who was
+				// already offboarded
+				var offboardErr error
+
+				if c.Bool("remove-leavers") || c.Bool("convert-leavers") {
+					offboardErr = gh.offboardLeavers(report, c.Bool("convert-leavers"), c.Int("max-removals"))
+				}
+
+				if err := writeOffboardingReport(c.String("output-file"), c.Bool("csv"), report); err != nil {
+					return errors.Wrap(err, "writing output")
+				}
+
+				if offboardErr != nil {
+					return errors.Wrap(offboardErr, "offboarding leavers")
+				}
+
+				return nil
+			},
+		},
+		{
+			Name:  "slack-sync",
+			Usage: "sync org chart teams to slack user groups",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name: "data-url",
+				},
+				cli.StringFlag{
+					Name:   "slack-token",
+					EnvVar: "SLACK_TOKEN",
+				},
+				cli.StringFlag{
+					Name:  "slack-api-url",
+					Value: "https://slack.com/api/",
+					Usage: "slack web api to call, can point at a local stand-in",
+				},
+				cli.StringFlag{
+					Name:  "group-prefix",
+					Value: "squad-",
+					Usage: "prefix of the user group handles managed by the sync",
+				},
+				cli.IntFlag{
+					Name:  "max-group-removals",
+					Value: 5,
+					Usage: "refuse to disable more user groups than this in one run, 0 for no limit",
+				},
+				cli.IntFlag{
+					Name:  "max-member-removals",
+					Value: 20,
+					Usage: "refuse to remove more users from user groups than this in one run, 0 for no limit",
+				},
+				cli.StringFlag{
+					Name:  "report",
+					Usage: "file to write a JSON report of the changes made to",
+				},
+				cli.BoolFlag{
+					Name: "dry-run",
+				},
+			},
+			Action: func(c *cli.Context) error {
+
+				if c.String("group-prefix") == "" {
+					return errors.New("a group prefix is required, user groups outside of it are left alone")
+				}
+
+				orgChart, err := loadOrgChartData(c.String("data-url"))
+
+				if err != nil {
+					return errors.Wrap(err, "retrieving org chart data")
+				}
+
+				slack, err := newSlackState(newSlackClient(c.String("slack-api-url"), c.String("slack-token")), c.String("group-prefix"))
+
+				if err != nil {
+					return errors.Wrap(err, "retrieving slack data")
+				}
+
+				slack.dry = c.Bool("dry-run")
+				slack.maxGroupRemovals = c.Int("max-group-removals")
+				slack.maxMemberRemovals = c.Int("max-member-removals")
+
+				if slack.dry {
+					logrus.Info("running in DRY mode")
+				}
+
+				report := newSlackSyncReport(slack.dry)
+
+				err = slack.Sync(orgChart, report)
+
+				report.finish(err)
+
+				logUnmatched("slack", report.UnmatchedEmployees)
+
+				for _, handle := range report.CreatedGroups {
+					logrus.Infof("created user group %s in slack", handle)
+				}
+
+				for _, change := range report.GroupChanges {
+					logrus.Infof("changed %s of %s in slack from %q to %q", change.Subject, change.Group, change.From, change.To)
+				}
+
+				for _, m := range report.MembershipAdditions {
+					logrus.Infof("added %s to %s in slack", m.Name, m.Group)
+				}
+
+				for _, m := range report.MembershipRemovals {
+					logrus.Infof("removed %s from %s in slack", m.Name, m.Group)
+				}
+
+				for _, handle := range report.DisabledGroups {
+					logrus.Infof("disabled user group %s in slack", handle)
+				}
+
+				if reportFile := c.String("report"); reportFile != "" {
+					if err := report.save(reportFile); err != nil {
+						return errors.Wrap(err, "writing report")
+					}
+				}
+
+				if err != nil {
+					return errors.Wrap(err, "syncing user groups")
+				}
+
+				return nil
+			},
+		},
+		{
+			Name:  "scim-serve",
+			Usage: "serve the org chart as a read only SCIM 2.0 endpoint, employees as users and teams as groups",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name: "data-url",
+				},
+				cli.StringFlag{
+					Name:  "address",
+					Value: ":8080",
+				},
+				cli.StringFlag{
+					Name:   "token",
+					EnvVar: "SCIM_TOKEN",
+					Usage:  "bearer token clients must present, no authentication when empty",
+				},
+				cli.StringFlag{
+					Name:  "base-url",
+					Usage: "external url of the scim endpoint used in resource locations, defaults to the address",
+				},
+				cli.DurationFlag{
+					Name:  "refresh-interval",
+					Value: 5 * time.Minute,
+					Usage: "how long the org chart data is served before being reloaded",
+				},
+			},
+			Action: func(c *cli.Context) error {
+
+				baseURL := c.String("base-url")
+
+				if baseURL == "" {
+					baseURL = "http://" + c.String("address") + "/scim/v2"
+				}
+
+				server := &scimServer{
+					dataURL: c.String("data-url"),
+					token:   c.String("token"),
+					refresh: c.Duration("refresh-interval"),
+					baseURL: strings.TrimSuffix(baseURL, "/"),
+				}
+
+				if _, err := server.resources(); err != nil {
+					return errors.Wrap(err, "retrieving org chart data")
+				}
+
+				if server.token == "" {
+					logrus.Warn("no token given, the scim endpoint is open to anyone who can reach it")
+				}
+
+				mux := http.NewServeMux()
+				mux.Handle("/scim/v2/", server)
+
+				logrus.Infof("serving scim on %s", c.String("address"))
+
+				return http.ListenAndServe(c.String("address"), mux)
+			},
+		},
+		{
+			Name:  "import-hr",
+			Usage: "propose the new starters, changes and leavers of an HR CSV export as a diff of the org chart, saving it with --apply",
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "file",
+					Usage: "HR CSV export, with a header row",
+				},
+				cli.StringSliceFlag{
+					Name:  "column",
+					Usage: "field=column naming the CSV column of a field, one of " + strings.Join(hrImportFields, ", ") + ", columns default to the field name",
+				},
+				cli.StringSliceFlag{
+					Name:  "type-map",
+					Usage: "hr=chart translating an HR employment type into a chart type",
+				},
+				cli.StringFlag{
+					Name:  "date-layout",
+					Value: "2006-01-02",
+					Usage: "Go time layout of the start dates in the HR export, they are saved as the admin UI writes them",
+				},
+				cli.StringFlag{
+					Name:  "team",
+					Usage: "team new starters join when their row names no known team",
+				},
+				cli.IntFlag{
+					Name:  "max-removals",
+					Value: 5,
+					Usage: "refuse to remove more employees than this in one run, 0 for no limit",
+				},
+			}, chartEditFlags...),
+			Action: func(c *cli.Context) error {
+
+				columns, err := parseHRColumns(c.StringSlice("column"))
+
+				if err != nil {
+					return err
+				}
+
+				types, err := parseHRTypes(c.StringSlice("type-map"))
+
+				if err != nil {
+					return err
+				}
+
+				f, err := os.Open(c.String("file"))
+
+				if err != nil {
+					return errors.Wrap(err, "opening HR export")
+				}
+
+				rows, err := parseHRExport(f, columns, types, c.String("date-layout"))
+				f.Close()
+
+				if err != nil {
+					return errors.Wrap(err, "parsing HR export")
+				}
+
+				return runChartEdit(c, func(doc *chartDocument) ([]chartChange, error) {
+					result, err := doc.importHR(rows, c.String("team"))
+
+					if err != nil {
+						return nil, err
+					}
+
+					for _, row := range result.skipped {
+						logrus.Warnf("skipping new starter %s (%s %s), no name or team", row["name"], row["number"], row["email"])
+					}
+
+					if err := checkRemovalThreshold("employees", result.removals, c.Int("max-removals")); err != nil {
+						return nil, err
+					}
+
+					return result.changes, nil
+				})
+			},
+		},
+		{
+			Name:  "move-team",
+			Usage: "nest a team under another one, or at the top level without a parent",
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name: "team",
+				},
+				cli.StringFlag{
+					Name: "parent",
+				},
+			}, chartEditFlags...),
+			Action: func(c *cli.Context) error {
+				return runChartEdit(c, func(doc *chartDocument) ([]chartChange, error) {
+					return doc.moveTeam(c.String("team"), c.String("parent"))
+				})
+			},
+		},
+		{
+			Name:  "move-employee",
+			Usage: "move an employee to another team",
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name: "employee",
+				},
+				cli.StringFlag{
+					Name: "team",
+				},
+			}, chartEditFlags...),
+			Action: func(c *cli.Context) error {
+				return runChartEdit(c, func(doc *chartDocument) ([]chartChange, error) {
+					return doc.moveEmployee(c.String("employee"), c.String("team"))
+				})
+			},
+		},
+		{
+			Name:  "set-lead",
+			Usage: "set the lead of a stream in a team, clearing it without an employee",
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name: "team",
+				},
+				cli.StringFlag{
+					Name:  "stream",
+					Usage: "stream led, engineering leads are the tech lead",
+				},
+				cli.StringFlag{
+					Name: "employee",
+				},
+			}, chartEditFlags...),
+			Action: func(c *cli.Context) error {
+				return runChartEdit(c, func(doc *chartDocument) ([]chartChange, error) {
+					return doc.setLead(c.String("team"), c.String("stream"), c.String("employee"))
+				})
+			},
+		},
+		{
+			Name:  "ldap-sync",
+			Usage: "set the manager of ldap users from the org chart and sync teams to groupOfNames entries",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name: "data-url",
+				},
+				cli.StringFlag{
+					Name:  "ldap-url",
+					Value: "ldap://localhost:389",
+					Usage: "ldap:// or ldaps:// url of the directory",
+				},
+				cli.BoolFlag{
+					Name: "start-tls",
+				},
+				cli.StringFlag{
+					Name: "bind-dn",
+				},
+				cli.StringFlag{
+					Name:   "bind-password",
+					EnvVar: "LDAP_BIND_PASSWORD",
+				},
+				cli.StringFlag{
+					Name:  "user-base-dn",
+					Usage: "where users are searched for, they are matched to employees by mail or by a uid equal to the employee id",
+				},
+				cli.StringFlag{
+					Name:  "user-filter",
+					Value: "(objectClass=inetOrgPerson)",
+				},
+				cli.StringFlag{
+					Name:  "group-base-dn",
+					Usage: "where the groupOfNames of teams are kept",
+				},
+				cli.StringFlag{
+					Name:  "group-prefix",
+					Value: "org-",
+					Usage: "prefix of the cn of groups managed by the sync",
+				},
+				cli.StringSliceFlag{
+					Name:  "group-object-class",
+					Usage: "object classes of created groups, top and groupOfNames when not given",
+				},
+				cli.IntFlag{
+					Name:  "max-group-removals",
+					Value: 5,
+					Usage: "refuse to remove more groups than this in one run, 0 for no limit",
+				},
+				cli.IntFlag{
+					Name:  "max-member-removals",
+					Value: 20,
+					Usage: "refuse to remove more members from groups than this in one run, 0 for no limit",
+				},
+				cli.StringFlag{
+					Name:  "report",
+					Usage: "file to write a JSON report of the changes made to",
+				},
+				cli.BoolFlag{
+					Name: "dry-run",
+				},
+			},
+			Action: func(c *cli.Context) error {
+
+				if c.String("group-prefix") == "" {
+					return errors.New("a group prefix is required, groups outside of it are left alone")
+				}
+
+				if c.String("user-base-dn") == "" || c.String("group-base-dn") == "" {
+					return errors.New("--user-base-dn and --group-base-dn are required")
+				}
+
+				orgChart, err := loadOrgChartData(c.String("data-url"))
+
+				if err != nil {
+					return errors.Wrap(err, "retrieving org chart data")
+				}
+
+				conn, err := dialLdap(c.String("ldap-url"), c.Bool("start-tls"), c.String("bind-dn"), c.String("bind-password"))
+
+				if err != nil {
+					return errors.Wrap(err, "connecting to ldap")
+				}
+
+				defer conn.Close()
+
+				groupClasses := c.StringSlice("group-object-class")
+
+				if len(groupClasses) == 0 {
+					groupClasses = []string{"top", "groupOfNames"}
+				}
+
+				directory := &LdapState{
+					conn:              conn,
+					userBaseDN:        c.String("user-base-dn"),
+					userFilter:        c.String("user-filter"),
+					groupBaseDN:       c.String("group-base-dn"),
+					groupPrefix:       c.String("group-prefix"),
+					groupClasses:      groupClasses,
+					dry:               c.Bool("dry-run"),
+					maxGroupRemovals:  c.Int("max-group-removals"),
+					maxMemberRemovals: c.Int("max-member-removals"),
+				}
+
+				if directory.dry {
+					logrus.Info("running in DRY mode")
+				}
+
+				if err := directory.load(); err != nil {
+					return errors.Wrap(err, "retrieving ldap data")
+				}
+
+				report := newLdapSyncReport(directory.dry)
+
+				err = directory.Sync(orgChart, report)
+
+				report.finish(err)
+
+				logUnmatched("ldap", report.UnmatchedEmployees)
+
+				for _, change := range report.ManagerChanges {
+					logrus.Infof("changed manager of %s in ldap from %q to %q", change.DN, change.From, change.To)
+				}
+
+				for _, dn := range report.CreatedGroups {
+					logrus.Infof("created group %s in ldap", dn)
+				}
+
+				for _, change := range report.GroupChanges {
+					logrus.Infof("changed %s of %s in ldap from %q to %q", change.Subject, change.DN, change.From, change.To)
+				}
+
+				for _, m := range report.MembershipAdditions {
+					logrus.Infof("added %s to %s in ldap", m.Member, m.Group)
+				}
+
+				for _, m := range report.MembershipRemovals {
+					logrus.Infof("removed %s from %s in ldap", m.Member, m.Group)
+				}
+
+				for _, dn := range report.RemovedGroups {
+					logrus.Infof("removed group %s from ldap", dn)
+				}
+
+				if reportFile := c.String("report"); reportFile != "" {
+					if err := report.save(reportFile); err != nil {
+						return errors.Wrap(err, "writing report")
+					}
+				}
+
+				if err != nil {
+					return errors.Wrap(err, "syncing ldap")
+				}
+
+				return nil
+			},
+		},
+		{
+			Name:  "google-groups-sync",
+			Usage: "sync teams to Google Workspace groups with membership from employee emails",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name: "data-url",
+				},
+				cli.StringFlag{
+					Name:  "credentials-file",
+					Usage: "service account key with domain wide delegation of the admin directory group scope",
+				},
+				cli.StringFlag{
+					Name:  "admin-email",
+					Usage: "workspace admin the service account acts as",
+				},
+				cli.StringFlag{
+					Name:  "api-url",
+					Usage: "base url of the directory api, the Google one when not given",
+				},
+				cli.StringFlag{
+					Name:  "customer",
+					Value: "my_customer",
+					Usage: "workspace customer id whose groups are synced",
+				},
+				cli.StringFlag{
+					Name:  "email-pattern",
+					Usage: "address of the group of a team with {id} standing for the team id, e.g. squad-{id}@example.com",
+				},
+				cli.StringFlag{
+					Name:  "membership-strategy",
+					Value: membershipDirect,
+					Usage: "direct, rolled-up to include descendant teams or leads-only",
+				},
+				cli.IntFlag{
+					Name:  "max-group-removals",
+					Value: 5,
+					Usage: "refuse to remove more groups than this in one run, 0 for no limit",
+				},
+				cli.IntFlag{
+					Name:  "max-member-removals",
+					Value: 20,
+					Usage: "refuse to remove more members from groups than this in one run, 0 for no limit",
+				},
+				cli.StringFlag{
+					Name:  "report",
+					Usage: "file to write a JSON report of the changes made to",
+				},
 				cli.BoolFlag{
 					Name: "dry-run",
 				},
+			},
+			Action: func(c *cli.Context) error {
+
+				if !strings.Contains(c.String("email-pattern"), "{id}") {
+					return errors.New("an email pattern containing {id} is required, groups outside of it are left alone")
+				}
+
+				if !validMembershipStrategy(c.String("membership-strategy")) {
+					return errors.Errorf("invalid membership strategy %s", c.String("membership-strategy"))
+				}
+
+				orgChart, err := loadOrgChartData(c.String("data-url"))
+
+				if err != nil {
+					return errors.Wrap(err, "retrieving org chart data")
+				}
+
+				ctx := context.Background()
+
+				service, err := newDirectoryService(ctx, c.String("credentials-file"), c.String("admin-email"), c.String("api-url"))
+
+				if err != nil {
+					return errors.Wrap(err, "creating directory client")
+				}
+
+				groups := &GoogleGroupsState{
+					service:           service,
+					customer:          c.String("customer"),
+					emailPattern:      c.String("email-pattern"),
+					strategy:          c.String("membership-strategy"),
+					dry:               c.Bool("dry-run"),
+					maxGroupRemovals:  c.Int("max-group-removals"),
+					maxMemberRemovals: c.Int("max-member-removals"),
+				}
+
+				if groups.dry {
+					logrus.Info("running in DRY mode")
+				}
+
+				if err := groups.load(ctx); err != nil {
+					return errors.Wrap(err, "retrieving google groups")
+				}
+
+				report := newGoogleGroupsSyncReport(groups.customer, groups.dry)
+
+				err = groups.Sync(ctx, orgChart, report)
+
+				report.finish(err)
+
+				logUnmatched("google", report.UnmatchedEmployees)
+
+				for _, email := range report.CreatedGroups {
+					logrus.Infof("created google group %s", email)
+				}
+
+				for _, change := range report.GroupChanges {
+					logrus.Infof("changed %s of google group %s from %q to %q", change.Subject, change.Group, change.From, change.To)
+				}
+
+				for _, m := range report.MembershipAdditions {
+					logrus.Infof("added %s to google group %s as %s", m.Member, m.Group, m.Role)
+				}
+
+				for _, change := range report.RoleChanges {
+					logrus.Infof("changed role of %s in google group %s from %s to %s", change.Member, change.Group, change.From, change.To)
+				}
+
+				for _, m := range report.MembershipRemovals {
+					logrus.Infof("removed %s from google group %s", m.Member, m.Group)
+				}
+
+				for _, email := range report.RemovedGroups {
+					logrus.Infof("removed google group %s", email)
+				}
+
+				if reportFile := c.String("report"); reportFile != "" {
+					if err := report.save(reportFile); err != nil {
+						return errors.Wrap(err, "writing report")
+					}
+				}
+
+				if err != nil {
+					return errors.Wrap(err, "syncing google groups")
+				}
+
+				return nil
+			},
+		},
+		{
+			Name:  "k8s-rbac",
+			Usage: "render kubernetes role bindings from a mapping of org teams to namespaces and roles",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name: "data-url",
+				},
+				cli.StringFlag{
+					Name:  "mapping",
+					Usage: "YAML file with grants of namespaces, roles and cluster roles to org team ids",
+				},
+				cli.StringFlag{
+					Name:  "output-dir",
+					Usage: "directory the manifests are written to, one file per binding",
+				},
+				cli.StringFlag{
+					Name:  "subjects",
+					Value: rbacSubjectsGroups,
+					Usage: rbacSubjectsGroups + " to bind the github teams as OIDC groups, or " + rbacSubjectsMembers + " to bind every member as a user",
+				},
+				cli.StringFlag{
+					Name:  "github-team-prefix",
+					Value: "org-",
+				},
+				cli.StringFlag{
+					Name:  "group-prefix",
+					Usage: "prefix of group claims, e.g. the github org followed by a colon",
+				},
+				cli.StringFlag{
+					Name:  "user-identity",
+					Value: "email",
+					Usage: "email or github, the employee field users are known by",
+				},
+				cli.StringFlag{
+					Name:  "user-prefix",
+					Usage: "prefix of user names, as set by the api server --oidc-username-prefix",
+				},
 				cli.BoolFlag{
-					Name: "skip-members",
+					Name:  "check",
+					Usage: "fail when the output directory differs from the generated manifests instead of writing them",
 				},
 			},
 			Action: func(c *cli.Context) error {
 
-				logrus.SetLevel(logrus.DebugLevel)
+				if c.String("output-dir") == "" {
+					return errors.New("an output directory is required")
+				}
+
+				if identity := c.String("user-identity"); identity != "email" && identity != "github" {
+					return errors.Errorf("invalid user identity %s, expected email or github", identity)
+				}
 
 				orgChart, err := loadOrgChartData(c.String("data-url"))
 
@@ -465,73 +1489,318 @@ func main() {
 					return errors.Wrap(err, "retrieving org chart data")
 				}
 
-				for _, t := range orgChart.Teams {
-					t.Github = fmt.Sprintf("%s%s", c.String("github-team-prefix"), strings.Replace(t.ID, "_", "-", -1))
-					if t.ParentID != "" {
-						t.ParentGithubID = fmt.Sprintf("%s%s", c.String("github-team-prefix"), strings.Replace(t.ParentID, "_", "-", -1))
+				orgChart.assignGithubTeams(c.String("github-team-prefix"))
+
+				mappingFile, err := os.Open(c.String("mapping"))
+
+				if err != nil {
+					return errors.Wrap(err, "opening mapping")
+				}
+
+				defer mappingFile.Close()
+
+				mapping, err := parseRBACMapping(mappingFile)
+
+				if err != nil {
+					return errors.Wrap(err, "parsing mapping")
+				}
+
+				files, err := renderRBAC(orgChart, mapping, &rbacSubjects{
+					kind:         c.String("subjects"),
+					groupPrefix:  c.String("group-prefix"),
+					userIdentity: c.String("user-identity"),
+					userPrefix:   c.String("user-prefix"),
+					warned:       map[string]bool{},
+				})
+
+				if err != nil {
+					return errors.Wrap(err, "rendering role bindings")
+				}
+
+				changed, err := writeRBAC(c.String("output-dir"), files, c.Bool("check"))
+
+				if err != nil {
+					return errors.Wrap(err, "writing role bindings")
+				}
+
+				if c.Bool("check") {
+					if len(changed) > 0 {
+						return errors.Errorf("%s is out of date with the org chart: %s", c.String("output-dir"), strings.Join(changed, ", "))
 					}
+
+					logrus.Infof("%s is up to date", c.String("output-dir"))
+					return nil
+				}
+
+				for _, name := range changed {
+					logrus.Infof("updated %s", name)
+				}
+
+				logrus.Infof("%d role bindings, %d files changed", len(files), len(changed))
+
+				return nil
+			},
+		},
+		{
+			Name:  "watch",
+			Usage: "follow changes of the org chart and post their events to webhooks",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name: "data-url",
+				},
+				cli.StringSliceFlag{
+					Name:  "webhook-url",
+					Usage: "url events are posted to, can be repeated",
+				},
+				cli.StringFlag{
+					Name:   "webhook-secret",
+					EnvVar: "WEBHOOK_SECRET",
+					Usage:  "secret the X-Org-Chart-Signature HMAC-SHA256 of every body is computed with",
+				},
+				cli.IntFlag{
+					Name:  "attempts",
+					Value: 5,
+					Usage: "how many times a delivery is tried before it is written to the dead letter file",
+				},
+				cli.DurationFlag{
+					Name:  "retry-delay",
+					Value: time.Second,
+					Usage: "delay before retrying a delivery, doubled on every attempt",
+				},
+				cli.DurationFlag{
+					Name:  "webhook-timeout",
+					Value: 10 * time.Second,
+				},
+				cli.StringFlag{
+					Name:  "dead-letter-file",
+					Usage: "file deliveries which failed for good are appended to, one JSON object per line",
+				},
+				cli.StringFlag{
+					Name:  "state-file",
+					Usage: "file remembering the last revision seen, so that changes made while stopped are posted on start",
+				},
+			},
+			Action: func(c *cli.Context) error {
+
+				if len(c.StringSlice("webhook-url")) == 0 {
+					return errors.New("at least one webhook url is required")
+				}
+
+				if c.String("webhook-secret") == "" {
+					logrus.Warn("no webhook secret given, deliveries are not signed")
+				}
+
+				if c.String("dead-letter-file") == "" {
+					logrus.Warn("no dead letter file given, failed deliveries are only logged")
+				}
+
+				watcher := &chartWatcher{
+					location:       c.String("data-url"),
+					webhooks:       c.StringSlice("webhook-url"),
+					secret:         c.String("webhook-secret"),
+					client:         &http.Client{Timeout: c.Duration("webhook-timeout")},
+					feedClient:     &http.Client{Timeout: 90 * time.Second},
+					attempts:       c.Int("attempts"),
+					retryDelay:     c.Duration("retry-delay"),
+					deadLetterFile: c.String("dead-letter-file"),
+					stateFile:      c.String("state-file"),
+				}
+
+				return watcher.run()
+			},
+		},
+		{
+			Name:      "diff",
+			Usage:     "show what changed in the org between two sources of the org chart",
+			ArgsUsage: "<source-a> <source-b>, each a file, a url or a couchdb database url with an optional ?rev=, ?rev=... alone names a revision at --data-url",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name: "data-url",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "text",
+					Usage: "text, markdown or json",
+				},
+			},
+			Action: func(c *cli.Context) error {
+
+				if c.NArg() != 2 {
+					return errors.New("two sources are required")
 				}
 
-				gh, err := newGithubState(c.String("github-token"), c.String("github-org"), c.String("github-team-prefix"))
+				from, err := loadOrgChartSource(c.Args().Get(0), c.String("data-url"))
 
 				if err != nil {
-					return errors.Wrap(err, "retrieving github data")
+					return errors.Wrapf(err, "loading %s", c.Args().Get(0))
 				}
 
-				gh.dry = c.Bool("dry-run")
+				to, err := loadOrgChartSource(c.Args().Get(1), c.String("data-url"))
 
-				if gh.dry {
-					logrus.Info("running in DRY mode")
+				if err != nil {
+					return errors.Wrapf(err, "loading %s", c.Args().Get(1))
+				}
+
+				return writeChartDiff(os.Stdout, c.String("format"), c.Args().Get(0), c.Args().Get(1), diffOrgCharts(from, to))
+			},
+		},
+		{
+			Name:  "history",
+			Usage: "show how the org chart changed across the revisions couchdb still keeps, or backfill the bigquery history tables from them",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name: "data-url",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "text",
+					Usage: "text or json",
+				},
+				cli.StringFlag{
+					Name:  "backfill-before",
+					Usage: "date, as 2006-01-02, bq-import was first scheduled on, the history tables are backfilled for every day before it",
+				},
+				cli.StringFlag{
+					Name:  "revision-dates",
+					Usage: "file of lines of a revision and the time it was saved, as RFC 3339 or 2006-01-02, for revisions saved before the chart kept its save time",
+				},
+				cli.StringFlag{
+					Name: "bq-project-id",
+				},
+				cli.StringFlag{
+					Name: "bq-credentials-file",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "show the partitions a backfill would load without loading them",
+				},
+			},
+			Action: func(c *cli.Context) error {
+
+				history, err := chartHistory(c.String("data-url"))
+
+				if err != nil {
+					return errors.Wrap(err, "retrieving org chart history")
 				}
 
-				if c.Bool("skip-members") {
-					logrus.Infof("skipping members sync")
+				if c.String("revision-dates") != "" {
+					f, err := os.Open(c.String("revision-dates"))
+
+					if err != nil {
+						return errors.Wrap(err, "opening revision dates")
+					}
+
+					dates, err := parseRevisionDates(f)
+					f.Close()
+
+					if err != nil {
+						return errors.Wrap(err, "parsing revision dates")
+					}
+
+					addRevisionDates(history, dates)
 				}
 
-				for _, m := range githubMembersNotInOrgchart(orgChart, gh) {
-					logrus.Infof("github user %s not found in orgchart", m.GetLogin())
+				if c.String("backfill-before") == "" {
+					return writeChartHistory(os.Stdout, c.String("format"), history)
 				}
 
-				for _, m := range employeesNotInGithub(orgChart, gh) {
-					logrus.Infof("employee %s (%s) not found in github, will be added", m.Name, m.Github)
+				until, err := time.Parse("2006-01-02", c.String("backfill-before"))
+
+				if err != nil {
+					return errors.Wrap(err, "parsing --backfill-before")
 				}
 
-				for _, t := range githubTeamsNotInOrgchart(orgChart, gh) {
-					logrus.Infof("github team %s not found in orgchart, will be removed", t.GetName())
+				ctx := context.Background()
+
+				var dataset *bigquery.Dataset
+
+				if !c.Bool("dry-run") {
+					client, err := bigquery.NewClient(
+						ctx,
+						c.String("bq-project-id"),
+						option.WithCredentialsFile(c.String("bq-credentials-file")),
+					)
+
+					if err != nil {
+						return errors.Wrap(err, "creating google client")
+					}
+
+					dataset = client.Dataset("org_chart")
 				}
 
-				for _, m := range teamsNotInGithub(orgChart, gh) {
-					logrus.Infof("team %s (%s) not found in github, will be added", m.Name, m.Github)
+				return backfillHistory(ctx, dataset, history, until, c.Bool("dry-run"))
+			},
+		},
+		{
+			Name:  "snapshot",
+			Usage: "archive every revision of the org chart couchdb keeps to a directory or an S3 compatible bucket, and those saved from then on with --follow",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name: "data-url",
+				},
+				cli.StringFlag{
+					Name:  "target",
+					Usage: "directory, file:///path or s3://bucket/prefix?endpoint=...&region=..., the archive is itself a --data-url taking ?rev= or ?at=",
+				},
+				cli.BoolFlag{
+					Name:  "follow",
+					Usage: "keep archiving revisions as they are saved",
+				},
+			},
+			Action: func(c *cli.Context) error {
+
+				if c.String("target") == "" {
+					return errors.New("a target is required")
 				}
 
-				result, err := gh.SyncTeams(orgChart, c.Bool("skip-members"))
+				store, _, err := openSnapshotStore(c.String("target"))
 
 				if err != nil {
-					return errors.Wrap(err, "syncing teams")
+					return err
 				}
 
-				for _, team := range result.createdTeams {
-					logrus.Infof("created %s in github", team.GetName())
+				manifest, err := loadSnapshotManifest(store)
+
+				if err != nil {
+					return errors.Wrap(err, "reading manifest")
 				}
 
-				for _, team := range result.reparentedTeams {
-					logrus.Infof("reparented %s in github", team.GetName())
+				archiver := &chartArchiver{
+					location: c.String("data-url"),
+					store:    store,
+					manifest: manifest,
 				}
 
-				for _, team := range result.removedTeams {
-					logrus.Infof("removed %s from github", team.GetName())
+				if c.Bool("follow") {
+					return archiver.follow()
 				}
 
-				for _, employee := range result.unableToCreateMembership {
-					logrus.Infof("unable to add member %s to %s team, github handle not provided", employee.Name, employee.MemberOf)
+				return archiver.archiveAvailable("")
+			},
+		},
+		{
+			Name:  "validate",
+			Usage: "report problems in the org chart data",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name: "data-url",
+				},
+			},
+			Action: func(c *cli.Context) error {
+
+				orgChart, err := loadOrgChartData(c.String("data-url"))
+
+				if err != nil {
+					return errors.Wrap(err, "retrieving org chart data")
 				}
 
-				for _, employee := range result.unableToCreateMaintainer {
-					logrus.Infof("unable to add maintainer %s to %s team, github handle not provided", employee.Name, employee.MemberOf)
+				if len(orgChart.validationErrors) > 0 {
+					return errors.Errorf("org chart has %d problems", len(orgChart.validationErrors))
 				}
 
-				return nil
+				logrus.Info("org chart is valid")
 
+				return nil
 			},
 		},
 	}
@@ -547,12 +1816,17 @@ func main() {
 type Employee struct {
 	ID        string
 	Name      string
+	Title     string
+	Number    string
 	Github    string
 	MemberOf  string
 	Team      *Team
 	Stream    string
 	Type      string
 	ReportsTo string
+	Email     string
+	// Slack is the slack user id or name of the employee, when it can't be found by email
+	Slack string
 }
 
 type EmployeeExport struct {
@@ -565,16 +1839,24 @@ type EmployeeExport struct {
 }
 
 type Team struct {
-	ID             string
-	Name           string
-	ParentID       string `json:"parent"`
-	Description    string
-	Github         string
-	ParentGithubID string
-	TeachLeadID    string `json:"techLead"`
-	ProductLeadID  string `json:"productLead"`
-	Vacancies      map[string]int
-	Backfills      map[string]int
+	ID            string
+	Name          string
+	Kind          string
+	ParentID      string `json:"parent"`
+	Description   string
+	Github        string
+	GithubPrivacy string `json:"githubPrivacy"`
+	// GithubMembership is one of direct, rolled-up or leads-only
+	GithubMembership string `json:"githubMembership"`
+	ParentGithubID   string
+	Repositories     map[string]string `json:"repositories"`
+	TeachLeadID      string            `json:"techLead"`
+	ProductLeadID    string            `json:"productLead"`
+	Vacancies        map[string]int
+	Backfills        map[string]int
+	// GithubTeamIDs are the github teams backing the team by organisation, recorded by
+	// gh-sync --annotate-chart so that the team keeps its github team when its id changes
+	GithubTeamIDs map[string]int64 `json:"githubTeamIds"`
 }
 
 type TeamExport struct {
@@ -595,6 +1877,18 @@ type OrgChart struct {
 	Teams         []*Team
 	TeamsByID     map[string]*Team
 	EmployeesByID map[string]*Employee
+
+	Rev string `json:"_rev"`
+	// UpdatedAt is when the chart was saved by the clock of whoever saved it, the browser for
+	// the admin UI, revisions saved before it was kept don't have it
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	// childTeams indexes teams under the id of their parent, top level teams under ""
+	childTeams map[string][]*Team
+	// teamEmployees indexes employees under the id of the team they are a member of
+	teamEmployees map[string][]*Employee
+
+	validationErrors []error
 }
 
 func (oc *OrgChart) vacanciesExports() []*VacancyExport {
@@ -700,42 +1994,53 @@ func (oc *OrgChart) productLead(t *Team) *Employee {
 	return oc.productLead(oc.TeamsByID[t.ParentID])
 }
 
-func (oc *OrgChart) reportingLine(e *Employee) string {
+// manager resolves who an employee reports to, their explicit reportsTo or else the tech or
+// product lead of their team depending on their stream. Leads report to the lead of the
+// parent team.
+func (oc *OrgChart) manager(e *Employee) *Employee {
 
-	var lead string
+	if e.ID == ROOT_EMPLOYEE {
+		return nil
+	}
 
 	if e.ReportsTo != "" {
-		lead = e.ReportsTo
+		return oc.EmployeesByID[e.ReportsTo]
 	}
 
-	if e.ID == ROOT_EMPLOYEE {
-		return ""
+	lead, leadID := oc.productLead, e.Team.ProductLeadID
+
+	if e.Stream == "ENGINEERING" || e.Stream == "OPERATIONS" {
+		lead, leadID = oc.techLead, e.Team.TeachLeadID
 	}
 
-	if lead == "" {
+	if e.ID != leadID {
+		return lead(e.Team)
+	}
 
-		if e.Stream == "ENGINEERING" || e.Stream == "OPERATIONS" {
-			if e.ID == e.Team.TeachLeadID {
-				lead = oc.techLead(oc.TeamsByID[e.Team.ParentID]).ID
-			} else {
-				lead = oc.techLead(e.Team).ID
-			}
-		} else {
-			if e.ID == e.Team.ProductLeadID {
-				lead = oc.productLead(oc.TeamsByID[e.Team.ParentID]).ID
-			} else {
-				lead = oc.productLead(e.Team).ID
-			}
-		}
+	parent, ok := oc.TeamsByID[e.Team.ParentID]
+
+	if !ok {
+		return oc.EmployeesByID[ROOT_EMPLOYEE]
+	}
+
+	return lead(parent)
+}
+
+func (oc *OrgChart) reportingLine(e *Employee) string {
+
+	lead := oc.manager(e)
+
+	if lead == nil {
+		return ""
 	}
 
-	upline := oc.reportingLine(oc.EmployeesByID[lead])
+	upline := oc.reportingLine(lead)
 
 	if upline == "" {
-		return lead
+		return lead.ID
 	}
 
-	return fmt.Sprintf("%s::%s", upline, lead)
+	return fmt.Sprintf("%s::%s", upline, lead.ID)
 
 }
 
@@ -760,19 +2065,57 @@ func (oc *OrgChart) teamAncestryString(t *Team, includeCurrent bool) string {
 	return strings.Join(path, "::")
 }
 
+// assignGithubTeams derives the github team slug of every team from its id
+func (oc *OrgChart) assignGithubTeams(prefix string) {
+	for _, t := range oc.Teams {
+		t.Github = githubTeamSlug(prefix, t.ID)
+		if t.ParentID != "" {
+			t.ParentGithubID = githubTeamSlug(prefix, t.ParentID)
+		}
+	}
+}
+
+func githubTeamSlug(prefix, teamID string) string {
+	return fmt.Sprintf("%s%s", prefix, strings.Replace(teamID, "_", "-", -1))
+}
+
 func (oc *OrgChart) organise() error {
 
 	oc.TeamsByID = make(map[string]*Team)
 	oc.EmployeesByID = make(map[string]*Employee)
+	oc.childTeams = make(map[string][]*Team)
+	oc.teamEmployees = make(map[string][]*Employee)
 
 	for _, t := range oc.Teams {
 		oc.TeamsByID[t.ID] = t
+		oc.childTeams[t.ParentID] = append(oc.childTeams[t.ParentID], t)
+
+		if t.GithubPrivacy != "" && !validGithubPrivacy(t.GithubPrivacy) {
+			oc.validationErrors = append(oc.validationErrors, errors.Errorf("team %s has invalid github privacy %q, expected secret or closed", t.ID, t.GithubPrivacy))
+			t.GithubPrivacy = ""
+		}
+
+		if t.GithubMembership != "" && !validMembershipStrategy(t.GithubMembership) {
+			oc.validationErrors = append(oc.validationErrors, errors.Errorf("team %s has invalid github membership %q, expected direct, rolled-up or leads-only", t.ID, t.GithubMembership))
+		}
+
+		oc.validationErrors = append(oc.validationErrors, repositoryErrors(t)...)
 	}
 
 	for _, e := range oc.Employees {
 
 		oc.EmployeesByID[e.ID] = e
 
+		if e.Github != "" {
+			handle, err := normaliseGithubHandle(e.Github)
+
+			if err != nil {
+				oc.validationErrors = append(oc.validationErrors, errors.Wrapf(err, "employee %s", e.ID))
+			}
+
+			e.Github = handle
+		}
+
 		team, ok := oc.TeamsByID[e.MemberOf]
 
 		if !ok {
@@ -780,12 +2123,58 @@ func (oc *OrgChart) organise() error {
 		}
 
 		e.Team = team
+		oc.teamEmployees[team.ID] = append(oc.teamEmployees[team.ID], e)
+	}
+
+	for _, t := range oc.Teams {
+		seen := map[string]bool{t.ID: true}
+
+		for parent := oc.TeamsByID[t.ParentID]; parent != nil; parent = oc.TeamsByID[parent.ParentID] {
+			if seen[parent.ID] {
+				return errors.Errorf("team %s is nested under itself", parent.ID)
+			}
+			seen[parent.ID] = true
+		}
 	}
 
 	return nil
 
 }
 
+// normaliseGithubHandle turns a handle as typed in the admin UI, possibly prefixed with @
+// or given as a profile URL, into a lower case github login. Handles which are not valid
+// logins normalise to an empty handle.
+func normaliseGithubHandle(handle string) (string, error) {
+	login := strings.TrimSpace(handle)
+
+	for _, prefix := range []string{"https://", "http://", "www.", "github.com/"} {
+		if len(login) >= len(prefix) && strings.EqualFold(login[:len(prefix)], prefix) {
+			login = login[len(prefix):]
+		}
+	}
+
+	login = strings.TrimPrefix(strings.TrimSuffix(login, "/"), "@")
+	login = strings.ToLower(login)
+
+	if login == "" || len(login) > 39 || strings.HasPrefix(login, "-") {
+		return "", errors.Errorf("invalid github handle %q", handle)
+	}
+
+	for _, r := range login {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-') {
+			return "", errors.Errorf("invalid github handle %q", handle)
+		}
+	}
+
+	return login, nil
+}
+
+// normalisedLogin allows github logins, which are case insensitive, to be compared with
+// normalised org chart handles
+func normalisedLogin(login string) string {
+	return strings.ToLower(login)
+}
+
 func employeesNotInGithub(orgchart *OrgChart, gh *GithubState) []*Employee {
 
 	notInGithub := []*Employee{}
@@ -795,16 +2184,7 @@ func employeesNotInGithub(orgchart *OrgChart, gh *GithubState) []*Employee {
 			continue
 		}
 
-		found := false
-
-		for _, ghMember := range gh.members {
-			if employee.Github == ghMember.GetLogin() {
-				found = true
-				break
-			}
-		}
-
-		if !found {
+		if _, ok := gh.members[employee.Github]; !ok {
 			notInGithub = append(notInGithub, employee)
 		}
 	}
@@ -815,19 +2195,22 @@ func employeesNotInGithub(orgchart *OrgChart, gh *GithubState) []*Employee {
 func githubMembersNotInOrgchart(orgchart *OrgChart, gh *GithubState) []*github.User {
 	notInOrgchart := []*github.User{}
 
-	for _, ghMember := range gh.members {
-		found := false
-		for _, employee := range orgchart.Employees {
-			if employee.Github == ghMember.GetLogin() {
-				found = true
-				break
-			}
-		}
-		if !found {
+	handles := make(map[string]bool, len(orgchart.Employees))
+
+	for _, employee := range orgchart.Employees {
+		handles[employee.Github] = true
+	}
+
+	for login, ghMember := range gh.members {
+		if !handles[login] {
 			notInOrgchart = append(notInOrgchart, ghMember)
 		}
 	}
 
+	sort.Slice(notInOrgchart, func(i, j int) bool {
+		return notInOrgchart[i].GetLogin() < notInOrgchart[j].GetLogin()
+	})
+
 	return notInOrgchart
 }
 
@@ -836,17 +2219,7 @@ func teamsNotInGithub(orgchart *OrgChart, gh *GithubState) []*Team {
 	notInGithub := []*Team{}
 
 	for _, team := range orgchart.Teams {
-
-		found := false
-
-		for _, ghTeam := range gh.teams {
-			if team.Github == ghTeam.GetName() {
-				found = true
-				break
-			}
-		}
-
-		if !found {
+		if _, ok := gh.teams[team.Github]; !ok {
 			notInGithub = append(notInGithub, team)
 		}
 	}
@@ -858,19 +2231,26 @@ func teamsNotInGithub(orgchart *OrgChart, gh *GithubState) []*Team {
 func githubTeamsNotInOrgchart(orgchart *OrgChart, gh *GithubState) []*github.Team {
 	notInOrgchart := []*github.Team{}
 
-	for _, ghTeam := range gh.teams {
-		found := false
-		for _, team := range orgchart.Teams {
-			if team.Github == ghTeam.GetName() {
-				found = true
-				break
-			}
-		}
-		if !found {
+	slugs := make(map[string]bool, len(orgchart.Teams))
+
+	for _, team := range orgchart.Teams {
+		slugs[team.Github] = true
+	}
+
+	if gh.memberFilter != nil && gh.memberFilter.ExcludedTeam != "" {
+		slugs[gh.memberFilter.ExcludedTeam] = true
+	}
+
+	for slug, ghTeam := range gh.teams {
+		if !slugs[slug] {
 			notInOrgchart = append(notInOrgchart, ghTeam)
 		}
 	}
 
+	sort.Slice(notInOrgchart, func(i, j int) bool {
+		return notInOrgchart[i].GetSlug() < notInOrgchart[j].GetSlug()
+	})
+
 	return notInOrgchart
 }
 
@@ -883,7 +2263,7 @@ func newGithubState(token, organisation, teamPrefix string) (*GithubState, error
 		teamPrefix:   teamPrefix,
 		client:       client,
 		teams:        make(map[string]*github.Team),
-		members:      []*github.User{},
+		members:      make(map[string]*github.User),
 	}
 
 	ctx := context.Background()
@@ -918,7 +2298,7 @@ func newGithubState(token, organisation, teamPrefix string) (*GithubState, error
 		}
 
 		for _, t := range teams {
-			if strings.HasPrefix(t.GetName(), teamPrefix) {
+			if strings.HasPrefix(t.GetSlug(), teamPrefix) {
 				gh.AddTeam(t)
 			}
 		}
@@ -937,41 +2317,75 @@ type githubSyncResult struct {
 	removedTeams             []*github.Team
 	createdTeams             []*github.Team
 	reparentedTeams          []*github.Team
+	editedTeams              []*githubTeamEdit
+	membershipAdditions      []*githubMembershipChange
+	membershipRemovals       []*githubMembershipChange
+	roleChanges              []*githubRoleChange
 	unableToCreateMembership []*Employee
 	unableToCreateMaintainer []*Employee
 }
 
+// githubTeamEdit lists the attributes changed on a pre-existing github team
+type githubTeamEdit struct {
+	team    *github.Team
+	changes []githubTeamAttributeChange
+}
+
+type githubTeamAttributeChange struct {
+	attribute string
+	from      string
+	to        string
+}
+
 type GithubState struct {
-	organisation string
-	teamPrefix   string
-	client       *github.Client
-	teams        map[string]*github.Team
-	members      []*github.User
-	syncResult   *githubSyncResult
-	dry          bool
-	orgTeams     []*Team
+	organisation   string
+	teamPrefix     string
+	defaultPrivacy string
+	client         *github.Client
+	teams          map[string]*github.Team
+	members        map[string]*github.User
+	invitations    map[string]*github.Invitation
+	syncResult     *githubSyncResult
+	dry            bool
+	orgTeams       map[string]*Team
+	// reconciledTeams are the org teams already created or edited in github this run
+	reconciledTeams map[string]bool
+	// createdTeams are the ids of the github teams created this run
+	createdTeams map[int64]bool
+
+	maxTeamRemovals           int
+	memberFilter              *githubMemberFilter
+	membershipStrategyDefault string
+	maintainerRoles           bool
+
+	failedInvitations []*githubFailedInvitation
 }
 
+// AddTeam registers a github team under its slug, which is what org teams are matched on
 func (gh *GithubState) AddTeam(team *github.Team) {
-	gh.teams[team.GetName()] = team
+	gh.teams[team.GetSlug()] = team
 }
 
-func (gh *GithubState) AddMembers(member ...*github.User) {
-	gh.members = append(gh.members, member...)
+// AddMembers registers organisation members under their normalised login
+func (gh *GithubState) AddMembers(members ...*github.User) {
+	for _, member := range members {
+		gh.members[normalisedLogin(member.GetLogin())] = member
+	}
 }
 
 func (gh *GithubState) createTeamByIDIfNotExists(teamID string) (*github.Team, error) {
 
-	var teamToCreate *Team
+	teamToCreate, ok := gh.orgTeams[teamID]
 
-	for _, team := range gh.orgTeams {
-		if team.ID == teamID {
-			teamToCreate = team
-		}
+	if !ok {
+		return nil, errors.Errorf("could not find org team %s for creation", teamID)
 	}
 
-	if teamToCreate == nil {
-		return nil, errors.Errorf("could not find org team %s for creation", teamID)
+	// parents are reached again through every one of their descendants
+	if gh.reconciledTeams[teamID] {
+		if team, ok := gh.teams[teamToCreate.Github]; ok {
+			return team, nil
+		}
 	}
 
 	var parentID *int64
@@ -986,44 +2400,82 @@ func (gh *GithubState) createTeamByIDIfNotExists(teamID string) (*github.Team, e
 		parentID = parentTeam.ID
 	}
 
-	privacy := "closed"
+	privacy := gh.teamPrivacy(teamToCreate)
+	name := gh.teamDisplayName(teamToCreate)
 
 	ctx := context.Background()
 
 	if preExistingTeam, ok := gh.teams[teamToCreate.Github]; ok {
-		if parentTeam := preExistingTeam.GetParent(); parentTeam != nil {
-			if parentTeam.GetName() != teamToCreate.ParentGithubID {
 
-				//logrus.Println("team considered: ", teamToCreate.Github, "github parent", parentTeam.GetName(), "defined parent", teamToCreate.ParentGithubID)
+		changes := []githubTeamAttributeChange{}
+		reparented := false
 
-				var editedTeam *github.Team
+		if preExistingTeam.GetName() != name {
+			changes = append(changes, githubTeamAttributeChange{"name", preExistingTeam.GetName(), name})
+		}
 
-				if !gh.dry {
+		if preExistingTeam.GetDescription() != teamToCreate.Description {
+			changes = append(changes, githubTeamAttributeChange{"description", preExistingTeam.GetDescription(), teamToCreate.Description})
+		}
 
-					var err error
+		if preExistingTeam.GetPrivacy() != privacy {
+			changes = append(changes, githubTeamAttributeChange{"privacy", preExistingTeam.GetPrivacy(), privacy})
+		}
 
-					editedTeam, _, err = gh.client.Teams.EditTeam(ctx, preExistingTeam.GetID(), github.NewTeam{
-						Name:         teamToCreate.Github,
-						Description:  &teamToCreate.Description,
-						ParentTeamID: parentID,
-						Privacy:      &privacy,
-					})
+		// parents are reconciled before their children, so by now the new parent is never a
+		// descendant of the team in github
+		currentParent := preExistingTeam.GetParent()
 
-					if err != nil {
-						return nil, errors.Wrap(err, "editing team")
-					}
+		if (currentParent == nil) != (parentID == nil) || (currentParent != nil && currentParent.GetID() != *parentID) {
+			changes = append(changes, githubTeamAttributeChange{"parent", currentParent.GetSlug(), teamToCreate.ParentGithubID})
+			reparented = true
+		}
 
-				} else {
-					editedTeam = preExistingTeam
-				}
+		gh.reconciledTeams[teamID] = true
+
+		if len(changes) == 0 {
+			return preExistingTeam, nil
+		}
+
+		var editedTeam *github.Team
+
+		if !gh.dry {
 
-				gh.syncResult.reparentedTeams = append(gh.syncResult.reparentedTeams, editedTeam)
+			var err error
 
-				gh.teams[editedTeam.GetName()] = editedTeam
+			editedTeam, err = gh.editTeam(preExistingTeam, &githubTeamEditRequest{
+				Name:         name,
+				Description:  &teamToCreate.Description,
+				ParentTeamID: parentID,
+				Privacy:      &privacy,
+			})
 
+			if err != nil {
+				return nil, errors.Wrap(err, "editing team")
 			}
+
+		} else {
+			// what the team would look like once edited, so the edit isn't planned twice
+			team := *preExistingTeam
+			team.Name = &name
+			team.Description = &teamToCreate.Description
+			team.Privacy = &privacy
+			team.Parent = parentTeam
+			editedTeam = &team
+		}
+
+		if reparented {
+			gh.syncResult.reparentedTeams = append(gh.syncResult.reparentedTeams, editedTeam)
 		}
-		return preExistingTeam, nil
+
+		gh.syncResult.editedTeams = append(gh.syncResult.editedTeams, &githubTeamEdit{
+			team:    editedTeam,
+			changes: changes,
+		})
+
+		gh.teams[teamToCreate.Github] = editedTeam
+
+		return editedTeam, nil
 	}
 
 	var createdTeam *github.Team
@@ -1034,7 +2486,8 @@ func (gh *GithubState) createTeamByIDIfNotExists(teamID string) (*github.Team, e
 
 		createdTeam = &github.Team{
 			ID:          &id,
-			Name:        &teamToCreate.Github,
+			Name:        &name,
+			Slug:        &teamToCreate.Github,
 			Description: &teamToCreate.Description,
 			Privacy:     &privacy,
 			Parent:      parentTeam,
@@ -1044,7 +2497,7 @@ func (gh *GithubState) createTeamByIDIfNotExists(teamID string) (*github.Team, e
 		var err error
 
 		createdTeam, _, err = gh.client.Teams.CreateTeam(ctx, gh.organisation, github.NewTeam{
-			Name:         teamToCreate.Github,
+			Name:         name,
 			Description:  &teamToCreate.Description,
 			ParentTeamID: parentID,
 			Privacy:      &privacy,
@@ -1056,12 +2509,105 @@ func (gh *GithubState) createTeamByIDIfNotExists(teamID string) (*github.Team, e
 	}
 
 	gh.syncResult.createdTeams = append(gh.syncResult.createdTeams, createdTeam)
-	gh.teams[createdTeam.GetName()] = createdTeam
+	gh.createdTeams[createdTeam.GetID()] = true
+	gh.teams[teamToCreate.Github] = createdTeam
+	gh.reconciledTeams[teamID] = true
 
 	return createdTeam, nil
 
 }
 
+// githubTeamEditRequest mirrors github.NewTeam but always sends the parent, a null parent
+// moving the team to the top level
+type githubTeamEditRequest struct {
+	Name         string  `json:"name"`
+	Description  *string `json:"description,omitempty"`
+	Privacy      *string `json:"privacy,omitempty"`
+	ParentTeamID *int64  `json:"parent_team_id"`
+}
+
+func (gh *GithubState) editTeam(team *github.Team, edit *githubTeamEditRequest) (*github.Team, error) {
+
+	req, err := gh.client.NewRequest("PATCH", fmt.Sprintf("teams/%v", team.GetID()), edit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// nested teams are still a preview feature of the api
+	req.Header.Set("Accept", "application/vnd.github.hellcat-preview+json")
+
+	editedTeam := &github.Team{}
+
+	if _, err := gh.client.Do(context.Background(), req, editedTeam); err != nil {
+		return nil, err
+	}
+
+	return editedTeam, nil
+}
+
+func validGithubPrivacy(privacy string) bool {
+	return privacy == "secret" || privacy == "closed"
+}
+
+// teamPrivacy resolves the github privacy of an org team, nested teams can only be closed
+func (gh *GithubState) teamPrivacy(t *Team) string {
+	privacy := gh.defaultPrivacy
+
+	if t.GithubPrivacy != "" {
+		privacy = t.GithubPrivacy
+	}
+
+	if privacy == "" {
+		privacy = "closed"
+	}
+
+	if privacy == "secret" && t.ParentID != "" {
+		logrus.Warnf("team %s is nested and cannot be secret in github, using closed", t.ID)
+		privacy = "closed"
+	}
+
+	return privacy
+}
+
+// teamDisplayName derives the github team name from the org team name. Github regenerates
+// the slug when a team is renamed, so the display name is only used when it keeps the slug.
+func (gh *GithubState) teamDisplayName(t *Team) string {
+	candidates := []string{
+		gh.teamPrefix + t.Name,
+		gh.teamPrefix + t.Name + " " + strings.ToLower(t.Kind),
+	}
+
+	for _, name := range candidates {
+		if githubSlug(name) == t.Github {
+			return name
+		}
+	}
+
+	return t.Github
+}
+
+// githubSlug mimics how github derives a team slug from its name
+func githubSlug(name string) string {
+	slug := strings.Builder{}
+	dash := false
+
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			slug.WriteRune(r)
+			dash = false
+			continue
+		}
+
+		if !dash && slug.Len() > 0 {
+			slug.WriteRune('-')
+			dash = true
+		}
+	}
+
+	return strings.TrimSuffix(slug.String(), "-")
+}
+
 func (gh *GithubState) removeTeam(team *github.Team) error {
 
 	if !gh.dry {
@@ -1069,14 +2615,14 @@ func (gh *GithubState) removeTeam(team *github.Team) error {
 		_, err := gh.client.Teams.DeleteTeam(context.Background(), team.GetID())
 
 		if err != nil {
-			return nil
+			return errors.Wrapf(err, "deleting team %s", team.GetSlug())
 		}
 
 	}
 
 	gh.syncResult.removedTeams = append(gh.syncResult.removedTeams, team)
 
-	delete(gh.teams, team.GetName())
+	delete(gh.teams, team.GetSlug())
 
 	return nil
 }
@@ -1086,31 +2632,107 @@ type teamMembershipSync struct {
 	Members     []string
 }
 
+const (
+	membershipDirect    = "direct"
+	membershipRolledUp  = "rolled-up"
+	membershipLeadsOnly = "leads-only"
+)
+
+func validMembershipStrategy(strategy string) bool {
+	return strategy == membershipDirect || strategy == membershipRolledUp || strategy == membershipLeadsOnly
+}
+
+// membershipStrategy resolves how the members of an org team are projected onto its github team
+func (gh *GithubState) membershipStrategy(t *Team) string {
+	if t.GithubMembership != "" {
+		return t.GithubMembership
+	}
+
+	if gh.membershipStrategyDefault != "" {
+		return gh.membershipStrategyDefault
+	}
+
+	return membershipDirect
+}
+
+// subtree returns a team followed by all of its descendants
+func (oc *OrgChart) subtree(t *Team) []*Team {
+	teams := []*Team{t}
+
+	for i := 0; i < len(teams); i++ {
+		teams = append(teams, oc.childTeams[teams[i].ID]...)
+	}
+
+	return teams
+}
+
+// leads returns the tech and product leads of a team
+func (oc *OrgChart) leads(t *Team) ([]*Employee, error) {
+	leads := []*Employee{}
+
+	if t.TeachLeadID != "" {
+		techLead, ok := oc.EmployeesByID[t.TeachLeadID]
+
+		if !ok {
+			return nil, errors.Errorf("could not find tech lead %s for team %s", t.TeachLeadID, t.Name)
+		}
+
+		leads = append(leads, techLead)
+	}
+
+	if t.ProductLeadID != "" {
+		productLead, ok := oc.EmployeesByID[t.ProductLeadID]
+
+		if !ok {
+			return nil, errors.Errorf("could not find product lead %s for team %s", t.ProductLeadID, t.Name)
+		}
+
+		leads = append(leads, productLead)
+	}
+
+	return leads, nil
+}
+
 func teamMembersSyncData(chart *OrgChart, gh *GithubState) (map[*github.Team]*teamMembershipSync, error) {
 
 	memberSync := map[*github.Team]*teamMembershipSync{}
 
+	employeesByTeam := map[string][]*Employee{}
+
+	var excludedMembership *teamMembershipSync
+
+	if excluded := gh.memberFilter.excludedTeam(gh.teamPrefix); excluded != nil {
+		team, ok := gh.teams[excluded.Github]
+
+		if !ok {
+			return nil, errors.Errorf("team %s not found in github", excluded.Github)
+		}
+
+		excludedMembership = &teamMembershipSync{
+			Maintainers: []string{},
+			Members:     []string{},
+		}
+
+		memberSync[team] = excludedMembership
+	}
+
 	for _, e := range chart.Employees {
 
-		if e.Github == "" {
-			gh.syncResult.unableToCreateMembership = append(gh.syncResult.unableToCreateMembership, e)
+		if !gh.memberFilter.synced(e) {
 			continue
 		}
 
-		team, ok := gh.teams[e.Team.Github]
-
-		if !ok {
-			return nil, errors.Errorf("team %s not found in github", e.Team.Github)
+		if e.Github == "" {
+			gh.syncResult.unableToCreateMembership = append(gh.syncResult.unableToCreateMembership, e)
+			continue
 		}
 
-		if _, ok := memberSync[team]; !ok {
-			memberSync[team] = &teamMembershipSync{
-				Maintainers: []string{},
-				Members:     []string{},
-			}
+		if !gh.memberFilter.inOwnTeam(e) {
+			excludedMembership.Members = append(excludedMembership.Members, e.Github)
+			continue
 		}
 
-		memberSync[team].Members = append(memberSync[team].Members, e.Github)
+		employeesByTeam[e.Team.ID] = append(employeesByTeam[e.Team.ID], e)
 	}
 
 	for _, t := range chart.Teams {
@@ -1121,41 +2743,62 @@ func teamMembersSyncData(chart *OrgChart, gh *GithubState) (map[*github.Team]*te
 			return nil, errors.Errorf("team %s not found in github", t.Github)
 		}
 
-		if _, ok := memberSync[team]; !ok {
-			memberSync[team] = &teamMembershipSync{
-				Maintainers: []string{},
-				Members:     []string{},
-			}
+		membership := &teamMembershipSync{
+			Maintainers: []string{},
+			Members:     []string{},
 		}
 
-		if t.TeachLeadID != "" {
-			techLead, ok := chart.EmployeesByID[t.TeachLeadID]
+		memberSync[team] = membership
+
+		leads, err := chart.leads(t)
+
+		if err != nil {
+			return nil, err
+		}
 
-			if !ok {
-				return nil, errors.Errorf("could not find tech lead %s for team %s", t.TeachLeadID, t.Name)
+		for _, lead := range leads {
+			if !gh.memberFilter.inOwnTeam(lead) {
+				continue
 			}
 
-			if techLead.Github == "" {
-				gh.syncResult.unableToCreateMaintainer = append(gh.syncResult.unableToCreateMaintainer, techLead)
+			if lead.Github == "" {
+				gh.syncResult.unableToCreateMaintainer = append(gh.syncResult.unableToCreateMaintainer, lead)
 				continue
 			}
 
-			memberSync[team].Maintainers = append(memberSync[team].Maintainers, techLead.Github)
+			membership.Maintainers = append(membership.Maintainers, lead.Github)
 		}
 
-		if t.ProductLeadID != "" {
-			productLead, ok := chart.EmployeesByID[t.ProductLeadID]
-
-			if !ok {
-				return nil, errors.Errorf("could not find product lead %s for team %s", t.TeachLeadID, t.Name)
+		switch strategy := gh.membershipStrategy(t); strategy {
+		case membershipDirect:
+			for _, e := range employeesByTeam[t.ID] {
+				membership.Members = append(membership.Members, e.Github)
 			}
+		case membershipRolledUp:
+			for _, descendant := range chart.subtree(t) {
+				for _, e := range employeesByTeam[descendant.ID] {
+					membership.Members = append(membership.Members, e.Github)
+				}
 
-			if productLead.Github == "" {
-				gh.syncResult.unableToCreateMaintainer = append(gh.syncResult.unableToCreateMaintainer, productLead)
-				continue
-			}
+				if descendant == t {
+					continue
+				}
+
+				descendantLeads, err := chart.leads(descendant)
+
+				if err != nil {
+					return nil, err
+				}
 
-			memberSync[team].Maintainers = append(memberSync[team].Maintainers, productLead.Github)
+				for _, lead := range descendantLeads {
+					if lead.Github != "" && gh.memberFilter.inOwnTeam(lead) {
+						membership.Members = append(membership.Members, lead.Github)
+					}
+				}
+			}
+		case membershipLeadsOnly:
+		default:
+			return nil, errors.Errorf("invalid membership strategy %s for team %s", strategy, t.ID)
 		}
 	}
 
@@ -1165,20 +2808,39 @@ func teamMembersSyncData(chart *OrgChart, gh *GithubState) (map[*github.Team]*te
 
 func (gh *GithubState) SyncTeams(chart *OrgChart, skipMembers bool) (*githubSyncResult, error) {
 
-	gh.orgTeams = chart.Teams
+	gh.orgTeams = chart.TeamsByID
+	gh.reconciledTeams = map[string]bool{}
+	gh.createdTeams = map[int64]bool{}
 
 	gh.syncResult = &githubSyncResult{
-		[]*github.Team{},
-		[]*github.Team{},
-		[]*github.Team{},
-		[]*Employee{},
-		[]*Employee{},
+		removedTeams:             []*github.Team{},
+		createdTeams:             []*github.Team{},
+		reparentedTeams:          []*github.Team{},
+		editedTeams:              []*githubTeamEdit{},
+		membershipAdditions:      []*githubMembershipChange{},
+		membershipRemovals:       []*githubMembershipChange{},
+		roleChanges:              []*githubRoleChange{},
+		unableToCreateMembership: []*Employee{},
+		unableToCreateMaintainer: []*Employee{},
 	}
 
-	for _, teamToRemove := range githubTeamsNotInOrgchart(chart, gh) {
-		err := gh.removeTeam(teamToRemove)
+	teamsToRemove := githubTeamsNotInOrgchart(chart, gh)
 
-		if err != nil {
+	if err := checkRemovalThreshold("github teams", len(teamsToRemove), gh.maxTeamRemovals); err != nil {
+		if !gh.dry {
+			return gh.syncResult, err
+		}
+		logrus.Warn(err)
+	}
+
+	if excluded := gh.memberFilter.excludedTeam(gh.teamPrefix); excluded != nil {
+		gh.orgTeams = map[string]*Team{excluded.ID: excluded}
+
+		for id, t := range chart.TeamsByID {
+			gh.orgTeams[id] = t
+		}
+
+		if _, err := gh.createTeamByIDIfNotExists(excluded.ID); err != nil {
 			return gh.syncResult, err
 		}
 	}
@@ -1192,6 +2854,16 @@ func (gh *GithubState) SyncTeams(chart *OrgChart, skipMembers bool) (*githubSync
 		}
 	}
 
+	// deleting a team in github deletes its child teams too, so teams are only removed once
+	// the ones staying have been moved out from under them
+	for _, teamToRemove := range teamsToRemove {
+		err := gh.removeTeam(teamToRemove)
+
+		if err != nil {
+			return gh.syncResult, err
+		}
+	}
+
 	syncData, err := teamMembersSyncData(chart, gh)
 
 	if err != nil {
@@ -1214,11 +2886,12 @@ func (gh *GithubState) SyncTeams(chart *OrgChart, skipMembers bool) (*githubSync
 
 }
 
-func (gh *GithubState) getTeamMembers(team *github.Team) ([]*github.User, error) {
+func (gh *GithubState) getTeamMembers(team *github.Team, role string) ([]*github.User, error) {
 
 	ctx := context.Background()
 
 	memberOpt := &github.TeamListTeamMembersOptions{
+		Role:        role,
 		ListOptions: github.ListOptions{PerPage: 500},
 	}
 
@@ -1309,47 +2982,133 @@ func (gh *GithubState) removeAllTeamMembers(team *github.Team) error {
 	return nil
 }
 
+// githubMembershipChange is a user added to or removed from a team, with their role when
+// maintainer roles are synced
+type githubMembershipChange struct {
+	team  *github.Team
+	login string
+	role  string
+}
+
+type githubRoleChange struct {
+	team  *github.Team
+	login string
+	from  string
+	to    string
+}
+
 func (gh *GithubState) syncTeamMembers(team *github.Team, memberHandles []string, maintainerHandles []string) error {
 
 	//logrus.Infof("syncing members and maintainers for %s", team.GetName())
 
-	allMembers := append(memberHandles, maintainerHandles...)
+	allMembers := make(map[string]bool, len(memberHandles)+len(maintainerHandles))
 
-	currentMembers, err := gh.getTeamMembers(team)
+	for _, handle := range memberHandles {
+		allMembers[handle] = true
+	}
 
-	if err != nil {
-		return err
+	for _, handle := range maintainerHandles {
+		allMembers[handle] = true
 	}
 
-	membersToAdd := []string{}
-	membersToRemove := []string{}
+	var currentMembers, currentMaintainers []*github.User
+	var pendingInvitations []*github.Invitation
 
-OUTER:
-	for _, ghMember := range currentMembers {
-		for _, member := range allMembers {
-			if ghMember.GetLogin() == member {
-				continue OUTER
+	// teams created during a dry run don't exist in github yet
+	if !gh.dry || !gh.createdTeams[team.GetID()] {
+		var err error
+
+		currentMembers, err = gh.getTeamMembers(team, "all")
+
+		if err != nil {
+			return err
+		}
+
+		if gh.maintainerRoles {
+			currentMaintainers, err = gh.getTeamMembers(team, "maintainer")
+
+			if err != nil {
+				return err
 			}
 		}
-		membersToRemove = append(membersToRemove, ghMember.GetLogin())
+
+		// users invited to the team show up as members once they accept the organisation invitation
+		pendingInvitations, err = gh.getPendingTeamInvitations(team)
+
+		if err != nil {
+			return err
+		}
 	}
 
-OUTER2:
-	for _, member := range allMembers {
+	current := make(map[string]bool, len(currentMembers))
+
+	for _, ghMember := range currentMembers {
+		current[normalisedLogin(ghMember.GetLogin())] = true
+	}
+
+	for _, invitation := range pendingInvitations {
+		if invitation.GetLogin() != "" {
+			current[normalisedLogin(invitation.GetLogin())] = true
+		}
+	}
+
+	// roles are only known when maintainer roles are synced, the role of a pending invitation
+	// can't be told so it is left alone
+	desiredRoles := map[string]string{}
+	currentRoles := map[string]string{}
+
+	if gh.maintainerRoles {
+		for _, handle := range memberHandles {
+			desiredRoles[handle] = "member"
+		}
+
+		for _, handle := range maintainerHandles {
+			desiredRoles[handle] = "maintainer"
+		}
+
 		for _, ghMember := range currentMembers {
-			if ghMember.GetLogin() == member {
-				continue OUTER2
-			}
+			currentRoles[normalisedLogin(ghMember.GetLogin())] = "member"
+		}
+
+		for _, ghMember := range currentMaintainers {
+			currentRoles[normalisedLogin(ghMember.GetLogin())] = "maintainer"
+		}
+	}
+
+	membersToAdd := []string{}
+	membersToRemove := []string{}
+	rolesToChange := []string{}
+
+	for login := range current {
+		if !allMembers[login] {
+			membersToRemove = append(membersToRemove, login)
+		}
+	}
+
+	for login := range allMembers {
+		if !current[login] {
+			membersToAdd = append(membersToAdd, login)
+		}
+	}
+
+	for login, role := range currentRoles {
+		if allMembers[login] && desiredRoles[login] != role {
+			rolesToChange = append(rolesToChange, login)
 		}
-		membersToAdd = append(membersToAdd, member)
 	}
 
+	sort.Strings(membersToRemove)
+	sort.Strings(membersToAdd)
+	sort.Strings(rolesToChange)
+
 	ctx := context.Background()
 
 	for _, user := range membersToRemove {
 
 		logrus.Debugf("removing %s from %s", user, team.GetName())
 
+		gh.syncResult.membershipRemovals = append(gh.syncResult.membershipRemovals, &githubMembershipChange{team, user, currentRoles[user]})
+
 		if gh.dry {
 			continue
 		}
@@ -1366,11 +3125,19 @@ OUTER2:
 
 		logrus.Debugf("adding %s  to %s", user, team.GetName())
 
+		gh.syncResult.membershipAdditions = append(gh.syncResult.membershipAdditions, &githubMembershipChange{team, user, desiredRoles[user]})
+
 		if gh.dry {
 			continue
 		}
 
-		_, _, err := gh.client.Teams.AddTeamMembership(ctx, team.GetID(), user, nil)
+		var opt *github.TeamAddTeamMembershipOptions
+
+		if role := desiredRoles[user]; role != "" {
+			opt = &github.TeamAddTeamMembershipOptions{Role: role}
+		}
+
+		_, _, err := gh.client.Teams.AddTeamMembership(ctx, team.GetID(), user, opt)
 
 		if err != nil {
 			return err
@@ -1378,6 +3145,25 @@ OUTER2:
 
 	}
 
+	for _, user := range rolesToChange {
+
+		logrus.Debugf("changing role of %s in %s to %s", user, team.GetName(), desiredRoles[user])
+
+		gh.syncResult.roleChanges = append(gh.syncResult.roleChanges, &githubRoleChange{team, user, currentRoles[user], desiredRoles[user]})
+
+		if gh.dry {
+			continue
+		}
+
+		_, _, err := gh.client.Teams.AddTeamMembership(ctx, team.GetID(), user, &github.TeamAddTeamMembershipOptions{
+			Role: desiredRoles[user],
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -1393,7 +3179,18 @@ func newGitHubClient(token string) *github.Client {
 	return github.NewClient(tc)
 }
 
+// loadOrgChartData loads the chart from couchdb, or from a snapshot archive
 func loadOrgChartData(location string) (*OrgChart, error) {
+	if isSnapshotLocation(location) {
+		return loadOrgChartSnapshot(location)
+	}
+
+	return loadOrgChartRevision(location, "")
+}
+
+// loadOrgChartRevision loads a past revision of the chart, which couchdb keeps until the
+// database is compacted, or the latest one when rev is empty
+func loadOrgChartRevision(location, rev string) (*OrgChart, error) {
 
 	URL, err := url.Parse(location)
 
@@ -1405,18 +3202,15 @@ func loadOrgChartData(location string) (*OrgChart, error) {
 
 	couchdb := couch.NewClient(URL)
 
-	err = couchdb.Get("chart", &chart)
-
-	if err != nil {
-		return nil, err
+	if rev == "" {
+		err = couchdb.Get("chart", &chart)
+	} else {
+		err = getCouchDocument(couchdb, "chart", url.Values{"rev": []string{rev}}, &chart)
 	}
 
-	err = chart.organise()
-
 	if err != nil {
 		return nil, err
 	}
 
-	return &chart, nil
-
+	return organisedOrgChart(&chart)
 }
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+// sizes of the generated org, about that of ours
+const (
+	benchmarkEmployees   = 1500
+	benchmarkContractors = 300
+)
+
+// generateOrgChart builds a company of tribes and squads, with employees and contractors
+// spread across the squads and the first two members of each squad leading it
+func generateOrgChart(employees, contractors int) *OrgChart {
+
+	chart := &OrgChart{
+		Teams:     []*Team{{ID: "company", Name: "Company", Kind: "Company"}},
+		Employees: []*Employee{},
+	}
+
+	squads := []*Team{}
+
+	for i := 0; i < 12; i++ {
+		tribe := &Team{ID: fmt.Sprintf("tribe_%d", i), Name: fmt.Sprintf("Tribe %d", i), Kind: "Tribe", ParentID: "company"}
+		chart.Teams = append(chart.Teams, tribe)
+
+		for j := 0; j < 10; j++ {
+			squad := &Team{ID: fmt.Sprintf("squad_%d_%d", i, j), Name: fmt.Sprintf("Squad %d %d", i, j), Kind: "Squad", ParentID: tribe.ID}
+			chart.Teams = append(chart.Teams, squad)
+			squads = append(squads, squad)
+		}
+	}
+
+	for i := 0; i < employees+contractors; i++ {
+		e := &Employee{
+			ID:       fmt.Sprintf("employee_%d", i),
+			Name:     fmt.Sprintf("Employee %d", i),
+			Github:   fmt.Sprintf("user-%d", i),
+			MemberOf: squads[i%len(squads)].ID,
+			Stream:   "ENGINEERING",
+			Type:     "EMPLOYEE",
+		}
+
+		if i >= employees {
+			e.Type = "CONTRACTOR"
+		}
+
+		chart.Employees = append(chart.Employees, e)
+	}
+
+	for i, squad := range squads {
+		squad.TeachLeadID = chart.Employees[i].ID
+		squad.ProductLeadID = chart.Employees[i+len(squads)].ID
+	}
+
+	if err := chart.organise(); err != nil {
+		panic(err)
+	}
+
+	chart.assignGithubTeams("org-")
+
+	return chart
+}
+
+// generateGithubState mirrors a chart in an in-memory github organisation, where some
+// employees have no account yet, leavers are still members and logins differ in case
+func generateGithubState(chart *OrgChart) *GithubState {
+
+	gh := &GithubState{
+		organisation:   "example",
+		teamPrefix:     "org-",
+		defaultPrivacy: "closed",
+		teams:          map[string]*github.Team{},
+		members:        map[string]*github.User{},
+		dry:            true,
+	}
+
+	for i, e := range chart.Employees {
+		if i%20 != 0 {
+			gh.AddMembers(&github.User{Login: github.String(strings.ToUpper(e.Github))})
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		gh.AddMembers(&github.User{Login: github.String(fmt.Sprintf("leaver-%d", i))})
+	}
+
+	for i, t := range chart.Teams {
+		id := int64(i + 1)
+
+		gh.AddTeam(&github.Team{
+			ID:          &id,
+			Name:        github.String(gh.teamDisplayName(t)),
+			Slug:        github.String(t.Github),
+			Description: github.String(t.Description),
+			Privacy:     github.String("closed"),
+			Parent:      gh.teams[t.ParentGithubID],
+		})
+	}
+
+	return gh
+}
+
+func (gh *GithubState) resetSyncResult() {
+	gh.reconciledTeams = map[string]bool{}
+	gh.createdTeams = map[int64]bool{}
+	gh.syncResult = &githubSyncResult{}
+}
+
+// fakeGithub serves the users and invitations of an organisation, and the members, pending
+// invitations and repositories of its teams, from memory. Repositories are listed with the
+// access inherited from parent teams, as github does.
+type fakeGithub struct {
+	members     map[int64][]*github.User
+	maintainers map[int64][]*github.User
+	repos       map[int64]map[string]string
+	parents     map[int64]int64
+	users       map[string]*github.User
+	invitations []*github.Invitation
+	failed      []*githubFailedInvitation
+	// refused are the ids of users github refuses to invite, as when out of seats
+	refused map[int64]bool
+	calls   []string
+}
+
+func (f *fakeGithub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var id int64
+	var resource string
+
+	if r.Method != http.MethodGet {
+		f.calls = append(f.calls, r.Method+" "+r.URL.Path)
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/orgs/") || strings.HasPrefix(r.URL.Path, "/users/") {
+		f.serveOrganisation(w, r)
+		return
+	}
+
+	if _, err := fmt.Sscanf(r.URL.Path, "/teams/%d/%s", &id, &resource); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	var body interface{}
+
+	switch {
+	case resource == "members" && r.URL.Query().Get("role") == "maintainer":
+		body = f.maintainers[id]
+	case resource == "members":
+		body = f.members[id]
+	case resource == "invitations":
+		body = []*github.Invitation{}
+	case resource == "repos":
+		if _, ok := f.repos[id]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		body = f.teamRepos(id)
+	case strings.HasPrefix(resource, "repos/") && r.Method == http.MethodPut:
+		var opt github.TeamAddTeamRepoOptions
+
+		if err := json.NewDecoder(r.Body).Decode(&opt); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if f.repos[id] == nil {
+			f.repos[id] = map[string]string{}
+		}
+
+		f.repos[id][path.Base(resource)] = opt.Permission
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case strings.HasPrefix(resource, "repos/") && r.Method == http.MethodDelete:
+		delete(f.repos[id], path.Base(resource))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+func (f *fakeGithub) serveOrganisation(w http.ResponseWriter, r *http.Request) {
+	var body interface{}
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/users/"):
+		user, ok := f.users[strings.TrimPrefix(r.URL.Path, "/users/")]
+
+		if !ok {
+			http.Error(w, `{"message": "Not Found"}`, http.StatusNotFound)
+			return
+		}
+
+		body = user
+	case strings.HasSuffix(r.URL.Path, "/failed_invitations"):
+		body = f.failed
+	case strings.HasSuffix(r.URL.Path, "/invitations") && r.Method == http.MethodPost:
+		var opt github.CreateOrgInvitationOptions
+
+		if err := json.NewDecoder(r.Body).Decode(&opt); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if f.refused[opt.GetInviteeID()] {
+			http.Error(w, `{"message": "You must purchase at least one more seat"}`, http.StatusUnprocessableEntity)
+			return
+		}
+
+		for _, user := range f.users {
+			if user.GetID() == opt.GetInviteeID() {
+				invitation := &github.Invitation{Login: user.Login, Role: opt.Role}
+				f.invitations = append(f.invitations, invitation)
+				body = invitation
+			}
+		}
+	case strings.HasSuffix(r.URL.Path, "/invitations"):
+		body = f.invitations
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// teamRepos lists the repositories of a team with the strongest access it has through
+// itself or its ancestors, every permission up to that one set
+func (f *fakeGithub) teamRepos(id int64) []*github.Repository {
+	access := map[string]string{}
+
+	for team, ok := id, true; ok; team, ok = f.parents[team] {
+		for repo, permission := range f.repos[team] {
+			access[repo] = strongerPermission(access[repo], permission)
+		}
+	}
+
+	repos := []*github.Repository{}
+
+	for name, permission := range access {
+		permissions := map[string]bool{}
+
+		for _, p := range githubRepoPermissions {
+			permissions[p] = true
+
+			if p == permission {
+				break
+			}
+		}
+
+		repos = append(repos, &github.Repository{Name: github.String(name), Permissions: &permissions})
+	}
+
+	return repos
+}
+
+// newFakeGithubClient returns a github client talking to handler, and the server to close
+func newFakeGithubClient(handler http.Handler) (*github.Client, *httptest.Server) {
+	server := httptest.NewServer(handler)
+
+	client := github.NewClient(nil)
+	client.BaseURL, _ = url.Parse(server.URL + "/")
+
+	return client, server
+}
+
+func TestNormaliseGithubHandle(t *testing.T) {
+	for handle, expected := range map[string]string{
+		"octocat":                        "octocat",
+		"OctoCat":                        "octocat",
+		"  octo-cat\t":                   "octo-cat",
+		"@octocat":                       "octocat",
+		"https://github.com/OctoCat":     "octocat",
+		"http://www.github.com/octocat/": "octocat",
+		"github.com/octocat":             "octocat",
+	} {
+		got, err := normaliseGithubHandle(handle)
+
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", handle, err)
+			continue
+		}
+
+		if got != expected {
+			t.Errorf("expected %q to normalise to %s, got %s", handle, expected, got)
+		}
+	}
+
+	for _, handle := range []string{"", "@", "-octocat", "octo cat", "octo_cat", "octocat@example.com", "https://github.com/octocat/repo", strings.Repeat("a", 40)} {
+		if got, err := normaliseGithubHandle(handle); err == nil {
+			t.Errorf("expected %q to be invalid, got %s", handle, got)
+		}
+	}
+}
+
+func TestOrganiseRecordsInvalidGithubHandles(t *testing.T) {
+	chart := &OrgChart{
+		Teams: []*Team{{ID: "squad"}},
+		Employees: []*Employee{
+			{ID: "alice", MemberOf: "squad", Github: "@Alice"},
+			{ID: "bob", MemberOf: "squad", Github: "bob smith"},
+		},
+	}
+
+	if err := chart.organise(); err != nil {
+		t.Fatal(err)
+	}
+
+	if alice := chart.EmployeesByID["alice"]; alice.Github != "alice" {
+		t.Errorf("expected the handle of alice to be normalised, got %s", alice.Github)
+	}
+
+	if bob := chart.EmployeesByID["bob"]; bob.Github != "" {
+		t.Errorf("expected the invalid handle of bob to be dropped, got %s", bob.Github)
+	}
+
+	if len(chart.validationErrors) != 1 || !strings.Contains(chart.validationErrors[0].Error(), "employee bob") {
+		t.Errorf("expected the handle of bob to be a validation error, got %v", chart.validationErrors)
+	}
+}
+
+func BenchmarkEmployeesNotInGithub(b *testing.B) {
+	chart := generateOrgChart(benchmarkEmployees, benchmarkContractors)
+	gh := generateGithubState(chart)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if len(employeesNotInGithub(chart, gh)) == 0 {
+			b.Fatal("expected employees missing from github")
+		}
+	}
+}
+
+func BenchmarkCreateTeamByIDIfNotExists(b *testing.B) {
+	chart := generateOrgChart(benchmarkEmployees, benchmarkContractors)
+	existing := generateGithubState(chart).teams
+
+	gh := generateGithubState(chart)
+	gh.orgTeams = chart.TeamsByID
+
+	// a third of the teams are still to be created, and a squad per tribe has a new description
+	for i, t := range chart.Teams {
+		if i%3 == 0 {
+			delete(existing, t.Github)
+		}
+	}
+
+	for _, t := range chart.Teams {
+		if strings.HasSuffix(t.ID, "_1") {
+			t.Description = "renamed"
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+
+		gh.teams = make(map[string]*github.Team, len(existing))
+
+		for slug, team := range existing {
+			gh.teams[slug] = team
+		}
+
+		gh.resetSyncResult()
+
+		b.StartTimer()
+
+		for _, t := range chart.Teams {
+			if _, err := gh.createTeamByIDIfNotExists(t.ID); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkSyncTeamMembers(b *testing.B) {
+	chart := generateOrgChart(benchmarkEmployees, benchmarkContractors)
+	gh := generateGithubState(chart)
+	gh.resetSyncResult()
+
+	syncData, err := teamMembersSyncData(chart, gh)
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// github is a little out of date, every team is missing someone and has a leaver in it
+	fake := &fakeGithub{
+		members:     map[int64][]*github.User{},
+		maintainers: map[int64][]*github.User{},
+	}
+
+	for team, membership := range syncData {
+		members := []*github.User{{Login: github.String("leaver-0")}}
+
+		for i, handle := range membership.Members {
+			if i > 0 {
+				members = append(members, &github.User{Login: github.String(handle)})
+			}
+		}
+
+		for _, handle := range membership.Maintainers {
+			maintainer := &github.User{Login: github.String(handle)}
+			members = append(members, maintainer)
+			fake.maintainers[team.GetID()] = append(fake.maintainers[team.GetID()], maintainer)
+		}
+
+		fake.members[team.GetID()] = members
+	}
+
+	client, server := newFakeGithubClient(fake)
+	defer server.Close()
+
+	gh.client = client
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		gh.resetSyncResult()
+		b.StartTimer()
+
+		for team, membership := range syncData {
+			if err := gh.syncTeamMembers(team, membership.Members, membership.Maintainers); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		if len(gh.syncResult.membershipRemovals) != len(syncData) {
+			b.Fatalf("expected a removal per team, got %d", len(gh.syncResult.membershipRemovals))
+		}
+	}
+}
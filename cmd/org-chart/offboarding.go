@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/google/go-github/github"
+	"github.com/jszwec/csvutil"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	offboardingLeaver              = "leaver"
+	offboardingUnknown             = "unknown"
+	offboardingBot                 = "bot"
+	offboardingOutsideCollaborator = "outside_collaborator"
+)
+
+type offboardingEntry struct {
+	Login          string `json:"login" csv:"login"`
+	Classification string `json:"classification" csv:"classification"`
+	EmployeeID     string `json:"employeeId" csv:"employee_id"`
+	Name           string `json:"name" csv:"name"`
+	Action         string `json:"action" csv:"action"`
+}
+
+// parseAllowList reads github logins of bots and service accounts, one per line, anything
+// after the login and lines starting with # are treated as comments
+func parseAllowList(r io.Reader) (map[string]bool, error) {
+	allowed := map[string]bool{}
+
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		allowed[normalisedLogin(strings.TrimPrefix(fields[0], "@"))] = true
+	}
+
+	return allowed, scanner.Err()
+}
+
+func (gh *GithubState) getOutsideCollaborators() ([]*github.User, error) {
+
+	ctx := context.Background()
+
+	opt := &github.ListOutsideCollaboratorsOptions{
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+
+	allCollaborators := []*github.User{}
+
+	for {
+		collaborators, res, err := gh.client.Organizations.ListOutsideCollaborators(ctx, gh.organisation, opt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		allCollaborators = append(allCollaborators, collaborators...)
+
+		if res.NextPage == 0 {
+			break
+		}
+
+		opt.Page = res.NextPage
+	}
+
+	return allCollaborators, nil
+}
+
+// offboardingReport classifies organisation members and outside collaborators who are not
+// in the org chart. Members whose handle was synced from the org chart before are leavers.
+func offboardingReport(chart *OrgChart, gh *GithubState, collaborators []*github.User, allowed map[string]bool, mapping *githubTeamMapping) []*offboardingEntry {
+
+	report := []*offboardingEntry{}
+
+	classify := func(user *github.User, outside bool) *offboardingEntry {
+		entry := &offboardingEntry{Login: user.GetLogin()}
+
+		if mapping != nil {
+			if member, ok := mapping.member(normalisedLogin(user.GetLogin())); ok {
+				entry.EmployeeID = member.EmployeeID
+				entry.Name = member.Name
+			}
+		}
+
+		switch {
+		case allowed[normalisedLogin(user.GetLogin())] || user.GetType() == "Bot":
+			entry.Classification = offboardingBot
+		case outside:
+			entry.Classification = offboardingOutsideCollaborator
+		case entry.EmployeeID != "":
+			entry.Classification = offboardingLeaver
+		default:
+			entry.Classification = offboardingUnknown
+		}
+
+		return entry
+	}
+
+	for _, member := range githubMembersNotInOrgchart(chart, gh) {
+		report = append(report, classify(member, false))
+	}
+
+	inChart := map[string]bool{}
+
+	for _, e := range chart.Employees {
+		inChart[e.Github] = true
+	}
+
+	for _, collaborator := range collaborators {
+		if !inChart[normalisedLogin(collaborator.GetLogin())] {
+			report = append(report, classify(collaborator, true))
+		}
+	}
+
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Classification != report[j].Classification {
+			return report[i].Classification < report[j].Classification
+		}
+		return report[i].Login < report[j].Login
+	})
+
+	return report
+}
+
+// checkRemovalThreshold guards against mass removals caused by a broken or partial org chart,
+// a threshold of 0 disables the check
+func checkRemovalThreshold(what string, count, threshold int) error {
+	if threshold > 0 && count > threshold {
+		return errors.Errorf("refusing to remove %d %s, more than the threshold of %d", count, what, threshold)
+	}
+	return nil
+}
+
+// offboardLeavers removes leavers from the organisation, or converts them to outside
+// collaborators, refusing to touch more than maxRemovals accounts in one run
+func (gh *GithubState) offboardLeavers(report []*offboardingEntry, convert bool, maxRemovals int) error {
+
+	leavers := []*offboardingEntry{}
+
+	for _, entry := range report {
+		if entry.Classification == offboardingLeaver {
+			leavers = append(leavers, entry)
+		}
+	}
+
+	if err := checkRemovalThreshold("organisation members", len(leavers), maxRemovals); err != nil {
+		if !gh.dry {
+			return err
+		}
+		logrus.Warn(err)
+	}
+
+	ctx := context.Background()
+
+	for _, entry := range leavers {
+
+		action := "removed"
+
+		if convert {
+			action = "converted"
+		}
+
+		if gh.dry {
+			entry.Action = "would be " + action
+			continue
+		}
+
+		var err error
+
+		if convert {
+			_, err = gh.client.Organizations.ConvertMemberToOutsideCollaborator(ctx, gh.organisation, entry.Login)
+		} else {
+			_, err = gh.client.Organizations.RemoveMember(ctx, gh.organisation, entry.Login)
+		}
+
+		if err != nil {
+			return errors.Wrapf(err, "offboarding %s", entry.Login)
+		}
+
+		entry.Action = action
+	}
+
+	return nil
+}
+
+// writeOffboardingReport writes the report as json, or csv, to a file or stdout when empty
+func writeOffboardingReport(outputFile string, asCSV bool, report []*offboardingEntry) error {
+
+	var outputWriter io.Writer
+
+	outputWriter = os.Stdout
+
+	if outputFile != "" {
+		f, err := os.Create(outputFile)
+
+		if err != nil {
+			return errors.Wrap(err, "creating output file")
+		}
+
+		defer f.Close()
+
+		outputWriter = f
+	}
+
+	if asCSV {
+
+		b, err := csvutil.Marshal(report)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = outputWriter.Write(b)
+		return err
+	}
+
+	encoder := json.NewEncoder(outputWriter)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(report)
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	scimUserSchema       = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema      = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimEnterpriseSchema = "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User"
+	scimListSchema       = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema      = "urn:ietf:params:scim:api:messages:2.0:Error"
+
+	scimDefaultCount = 100
+	scimMaxCount     = 1000
+)
+
+type scimMeta struct {
+	ResourceType string `json:"resourceType"`
+	Location     string `json:"location"`
+}
+
+type scimName struct {
+	Formatted string `json:"formatted"`
+}
+
+type scimValue struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+type scimEnterpriseUser struct {
+	EmployeeNumber string     `json:"employeeNumber,omitempty"`
+	Department     string     `json:"department,omitempty"`
+	Division       string     `json:"division,omitempty"`
+	Manager        *scimValue `json:"manager,omitempty"`
+}
+
+type scimUser struct {
+	Schemas     []string            `json:"schemas"`
+	ID          string              `json:"id"`
+	ExternalID  string              `json:"externalId"`
+	UserName    string              `json:"userName"`
+	Name        scimName            `json:"name"`
+	DisplayName string              `json:"displayName"`
+	Title       string              `json:"title,omitempty"`
+	UserType    string              `json:"userType,omitempty"`
+	Active      bool                `json:"active"`
+	Emails      []scimValue         `json:"emails,omitempty"`
+	Groups      []scimValue         `json:"groups"`
+	Enterprise  *scimEnterpriseUser `json:"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User"`
+	Meta        scimMeta            `json:"meta"`
+}
+
+type scimGroup struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id"`
+	ExternalID  string      `json:"externalId"`
+	DisplayName string      `json:"displayName"`
+	Members     []scimValue `json:"members"`
+	Meta        scimMeta    `json:"meta"`
+}
+
+type scimListResponse struct {
+	Schemas      []string      `json:"schemas"`
+	TotalResults int           `json:"totalResults"`
+	StartIndex   int           `json:"startIndex"`
+	ItemsPerPage int           `json:"itemsPerPage"`
+	Resources    []interface{} `json:"Resources"`
+}
+
+type scimError struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail"`
+}
+
+// scimServer serves the org chart as a read only SCIM 2.0 service provider, reloading the
+// chart once it is older than refresh
+type scimServer struct {
+	dataURL string
+	token   string
+	refresh time.Duration
+	baseURL string
+
+	mu       sync.Mutex
+	index    *scimIndex
+	loadedAt time.Time
+}
+
+// scimResources are the users or groups of a chart listed by id, so pages stay stable
+// between requests, with the attribute trees filters are evaluated on
+type scimResources struct {
+	resources  []interface{}
+	attributes []map[string]interface{}
+	byID       map[string]interface{}
+}
+
+func (r *scimResources) add(id string, resource interface{}) error {
+	attributes, err := scimAttributes(resource)
+
+	if err != nil {
+		return err
+	}
+
+	r.resources = append(r.resources, resource)
+	r.attributes = append(r.attributes, attributes)
+	r.byID[id] = resource
+
+	return nil
+}
+
+// scimIndex holds the resources of a loaded chart, built once per load
+type scimIndex struct {
+	users  *scimResources
+	groups *scimResources
+}
+
+func (s *scimServer) newIndex(oc *OrgChart) (*scimIndex, error) {
+
+	index := &scimIndex{
+		users:  &scimResources{byID: map[string]interface{}{}},
+		groups: &scimResources{byID: map[string]interface{}{}},
+	}
+
+	employees := make([]*Employee, len(oc.Employees))
+	copy(employees, oc.Employees)
+
+	sort.Slice(employees, func(i, j int) bool {
+		return employees[i].ID < employees[j].ID
+	})
+
+	employeesByTeam := map[string][]*Employee{}
+
+	for _, e := range employees {
+		employeesByTeam[e.MemberOf] = append(employeesByTeam[e.MemberOf], e)
+
+		if err := index.users.add(e.ID, s.user(oc, e)); err != nil {
+			return nil, err
+		}
+	}
+
+	teams := make([]*Team, len(oc.Teams))
+	copy(teams, oc.Teams)
+
+	sort.Slice(teams, func(i, j int) bool {
+		return teams[i].ID < teams[j].ID
+	})
+
+	for _, t := range teams {
+		if err := index.groups.add(t.ID, s.group(oc, t, employeesByTeam[t.ID])); err != nil {
+			return nil, err
+		}
+	}
+
+	return index, nil
+}
+
+// load loads the chart and indexes its users and groups
+func (s *scimServer) load() (*scimIndex, error) {
+
+	chart, err := loadOrgChartData(s.dataURL)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.newIndex(chart)
+}
+
+// resources returns the index of the chart, reloading it once it is older than refresh
+func (s *scimServer) resources() (*scimIndex, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.index != nil && time.Since(s.loadedAt) < s.refresh {
+		return s.index, nil
+	}
+
+	index, err := s.load()
+
+	if err != nil {
+		if s.index == nil {
+			return nil, err
+		}
+
+		logrus.Errorf("reloading org chart data, serving the previous copy: %v", err)
+		return s.index, nil
+	}
+
+	s.index = index
+	s.loadedAt = time.Now()
+
+	return s.index, nil
+}
+
+func (s *scimServer) user(oc *OrgChart, e *Employee) *scimUser {
+
+	user := &scimUser{
+		Schemas:     []string{scimUserSchema, scimEnterpriseSchema},
+		ID:          e.ID,
+		ExternalID:  e.ID,
+		UserName:    e.ID,
+		Name:        scimName{Formatted: e.Name},
+		DisplayName: e.Name,
+		Title:       e.Title,
+		UserType:    e.Type,
+		Active:      true,
+		Groups:      []scimValue{},
+		Enterprise: &scimEnterpriseUser{
+			EmployeeNumber: e.Number,
+			Department:     e.Team.Name,
+			Division:       e.Stream,
+		},
+		Meta: scimMeta{
+			ResourceType: "User",
+			Location:     fmt.Sprintf("%s/Users/%s", s.baseURL, e.ID),
+		},
+	}
+
+	if e.Email != "" {
+		user.UserName = e.Email
+		user.Emails = []scimValue{{Value: e.Email, Type: "work", Primary: true}}
+	}
+
+	for t := e.Team; t != nil; t = oc.TeamsByID[t.ParentID] {
+		groupType := "indirect"
+
+		if t == e.Team {
+			groupType = "direct"
+		}
+
+		user.Groups = append(user.Groups, scimValue{
+			Value:   t.ID,
+			Display: t.Name,
+			Type:    groupType,
+			Ref:     fmt.Sprintf("%s/Groups/%s", s.baseURL, t.ID),
+		})
+	}
+
+	if manager := oc.manager(e); manager != nil {
+		user.Enterprise.Manager = &scimValue{
+			Value:   manager.ID,
+			Display: manager.Name,
+			Ref:     fmt.Sprintf("%s/Users/%s", s.baseURL, manager.ID),
+		}
+	}
+
+	return user
+}
+
+// group maps a team to a group whose members are the employees of the team and its child
+// teams as nested groups
+func (s *scimServer) group(oc *OrgChart, t *Team, employees []*Employee) *scimGroup {
+
+	group := &scimGroup{
+		Schemas:     []string{scimGroupSchema},
+		ID:          t.ID,
+		ExternalID:  t.ID,
+		DisplayName: t.Name,
+		Members:     []scimValue{},
+		Meta: scimMeta{
+			ResourceType: "Group",
+			Location:     fmt.Sprintf("%s/Groups/%s", s.baseURL, t.ID),
+		},
+	}
+
+	for _, e := range employees {
+		group.Members = append(group.Members, scimValue{
+			Value:   e.ID,
+			Display: e.Name,
+			Type:    "User",
+			Ref:     fmt.Sprintf("%s/Users/%s", s.baseURL, e.ID),
+		})
+	}
+
+	for _, child := range oc.childTeams[t.ID] {
+		group.Members = append(group.Members, scimValue{
+			Value:   child.ID,
+			Display: child.Name,
+			Type:    "Group",
+			Ref:     fmt.Sprintf("%s/Groups/%s", s.baseURL, child.ID),
+		})
+	}
+
+	return group
+}
+
+func (s *scimServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if s.token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+s.token)) != 1 {
+		scimRespondError(w, http.StatusUnauthorized, "", "missing or invalid bearer token")
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		scimRespondError(w, http.StatusNotImplemented, "", "the org chart is read only")
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/scim/v2"), "/")
+	parts := strings.SplitN(path, "/", 2)
+
+	switch parts[0] {
+	case "ServiceProviderConfig":
+		scimRespond(w, http.StatusOK, scimServiceProviderConfig)
+		return
+	case "ResourceTypes":
+		scimRespond(w, http.StatusOK, s.resourceTypes())
+		return
+	case "Users", "Groups":
+	default:
+		scimRespondError(w, http.StatusNotFound, "", fmt.Sprintf("unknown resource %s", path))
+		return
+	}
+
+	index, err := s.resources()
+
+	if err != nil {
+		logrus.Errorf("retrieving org chart data: %v", err)
+		scimRespondError(w, http.StatusInternalServerError, "", "org chart data unavailable")
+		return
+	}
+
+	resources := index.users
+
+	if parts[0] == "Groups" {
+		resources = index.groups
+	}
+
+	if len(parts) == 2 {
+		if resource, ok := resources.byID[parts[1]]; ok {
+			scimRespond(w, http.StatusOK, resource)
+			return
+		}
+
+		scimRespondError(w, http.StatusNotFound, "", fmt.Sprintf("%s %s not found", strings.TrimSuffix(parts[0], "s"), parts[1]))
+		return
+	}
+
+	list, err := scimList(resources, r.URL.Query().Get("filter"), r.URL.Query().Get("startIndex"), r.URL.Query().Get("count"))
+
+	if err != nil {
+		scimRespondError(w, http.StatusBadRequest, "invalidFilter", err.Error())
+		return
+	}
+
+	scimRespond(w, http.StatusOK, list)
+}
+
+// scimList filters resources and returns the requested page of them
+func scimList(resources *scimResources, filterExpr, startIndex, count string) (*scimListResponse, error) {
+
+	var filter scimFilter
+
+	if filterExpr != "" {
+		var err error
+
+		filter, err = parseScimFilter(filterExpr)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	matching := []interface{}{}
+
+	for i, resource := range resources.resources {
+		if filter != nil && !filter.match(resources.attributes[i]) {
+			continue
+		}
+
+		matching = append(matching, resource)
+	}
+
+	start := 1
+
+	if startIndex != "" {
+		i, err := strconv.Atoi(startIndex)
+
+		if err != nil {
+			return nil, errors.Errorf("invalid startIndex %s", startIndex)
+		}
+
+		// out of range start indexes are interpreted as 1, as the spec requires
+		if i > 1 {
+			start = i
+		}
+	}
+
+	size := scimDefaultCount
+
+	if count != "" {
+		i, err := strconv.Atoi(count)
+
+		if err != nil {
+			return nil, errors.Errorf("invalid count %s", count)
+		}
+
+		size = i
+
+		if size < 0 {
+			size = 0
+		}
+
+		if size > scimMaxCount {
+			size = scimMaxCount
+		}
+	}
+
+	page := []interface{}{}
+
+	for i := start - 1; i < len(matching) && len(page) < size; i++ {
+		page = append(page, matching[i])
+	}
+
+	return &scimListResponse{
+		Schemas:      []string{scimListSchema},
+		TotalResults: len(matching),
+		StartIndex:   start,
+		ItemsPerPage: len(page),
+		Resources:    page,
+	}, nil
+}
+
+// scimAttributes turns a resource into the generic attribute tree filters are evaluated on
+func scimAttributes(resource interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(resource)
+
+	if err != nil {
+		return nil, err
+	}
+
+	attributes := map[string]interface{}{}
+
+	return attributes, json.Unmarshal(b, &attributes)
+}
+
+var scimServiceProviderConfig = map[string]interface{}{
+	"schemas":        []string{"urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"},
+	"patch":          map[string]bool{"supported": false},
+	"bulk":           map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+	"filter":         map[string]interface{}{"supported": true, "maxResults": scimMaxCount},
+	"changePassword": map[string]bool{"supported": false},
+	"sort":           map[string]bool{"supported": false},
+	"etag":           map[string]bool{"supported": false},
+	"authenticationSchemes": []map[string]string{{
+		"type":        "oauthbearertoken",
+		"name":        "Bearer token",
+		"description": "token given to scim-serve",
+	}},
+}
+
+func (s *scimServer) resourceTypes() *scimListResponse {
+	types := []interface{}{
+		map[string]interface{}{
+			"schemas":  []string{"urn:ietf:params:scim:schemas:core:2.0:ResourceType"},
+			"id":       "User",
+			"name":     "User",
+			"endpoint": "/Users",
+			"schema":   scimUserSchema,
+			"schemaExtensions": []map[string]interface{}{
+				{"schema": scimEnterpriseSchema, "required": true},
+			},
+			"meta": scimMeta{ResourceType: "ResourceType", Location: s.baseURL + "/ResourceTypes/User"},
+		},
+		map[string]interface{}{
+			"schemas":  []string{"urn:ietf:params:scim:schemas:core:2.0:ResourceType"},
+			"id":       "Group",
+			"name":     "Group",
+			"endpoint": "/Groups",
+			"schema":   scimGroupSchema,
+			"meta":     scimMeta{ResourceType: "ResourceType", Location: s.baseURL + "/ResourceTypes/Group"},
+		},
+	}
+
+	return &scimListResponse{
+		Schemas:      []string{scimListSchema},
+		TotalResults: len(types),
+		StartIndex:   1,
+		ItemsPerPage: len(types),
+		Resources:    types,
+	}
+}
+
+func scimRespond(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/scim+json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logrus.Errorf("writing scim response: %v", err)
+	}
+}
+
+func scimRespondError(w http.ResponseWriter, status int, scimType, detail string) {
+	scimRespond(w, status, &scimError{
+		Schemas:  []string{scimErrorSchema},
+		Status:   strconv.Itoa(status),
+		ScimType: scimType,
+		Detail:   detail,
+	})
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// scimFilter is a parsed SCIM filter expression, see RFC 7644 section 3.4.2.2
+type scimFilter interface {
+	match(attributes map[string]interface{}) bool
+}
+
+type scimLogicalFilter struct {
+	or          bool
+	left, right scimFilter
+}
+
+func (f *scimLogicalFilter) match(attributes map[string]interface{}) bool {
+	if f.or {
+		return f.left.match(attributes) || f.right.match(attributes)
+	}
+	return f.left.match(attributes) && f.right.match(attributes)
+}
+
+type scimNotFilter struct {
+	filter scimFilter
+}
+
+func (f *scimNotFilter) match(attributes map[string]interface{}) bool {
+	return !f.filter.match(attributes)
+}
+
+// scimValuePathFilter matches multi-valued attributes having an element matching filter,
+// as in emails[type eq "work"]
+type scimValuePathFilter struct {
+	path   string
+	filter scimFilter
+}
+
+func (f *scimValuePathFilter) match(attributes map[string]interface{}) bool {
+	for _, v := range scimResolve(attributes, f.path) {
+		if element, ok := v.(map[string]interface{}); ok && f.filter.match(element) {
+			return true
+		}
+	}
+	return false
+}
+
+type scimAttributeFilter struct {
+	path     string
+	operator string
+	value    interface{}
+}
+
+var scimOperators = map[string]bool{
+	"eq": true, "ne": true, "co": true, "sw": true, "ew": true,
+	"gt": true, "ge": true, "lt": true, "le": true, "pr": true,
+}
+
+func (f *scimAttributeFilter) match(attributes map[string]interface{}) bool {
+	values := scimResolve(attributes, f.path)
+
+	switch f.operator {
+	case "pr":
+		for _, v := range values {
+			if s, ok := v.(string); !ok || s != "" {
+				return true
+			}
+		}
+		return false
+	case "ne":
+		return !(&scimAttributeFilter{f.path, "eq", f.value}).match(attributes)
+	}
+
+	if f.value == nil {
+		return f.operator == "eq" && len(values) == 0
+	}
+
+	for _, v := range values {
+		if scimCompare(v, f.operator, f.value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func scimCompare(attribute interface{}, operator string, value interface{}) bool {
+
+	switch a := attribute.(type) {
+	case string:
+		v, ok := value.(string)
+
+		if !ok {
+			return false
+		}
+
+		a, v = strings.ToLower(a), strings.ToLower(v)
+
+		switch operator {
+		case "eq":
+			return a == v
+		case "co":
+			return strings.Contains(a, v)
+		case "sw":
+			return strings.HasPrefix(a, v)
+		case "ew":
+			return strings.HasSuffix(a, v)
+		case "gt":
+			return a > v
+		case "ge":
+			return a >= v
+		case "lt":
+			return a < v
+		case "le":
+			return a <= v
+		}
+	case bool:
+		v, ok := value.(bool)
+		return ok && operator == "eq" && a == v
+	case float64:
+		v, ok := value.(float64)
+
+		if !ok {
+			return false
+		}
+
+		switch operator {
+		case "eq":
+			return a == v
+		case "gt":
+			return a > v
+		case "ge":
+			return a >= v
+		case "lt":
+			return a < v
+		case "le":
+			return a <= v
+		}
+	}
+
+	return false
+}
+
+// scimResolve returns the values of an attribute path, matching attribute names case
+// insensitively and flattening multi-valued attributes. Paths may be prefixed with the
+// URN of their schema.
+func scimResolve(attributes map[string]interface{}, path string) []interface{} {
+
+	lower := strings.ToLower(path)
+
+	for _, core := range []string{scimUserSchema, scimGroupSchema} {
+		if prefix := strings.ToLower(core) + ":"; strings.HasPrefix(lower, prefix) {
+			path, lower = path[len(prefix):], lower[len(prefix):]
+		}
+	}
+
+	current := []interface{}{attributes}
+
+	if strings.HasPrefix(lower, "urn:") {
+		for key, v := range attributes {
+			if prefix := strings.ToLower(key) + ":"; strings.HasPrefix(lower, prefix) {
+				current = []interface{}{v}
+				path = path[len(prefix):]
+				break
+			}
+		}
+	}
+
+	for _, name := range strings.Split(path, ".") {
+		next := []interface{}{}
+
+		for _, v := range current {
+			object, ok := v.(map[string]interface{})
+
+			if !ok {
+				continue
+			}
+
+			for key, value := range object {
+				if !strings.EqualFold(key, name) || value == nil {
+					continue
+				}
+
+				if values, ok := value.([]interface{}); ok {
+					next = append(next, values...)
+				} else {
+					next = append(next, value)
+				}
+			}
+		}
+
+		current = next
+	}
+
+	return current
+}
+
+type scimFilterParser struct {
+	tokens []string
+	pos    int
+}
+
+func parseScimFilter(expr string) (scimFilter, error) {
+
+	tokens, err := scimFilterTokens(expr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	p := &scimFilterParser{tokens: tokens}
+
+	filter, err := p.parseOr()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos < len(p.tokens) {
+		return nil, errors.Errorf("unexpected %s in filter", p.tokens[p.pos])
+	}
+
+	return filter, nil
+}
+
+// scimFilterTokens splits a filter into words, quoted strings, parentheses and brackets
+func scimFilterTokens(expr string) ([]string, error) {
+	tokens := []string{}
+
+	for i := 0; i < len(expr); {
+		switch c := expr[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case strings.IndexByte("()[]", c) >= 0:
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			end := i + 1
+
+			for ; end < len(expr) && expr[end] != '"'; end++ {
+				if expr[end] == '\\' {
+					end++
+				}
+			}
+
+			if end >= len(expr) {
+				return nil, errors.New("unterminated string in filter")
+			}
+
+			tokens = append(tokens, expr[i:end+1])
+			i = end + 1
+		default:
+			end := i
+
+			for end < len(expr) && strings.IndexByte(" \t()[]\"", expr[end]) < 0 {
+				end++
+			}
+
+			tokens = append(tokens, expr[i:end])
+			i = end
+		}
+	}
+
+	return tokens, nil
+}
+
+func (p *scimFilterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *scimFilterParser) next() (string, error) {
+	if p.pos >= len(p.tokens) {
+		return "", errors.New("unexpected end of filter")
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *scimFilterParser) expect(token string) error {
+	t, err := p.next()
+
+	if err != nil {
+		return err
+	}
+
+	if t != token {
+		return errors.Errorf("expected %s but found %s in filter", token, t)
+	}
+
+	return nil
+}
+
+func (p *scimFilterParser) parseOr() (scimFilter, error) {
+	left, err := p.parseAnd()
+
+	for err == nil && strings.EqualFold(p.peek(), "or") {
+		p.pos++
+
+		var right scimFilter
+		right, err = p.parseAnd()
+		left = &scimLogicalFilter{or: true, left: left, right: right}
+	}
+
+	return left, err
+}
+
+func (p *scimFilterParser) parseAnd() (scimFilter, error) {
+	left, err := p.parseUnary()
+
+	for err == nil && strings.EqualFold(p.peek(), "and") {
+		p.pos++
+
+		var right scimFilter
+		right, err = p.parseUnary()
+		left = &scimLogicalFilter{left: left, right: right}
+	}
+
+	return left, err
+}
+
+func (p *scimFilterParser) parseUnary() (scimFilter, error) {
+
+	negate := false
+
+	if strings.EqualFold(p.peek(), "not") {
+		p.pos++
+		negate = true
+	}
+
+	var filter scimFilter
+	var err error
+
+	if p.peek() == "(" {
+		p.pos++
+
+		if filter, err = p.parseOr(); err != nil {
+			return nil, err
+		}
+
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+	} else if negate {
+		return nil, errors.New("not must be followed by a parenthesised filter")
+	} else if filter, err = p.parseAttribute(); err != nil {
+		return nil, err
+	}
+
+	if negate {
+		return &scimNotFilter{filter}, nil
+	}
+
+	return filter, nil
+}
+
+func (p *scimFilterParser) parseAttribute() (scimFilter, error) {
+
+	path, err := p.next()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.IndexByte("()[]\"", path[0]) >= 0 {
+		return nil, errors.Errorf("expected an attribute but found %s in filter", path)
+	}
+
+	if p.peek() == "[" {
+		p.pos++
+
+		filter, err := p.parseOr()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+
+		return &scimValuePathFilter{path: path, filter: filter}, nil
+	}
+
+	operator, err := p.next()
+
+	if err != nil {
+		return nil, err
+	}
+
+	operator = strings.ToLower(operator)
+
+	if !scimOperators[operator] {
+		return nil, errors.Errorf("unsupported operator %s in filter", operator)
+	}
+
+	if operator == "pr" {
+		return &scimAttributeFilter{path: path, operator: operator}, nil
+	}
+
+	literal, err := p.next()
+
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := scimFilterValue(literal)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &scimAttributeFilter{path: path, operator: operator, value: value}, nil
+}
+
+func scimFilterValue(literal string) (interface{}, error) {
+
+	switch strings.ToLower(literal) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+
+	if strings.HasPrefix(literal, "\"") {
+		value, err := strconv.Unquote(literal)
+
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid string %s in filter", literal)
+		}
+
+		return value, nil
+	}
+
+	number, err := strconv.ParseFloat(literal, 64)
+
+	if err != nil {
+		return nil, errors.Errorf("invalid value %s in filter", literal)
+	}
+
+	return number, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func scimFilterTestUsers(t *testing.T) map[string]map[string]interface{} {
+	chart := &OrgChart{
+		Teams: []*Team{
+			{ID: "tribe", Name: "Tribe", Kind: "Tribe"},
+			{ID: "squad", Name: "Squad", Kind: "Squad", ParentID: "tribe", TeachLeadID: "lead"},
+		},
+		Employees: []*Employee{
+			{ID: "lead", Name: "Lead", MemberOf: "tribe", Title: "Engineering Manager", Number: "1", Email: "lead@example.com"},
+			{ID: "alice", Name: "Alice", MemberOf: "squad", Title: "Engineer", Number: "42", Email: "alice@example.com", Stream: "ENGINEERING"},
+			{ID: "bob", Name: "Bob", MemberOf: "squad", Number: "43", Type: "CONTRACTOR", Stream: "ENGINEERING"},
+		},
+	}
+
+	if err := chart.organise(); err != nil {
+		t.Fatal(err)
+	}
+
+	server := &scimServer{baseURL: "http://localhost/scim/v2"}
+	users := map[string]map[string]interface{}{}
+
+	for _, e := range chart.Employees {
+		attributes, err := scimAttributes(server.user(chart, e))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		users[e.ID] = attributes
+	}
+
+	return users
+}
+
+func TestScimFilter(t *testing.T) {
+	users := scimFilterTestUsers(t)
+
+	for _, test := range []struct {
+		filter  string
+		matches []string
+	}{
+		{`userName eq "alice@example.com"`, []string{"alice"}},
+		{`USERNAME EQ "Alice@Example.com"`, []string{"alice"}},
+		{`userName ne "alice@example.com"`, []string{"bob", "lead"}},
+		{`title co "engineer"`, []string{"alice", "lead"}},
+		{`title sw "Eng" and title ew "er"`, []string{"alice", "lead"}},
+		{`name.formatted gt "B"`, []string{"bob", "lead"}},
+		{`userType eq "CONTRACTOR"`, []string{"bob"}},
+		{`active eq true`, []string{"alice", "bob", "lead"}},
+		{`active eq false`, []string{}},
+
+		// and binds tighter than or
+		{`userName eq "alice@example.com" or title eq "Nope" and active eq false`, []string{"alice"}},
+		{`title eq "Nope" and active eq true or userName eq "bob"`, []string{"bob"}},
+		{`(userName eq "alice@example.com" or userName eq "bob") and userType eq "CONTRACTOR"`, []string{"bob"}},
+
+		{`not (title pr)`, []string{"bob"}},
+		{`not (userName eq "bob" or userName eq "lead@example.com")`, []string{"alice"}},
+		{`active eq true and not (userType eq "CONTRACTOR")`, []string{"alice", "lead"}},
+
+		{`emails[type eq "work"]`, []string{"alice", "lead"}},
+		{`emails[type eq "work" and value sw "alice"]`, []string{"alice"}},
+		{`emails[type eq "home"]`, []string{}},
+		{`groups[value eq "tribe" and type eq "indirect"]`, []string{"alice", "bob"}},
+		{`groups.value eq "squad"`, []string{"alice", "bob"}},
+
+		{`urn:ietf:params:scim:schemas:core:2.0:User:userName eq "bob"`, []string{"bob"}},
+		{`urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:employeeNumber eq "42"`, []string{"alice"}},
+		{`urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:manager.value eq "lead"`, []string{"alice", "bob"}},
+		{`URN:IETF:PARAMS:SCIM:SCHEMAS:EXTENSION:ENTERPRISE:2.0:USER:division pr`, []string{"alice", "bob"}},
+
+		{`title pr`, []string{"alice", "lead"}},
+		{`emails pr`, []string{"alice", "lead"}},
+		{`urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:manager pr`, []string{"alice", "bob"}},
+		{`nickName pr`, []string{}},
+		{`title eq null`, []string{"bob"}},
+	} {
+		filter, err := parseScimFilter(test.filter)
+
+		if err != nil {
+			t.Errorf("parsing %s: %v", test.filter, err)
+			continue
+		}
+
+		matches := []string{}
+
+		for _, id := range []string{"alice", "bob", "lead"} {
+			if filter.match(users[id]) {
+				matches = append(matches, id)
+			}
+		}
+
+		if !reflect.DeepEqual(matches, test.matches) {
+			t.Errorf("%s: expected %v, got %v", test.filter, test.matches, matches)
+		}
+	}
+}
+
+func TestScimFilterErrors(t *testing.T) {
+	for _, filter := range []string{
+		``,
+		`title`,
+		`title eq`,
+		`title like "x"`,
+		`title eq "unterminated`,
+		`title eq unquoted`,
+		`title eq "x" extra`,
+		`title eq "x" and`,
+		`(title eq "x"`,
+		`title eq "x")`,
+		`emails[type eq "work"`,
+		`emails[]`,
+		`not title eq "x"`,
+		`"title" eq "x"`,
+	} {
+		if _, err := parseScimFilter(filter); err == nil {
+			t.Errorf("expected %q to be rejected", filter)
+		}
+	}
+}
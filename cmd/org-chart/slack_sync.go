@@ -0,0 +1,594 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// slackClient calls the slack web api, apiURL can point at a local stand-in
+type slackClient struct {
+	apiURL string
+	token  string
+	http   *http.Client
+}
+
+type slackResponse struct {
+	OK               bool   `json:"ok"`
+	Error            string `json:"error"`
+	ResponseMetadata struct {
+		NextCursor string `json:"next_cursor"`
+	} `json:"response_metadata"`
+}
+
+func newSlackClient(apiURL, token string) *slackClient {
+	return &slackClient{
+		apiURL: strings.TrimSuffix(apiURL, "/") + "/",
+		token:  token,
+		http:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// call posts a form encoded request to a web api method and decodes the response into
+// result, which must embed slackResponse
+func (c *slackClient) call(method string, params url.Values, result interface{}) error {
+
+	req, err := http.NewRequest("POST", c.apiURL+method, strings.NewReader(params.Encode()))
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	res, err := c.http.Do(req)
+
+	if err != nil {
+		return errors.Wrapf(err, "calling %s", method)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return errors.Errorf("calling %s: unexpected status %s", method, res.Status)
+	}
+
+	b, err := ioutil.ReadAll(res.Body)
+
+	if err != nil {
+		return errors.Wrapf(err, "reading %s response", method)
+	}
+
+	var status slackResponse
+
+	if err := json.Unmarshal(b, &status); err != nil {
+		return errors.Wrapf(err, "decoding %s response", method)
+	}
+
+	if !status.OK {
+		return errors.Errorf("calling %s: %s", method, status.Error)
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	return json.Unmarshal(b, result)
+}
+
+type slackUser struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Deleted bool   `json:"deleted"`
+	IsBot   bool   `json:"is_bot"`
+	Profile struct {
+		Email       string `json:"email"`
+		DisplayName string `json:"display_name"`
+	} `json:"profile"`
+}
+
+type slackUserGroup struct {
+	ID          string   `json:"id"`
+	Handle      string   `json:"handle"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	DateDelete  int64    `json:"date_delete"`
+	Users       []string `json:"users"`
+}
+
+func (g *slackUserGroup) disabled() bool {
+	return g.DateDelete != 0
+}
+
+type SlackState struct {
+	client      *slackClient
+	groupPrefix string
+	groups      map[string]*slackUserGroup
+	users       map[string]*slackUser
+	usersByName map[string]*slackUser
+	usersByMail map[string]*slackUser
+	dry         bool
+
+	maxGroupRemovals  int
+	maxMemberRemovals int
+}
+
+func newSlackState(client *slackClient, groupPrefix string) (*SlackState, error) {
+
+	slack := &SlackState{
+		client:      client,
+		groupPrefix: groupPrefix,
+		groups:      map[string]*slackUserGroup{},
+		users:       map[string]*slackUser{},
+		usersByName: map[string]*slackUser{},
+		usersByMail: map[string]*slackUser{},
+	}
+
+	cursor := ""
+
+	for {
+		var page struct {
+			slackResponse
+			Members []*slackUser `json:"members"`
+		}
+
+		params := url.Values{"limit": {"200"}}
+
+		if cursor != "" {
+			params.Set("cursor", cursor)
+		}
+
+		if err := client.call("users.list", params, &page); err != nil {
+			return nil, err
+		}
+
+		for _, u := range page.Members {
+			if u.Deleted || u.IsBot {
+				continue
+			}
+
+			slack.users[u.ID] = u
+			slack.usersByName[strings.ToLower(u.Name)] = u
+
+			if u.Profile.DisplayName != "" {
+				slack.usersByName[strings.ToLower(u.Profile.DisplayName)] = u
+			}
+
+			if u.Profile.Email != "" {
+				slack.usersByMail[strings.ToLower(u.Profile.Email)] = u
+			}
+		}
+
+		cursor = page.ResponseMetadata.NextCursor
+
+		if cursor == "" {
+			break
+		}
+	}
+
+	var groups struct {
+		slackResponse
+		UserGroups []*slackUserGroup `json:"usergroups"`
+	}
+
+	err := client.call("usergroups.list", url.Values{"include_users": {"true"}, "include_disabled": {"true"}}, &groups)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, g := range groups.UserGroups {
+		slack.groups[g.Handle] = g
+	}
+
+	return slack, nil
+}
+
+// slackGroupHandle derives the user group handle of a team from its id
+func slackGroupHandle(prefix, teamID string) string {
+	return fmt.Sprintf("%s%s", prefix, strings.ToLower(strings.Replace(teamID, "_", "-", -1)))
+}
+
+// user matches an employee to a slack user by their explicit slack handle or id, falling back
+// to their email address
+func (s *SlackState) user(e *Employee) *slackUser {
+	if handle := strings.TrimPrefix(strings.TrimSpace(e.Slack), "@"); handle != "" {
+		if u, ok := s.users[handle]; ok {
+			return u
+		}
+
+		return s.usersByName[strings.ToLower(handle)]
+	}
+
+	if e.Email != "" {
+		return s.usersByMail[strings.ToLower(strings.TrimSpace(e.Email))]
+	}
+
+	return nil
+}
+
+// slackGroupPlan is the user group an org team should have in slack
+type slackGroupPlan struct {
+	team        *Team
+	handle      string
+	name        string
+	description string
+	users       []string
+}
+
+// slackSyncReport is the machine readable outcome of a slack-sync run
+type slackSyncReport struct {
+	StartedAt           time.Time            `json:"startedAt"`
+	FinishedAt          time.Time            `json:"finishedAt"`
+	DryRun              bool                 `json:"dryRun"`
+	Error               string               `json:"error,omitempty"`
+	CreatedGroups       []string             `json:"createdGroups"`
+	EnabledGroups       []string             `json:"enabledGroups"`
+	DisabledGroups      []string             `json:"disabledGroups"`
+	GroupChanges        []slackReportChange  `json:"groupChanges"`
+	MembershipAdditions []slackReportMember  `json:"membershipAdditions"`
+	MembershipRemovals  []slackReportMember  `json:"membershipRemovals"`
+	EmptyGroups         []string             `json:"emptyGroups"`
+	UnmatchedEmployees  []syncReportEmployee `json:"unmatchedEmployees"`
+}
+
+type slackReportChange struct {
+	Group   string `json:"group"`
+	Subject string `json:"subject"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+}
+
+type slackReportMember struct {
+	Group string `json:"group"`
+	User  string `json:"user"`
+	Name  string `json:"name"`
+}
+
+func newSlackSyncReport(dry bool) *slackSyncReport {
+	return &slackSyncReport{
+		StartedAt:           time.Now(),
+		DryRun:              dry,
+		CreatedGroups:       []string{},
+		EnabledGroups:       []string{},
+		DisabledGroups:      []string{},
+		GroupChanges:        []slackReportChange{},
+		MembershipAdditions: []slackReportMember{},
+		MembershipRemovals:  []slackReportMember{},
+		EmptyGroups:         []string{},
+		UnmatchedEmployees:  []syncReportEmployee{},
+	}
+}
+
+func (r *slackSyncReport) finish(err error) {
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	r.FinishedAt = time.Now()
+}
+
+func (r *slackSyncReport) save(path string) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// plan works out the user group of every team, members and leads of a team are the users of
+// its group. Employees who can't be matched to a slack user are reported.
+func (s *SlackState) plan(chart *OrgChart, report *slackSyncReport) (map[string]*slackGroupPlan, error) {
+
+	plans := map[string]*slackGroupPlan{}
+
+	unmatched := map[string]*Employee{}
+
+	userIDs := func(employees []*Employee) []string {
+		ids := []string{}
+
+		for _, e := range employees {
+			u := s.user(e)
+
+			if u == nil {
+				unmatched[e.ID] = e
+				continue
+			}
+
+			ids = append(ids, u.ID)
+		}
+
+		return ids
+	}
+
+	employeesByTeam := map[string][]*Employee{}
+
+	for _, e := range chart.Employees {
+		employeesByTeam[e.MemberOf] = append(employeesByTeam[e.MemberOf], e)
+	}
+
+	for _, t := range chart.Teams {
+		leads, err := chart.leads(t)
+
+		if err != nil {
+			return nil, err
+		}
+
+		users := map[string]bool{}
+
+		for _, id := range userIDs(append(employeesByTeam[t.ID], leads...)) {
+			users[id] = true
+		}
+
+		plan := &slackGroupPlan{
+			team:        t,
+			handle:      slackGroupHandle(s.groupPrefix, t.ID),
+			name:        t.Name,
+			description: t.Description,
+			users:       []string{},
+		}
+
+		for id := range users {
+			plan.users = append(plan.users, id)
+		}
+
+		sort.Strings(plan.users)
+
+		plans[plan.handle] = plan
+	}
+
+	employees := []*Employee{}
+
+	for _, e := range unmatched {
+		employees = append(employees, e)
+	}
+
+	sort.Slice(employees, func(i, j int) bool {
+		return employees[i].ID < employees[j].ID
+	})
+
+	report.UnmatchedEmployees = unmatchedEmployees(employees, true)
+
+	return plans, nil
+}
+
+// diffUsers returns the users of desired missing from current and the users of current
+// missing from desired
+func diffUsers(current, desired []string) ([]string, []string) {
+	currentSet := map[string]bool{}
+	desiredSet := map[string]bool{}
+
+	for _, id := range current {
+		currentSet[id] = true
+	}
+
+	for _, id := range desired {
+		desiredSet[id] = true
+	}
+
+	added := []string{}
+	removed := []string{}
+
+	for _, id := range desired {
+		if !currentSet[id] {
+			added = append(added, id)
+		}
+	}
+
+	for _, id := range current {
+		if !desiredSet[id] {
+			removed = append(removed, id)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+
+	return added, removed
+}
+
+func (s *SlackState) reportMember(handle, id string) slackReportMember {
+	member := slackReportMember{Group: handle, User: id}
+
+	if u, ok := s.users[id]; ok {
+		member.Name = u.Name
+	}
+
+	return member
+}
+
+// Sync reconciles the prefixed user groups of the slack workspace with the org chart. Groups
+// of teams no longer in the chart are disabled, slack has no way of deleting them.
+func (s *SlackState) Sync(chart *OrgChart, report *slackSyncReport) error {
+
+	plans, err := s.plan(chart, report)
+
+	if err != nil {
+		return err
+	}
+
+	toDisable := []*slackUserGroup{}
+
+	for handle, g := range s.groups {
+		if _, ok := plans[handle]; !ok && strings.HasPrefix(handle, s.groupPrefix) && !g.disabled() {
+			toDisable = append(toDisable, g)
+		}
+	}
+
+	sort.Slice(toDisable, func(i, j int) bool {
+		return toDisable[i].Handle < toDisable[j].Handle
+	})
+
+	memberRemovals := 0
+
+	for handle, plan := range plans {
+		if g, ok := s.groups[handle]; ok && len(plan.users) > 0 {
+			_, removed := diffUsers(g.Users, plan.users)
+			memberRemovals += len(removed)
+		}
+	}
+
+	for _, err := range []error{
+		checkRemovalThreshold("slack user groups", len(toDisable), s.maxGroupRemovals),
+		checkRemovalThreshold("slack user group members", memberRemovals, s.maxMemberRemovals),
+	} {
+		if err == nil {
+			continue
+		}
+
+		if !s.dry {
+			return err
+		}
+
+		logrus.Warn(err)
+	}
+
+	handles := []string{}
+
+	for handle := range plans {
+		handles = append(handles, handle)
+	}
+
+	sort.Strings(handles)
+
+	for _, handle := range handles {
+		if err := s.syncGroup(plans[handle], report); err != nil {
+			return errors.Wrapf(err, "syncing user group %s", handle)
+		}
+	}
+
+	for _, g := range toDisable {
+		if !s.dry {
+			if err := s.client.call("usergroups.disable", url.Values{"usergroup": {g.ID}}, nil); err != nil {
+				return errors.Wrapf(err, "disabling user group %s", g.Handle)
+			}
+		}
+
+		report.DisabledGroups = append(report.DisabledGroups, g.Handle)
+	}
+
+	return nil
+}
+
+func (s *SlackState) syncGroup(plan *slackGroupPlan, report *slackSyncReport) error {
+
+	group, ok := s.groups[plan.handle]
+
+	if !ok {
+		params := url.Values{
+			"handle":      {plan.handle},
+			"name":        {plan.name},
+			"description": {plan.description},
+		}
+
+		if s.dry {
+			group = &slackUserGroup{
+				ID:          fmt.Sprintf("S%d", rand.Int63()),
+				Handle:      plan.handle,
+				Name:        plan.name,
+				Description: plan.description,
+			}
+		} else {
+			var created struct {
+				slackResponse
+				UserGroup *slackUserGroup `json:"usergroup"`
+			}
+
+			if err := s.client.call("usergroups.create", params, &created); err != nil {
+				return err
+			}
+
+			group = created.UserGroup
+		}
+
+		s.groups[plan.handle] = group
+		report.CreatedGroups = append(report.CreatedGroups, plan.handle)
+	}
+
+	if group.disabled() {
+		if !s.dry {
+			if err := s.client.call("usergroups.enable", url.Values{"usergroup": {group.ID}}, nil); err != nil {
+				return err
+			}
+		}
+
+		report.EnabledGroups = append(report.EnabledGroups, plan.handle)
+	}
+
+	changes := []slackReportChange{}
+
+	if group.Name != plan.name {
+		changes = append(changes, slackReportChange{plan.handle, "name", group.Name, plan.name})
+	}
+
+	if group.Description != plan.description {
+		changes = append(changes, slackReportChange{plan.handle, "description", group.Description, plan.description})
+	}
+
+	if len(changes) > 0 {
+		if !s.dry {
+			params := url.Values{
+				"usergroup":   {group.ID},
+				"name":        {plan.name},
+				"description": {plan.description},
+			}
+
+			if err := s.client.call("usergroups.update", params, nil); err != nil {
+				return err
+			}
+		}
+
+		report.GroupChanges = append(report.GroupChanges, changes...)
+	}
+
+	// slack refuses to empty a user group, its users are left alone until the team has some
+	if len(plan.users) == 0 {
+		if len(group.Users) > 0 {
+			logrus.Warnf("team %s has no slack users, leaving user group %s as it is", plan.team.ID, plan.handle)
+		}
+
+		report.EmptyGroups = append(report.EmptyGroups, plan.handle)
+		return nil
+	}
+
+	added, removed := diffUsers(group.Users, plan.users)
+
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	if !s.dry {
+		params := url.Values{
+			"usergroup": {group.ID},
+			"users":     {strings.Join(plan.users, ",")},
+		}
+
+		if err := s.client.call("usergroups.users.update", params, nil); err != nil {
+			return err
+		}
+	}
+
+	for _, id := range added {
+		report.MembershipAdditions = append(report.MembershipAdditions, s.reportMember(plan.handle, id))
+	}
+
+	for _, id := range removed {
+		report.MembershipRemovals = append(report.MembershipRemovals, s.reportMember(plan.handle, id))
+	}
+
+	group.Users = plan.users
+
+	return nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// fakeSlack stands in for the methods of the slack web api the sync calls
+type fakeSlack struct {
+	token  string
+	users  []*slackUser
+	groups map[string]*slackUserGroup
+	calls  []string
+}
+
+func (f *fakeSlack) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	method := strings.TrimPrefix(r.URL.Path, "/")
+	f.calls = append(f.calls, method)
+
+	reply := func(body map[string]interface{}) {
+		body["ok"] = true
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(body)
+	}
+
+	if r.Header.Get("Authorization") != "Bearer "+f.token {
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": false, "error": "invalid_auth"})
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	byID := func() *slackUserGroup {
+		for _, g := range f.groups {
+			if g.ID == r.Form.Get("usergroup") {
+				return g
+			}
+		}
+		return nil
+	}
+
+	switch method {
+	case "users.list":
+		// a user per page, to go through the cursor
+		page := 0
+		fmt.Sscanf(r.Form.Get("cursor"), "page-%d", &page)
+
+		body := map[string]interface{}{"members": f.users[page : page+1]}
+
+		if page+1 < len(f.users) {
+			body["response_metadata"] = map[string]string{"next_cursor": fmt.Sprintf("page-%d", page+1)}
+		}
+
+		reply(body)
+	case "usergroups.list":
+		groups := []*slackUserGroup{}
+
+		for _, g := range f.groups {
+			groups = append(groups, g)
+		}
+
+		reply(map[string]interface{}{"usergroups": groups})
+	case "usergroups.create":
+		g := &slackUserGroup{
+			ID:          fmt.Sprintf("S%d", len(f.groups)+1),
+			Handle:      r.Form.Get("handle"),
+			Name:        r.Form.Get("name"),
+			Description: r.Form.Get("description"),
+		}
+		f.groups[g.Handle] = g
+
+		reply(map[string]interface{}{"usergroup": g})
+	case "usergroups.update":
+		g := byID()
+		g.Name = r.Form.Get("name")
+		g.Description = r.Form.Get("description")
+
+		reply(map[string]interface{}{"usergroup": g})
+	case "usergroups.users.update":
+		g := byID()
+		g.Users = strings.Split(r.Form.Get("users"), ",")
+
+		reply(map[string]interface{}{"usergroup": g})
+	case "usergroups.disable":
+		byID().DateDelete = 1
+
+		reply(map[string]interface{}{})
+	case "usergroups.enable":
+		byID().DateDelete = 0
+
+		reply(map[string]interface{}{})
+	default:
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": false, "error": "unknown_method"})
+	}
+}
+
+func slackTestUser(id, name, email string) *slackUser {
+	u := &slackUser{ID: id, Name: name}
+	u.Profile.Email = email
+	return u
+}
+
+func newSlackTestFixture(t *testing.T) (*OrgChart, *fakeSlack) {
+	chart := &OrgChart{
+		Teams: []*Team{
+			{ID: "tribe", Name: "Tribe", Kind: "Tribe"},
+			{ID: "squad_one", Name: "Squad One", Description: "the first", Kind: "Squad", ParentID: "tribe", TeachLeadID: "lead"},
+			{ID: "squad_two", Name: "Squad Two", Kind: "Squad", ParentID: "tribe"},
+		},
+		Employees: []*Employee{
+			{ID: "lead", Name: "Lead", MemberOf: "tribe", Email: "Lead@example.com"},
+			{ID: "alice", Name: "Alice", MemberOf: "squad_one", Email: "alice@example.com"},
+			{ID: "bob", Name: "Bob", MemberOf: "squad_one", Slack: "@bobby"},
+			{ID: "carol", Name: "Carol", MemberOf: "squad_two"},
+			{ID: "dan", Name: "Dan", MemberOf: "squad_two", Email: "dan@elsewhere.com"},
+		},
+	}
+
+	if err := chart.organise(); err != nil {
+		t.Fatal(err)
+	}
+
+	fake := &fakeSlack{
+		token: "xoxb-test",
+		users: []*slackUser{
+			slackTestUser("U1", "lead", "lead@example.com"),
+			slackTestUser("U2", "alice", "alice@example.com"),
+			slackTestUser("U3", "bobby", ""),
+			slackTestUser("U4", "leaver", "leaver@example.com"),
+		},
+		groups: map[string]*slackUserGroup{
+			"squad-squad-one": {ID: "S100", Handle: "squad-squad-one", Name: "Squad 1", Description: "the first", Users: []string{"U2", "U4"}},
+			"squad-gone":      {ID: "S101", Handle: "squad-gone", Name: "Gone", Users: []string{"U4"}},
+			"other":           {ID: "S102", Handle: "other", Name: "Not ours", Users: []string{"U4"}},
+		},
+	}
+
+	return chart, fake
+}
+
+func syncSlack(t *testing.T, chart *OrgChart, fake *fakeSlack, dry bool) (*slackSyncReport, error) {
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	slack, err := newSlackState(newSlackClient(server.URL, fake.token), "squad-")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slack.dry = dry
+	slack.maxGroupRemovals = 5
+	slack.maxMemberRemovals = 5
+
+	report := newSlackSyncReport(dry)
+
+	return report, slack.Sync(chart, report)
+}
+
+func TestSlackSync(t *testing.T) {
+	chart, fake := newSlackTestFixture(t)
+
+	report, err := syncSlack(t, chart, fake, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := func(handle string) []string {
+		users := append([]string{}, fake.groups[handle].Users...)
+		sort.Strings(users)
+		return users
+	}
+
+	if got := users("squad-squad-one"); !reflect.DeepEqual(got, []string{"U1", "U2", "U3"}) {
+		t.Errorf("unexpected users of squad-squad-one %v", got)
+	}
+
+	if got := fake.groups["squad-squad-one"].Name; got != "Squad One" {
+		t.Errorf("expected squad-squad-one to be renamed, got %s", got)
+	}
+
+	if got := users("squad-tribe"); !reflect.DeepEqual(got, []string{"U1"}) {
+		t.Errorf("unexpected users of squad-tribe %v", got)
+	}
+
+	if _, ok := fake.groups["squad-squad-two"]; !ok {
+		t.Error("expected squad-squad-two to be created although it has no slack users")
+	}
+
+	if fake.groups["squad-gone"].DateDelete == 0 {
+		t.Error("expected squad-gone to be disabled")
+	}
+
+	if fake.groups["other"].DateDelete != 0 {
+		t.Error("expected a group without the prefix to be left alone")
+	}
+
+	if !reflect.DeepEqual(report.DisabledGroups, []string{"squad-gone"}) {
+		t.Errorf("unexpected disabled groups %v", report.DisabledGroups)
+	}
+
+	if !reflect.DeepEqual(report.MembershipRemovals, []slackReportMember{{"squad-squad-one", "U4", "leaver"}}) {
+		t.Errorf("unexpected removals %v", report.MembershipRemovals)
+	}
+
+	if !reflect.DeepEqual(report.GroupChanges, []slackReportChange{{"squad-squad-one", "name", "Squad 1", "Squad One"}}) {
+		t.Errorf("unexpected group changes %v", report.GroupChanges)
+	}
+
+	expected := []syncReportEmployee{
+		{ID: "carol", Name: "Carol", Team: "squad_two", Reason: unmatchedNoEmail},
+		{ID: "dan", Name: "Dan", Team: "squad_two", Email: "dan@elsewhere.com", Reason: unmatchedNotFound},
+	}
+
+	if !reflect.DeepEqual(report.UnmatchedEmployees, expected) {
+		t.Errorf("unexpected unmatched employees %v", report.UnmatchedEmployees)
+	}
+}
+
+func TestSlackSyncDryRunChangesNothing(t *testing.T) {
+	chart, fake := newSlackTestFixture(t)
+
+	report, err := syncSlack(t, chart, fake, true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, call := range fake.calls {
+		if call != "users.list" && call != "usergroups.list" {
+			t.Errorf("unexpected call to %s in a dry run", call)
+		}
+	}
+
+	if len(report.CreatedGroups) != 2 || len(report.DisabledGroups) != 1 {
+		t.Errorf("expected the changes to be reported, got %v created and %v disabled", report.CreatedGroups, report.DisabledGroups)
+	}
+}
+
+func TestSlackSyncRefusesTooManyRemovals(t *testing.T) {
+	chart, fake := newSlackTestFixture(t)
+
+	for i := 0; i < 6; i++ {
+		handle := fmt.Sprintf("squad-gone-%d", i)
+		fake.groups[handle] = &slackUserGroup{ID: fmt.Sprintf("S%d", 200+i), Handle: handle}
+	}
+
+	if _, err := syncSlack(t, chart, fake, false); err == nil {
+		t.Fatal("expected the sync to refuse disabling 7 groups")
+	}
+
+	for _, call := range fake.calls {
+		if call != "users.list" && call != "usergroups.list" {
+			t.Errorf("unexpected call to %s after refusing", call)
+		}
+	}
+}
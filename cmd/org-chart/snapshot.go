@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const snapshotManifestFile = "manifest.json"
+
+// snapshotManifest indexes the revisions kept in a snapshot archive. The charts themselves
+// are gzipped json named after the sha256 of their content, so that revisions which didn't
+// change anything share a file.
+type snapshotManifest struct {
+	Snapshots []*snapshotEntry `json:"snapshots"`
+}
+
+type snapshotEntry struct {
+	Rev  string `json:"rev"`
+	Hash string `json:"hash"`
+	File string `json:"file"`
+	// Timestamp is when the revision was saved, or seen when following changes, revisions
+	// archived after the fact without a save time have none
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	Headcount int        `json:"headcount"`
+}
+
+// revGeneration is the number of edits a couchdb revision is the result of
+func revGeneration(rev string) int {
+	generation, _ := strconv.Atoi(strings.SplitN(rev, "-", 2)[0])
+	return generation
+}
+
+func loadSnapshotManifest(store snapshotStore) (*snapshotManifest, error) {
+	manifest := &snapshotManifest{Snapshots: []*snapshotEntry{}}
+
+	b, err := store.get(snapshotManifestFile)
+
+	if err == errSnapshotNotFound {
+		return manifest, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, manifest); err != nil {
+		return nil, errors.Wrap(err, "parsing manifest")
+	}
+
+	return manifest, nil
+}
+
+func (m *snapshotManifest) entry(rev string) *snapshotEntry {
+	for _, entry := range m.Snapshots {
+		if entry.Rev == rev {
+			return entry
+		}
+	}
+	return nil
+}
+
+// at returns the last revision saved at or before t, only revisions with a timestamp count
+func (m *snapshotManifest) at(t time.Time) *snapshotEntry {
+	var found *snapshotEntry
+
+	for _, entry := range m.Snapshots {
+		if entry.Timestamp != nil && !entry.Timestamp.After(t) {
+			found = entry
+		}
+	}
+
+	return found
+}
+
+// chartArchiver writes revisions of the chart to a snapshot archive
+type chartArchiver struct {
+	location string
+	store    snapshotStore
+	manifest *snapshotManifest
+	// compacted are the revisions found compacted away, warned about once
+	compacted map[string]bool
+}
+
+// archive adds a revision to the archive unless it is there already. Revisions without a save
+// time are stamped with the time they were seen when observed is set.
+func (a *chartArchiver) archive(rev string, observed bool) (*snapshotEntry, error) {
+
+	if entry := a.manifest.entry(rev); entry != nil {
+		return nil, nil
+	}
+
+	couchdb, err := couchClient(a.location)
+
+	if err != nil {
+		return nil, err
+	}
+
+	raw := map[string]interface{}{}
+
+	if err := getCouchDocument(couchdb, "chart", url.Values{"rev": []string{rev}}, &raw); err != nil {
+		return nil, errors.Wrapf(err, "retrieving revision %s", rev)
+	}
+
+	delete(raw, "_id")
+	delete(raw, "_rev")
+
+	// maps are marshalled with sorted keys, the same content always hashes the same
+	content, err := json.Marshal(raw)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(content)
+
+	entry := &snapshotEntry{
+		Rev:  rev,
+		Hash: hex.EncodeToString(sum[:]),
+	}
+
+	entry.File = "charts/" + entry.Hash + ".json.gz"
+
+	if employees, ok := raw["employees"].([]interface{}); ok {
+		entry.Headcount = len(employees)
+	}
+
+	if updatedAt, ok := raw["updatedAt"].(string); ok {
+		if t, err := time.Parse(time.RFC3339, updatedAt); err == nil {
+			t = t.UTC()
+			entry.Timestamp = &t
+		}
+	}
+
+	if entry.Timestamp == nil && observed {
+		t := time.Now().UTC()
+		entry.Timestamp = &t
+	}
+
+	if _, err := a.store.get(entry.File); err == errSnapshotNotFound {
+		buf := &bytes.Buffer{}
+		gz := gzip.NewWriter(buf)
+
+		if _, err := gz.Write(content); err != nil {
+			return nil, err
+		}
+
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+
+		if err := a.store.put(entry.File, buf.Bytes(), "application/gzip"); err != nil {
+			return nil, errors.Wrapf(err, "writing %s", entry.File)
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	a.manifest.Snapshots = append(a.manifest.Snapshots, entry)
+
+	sort.SliceStable(a.manifest.Snapshots, func(i, j int) bool {
+		return revGeneration(a.manifest.Snapshots[i].Rev) < revGeneration(a.manifest.Snapshots[j].Rev)
+	})
+
+	b, err := json.MarshalIndent(a.manifest, "", "  ")
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.store.put(snapshotManifestFile, b, "application/json"); err != nil {
+		return nil, errors.Wrap(err, "writing manifest")
+	}
+
+	return entry, nil
+}
+
+// archiveAvailable archives every revision couchdb still keeps which isn't archived yet. Only
+// observed, the revision the changes feed just reported, is known to be saved just now, those
+// caught up on with it are left without a timestamp unless they have a save time.
+func (a *chartArchiver) archiveAvailable(observed string) error {
+
+	revs, available, err := chartRevisions(a.location)
+
+	if err != nil {
+		return errors.Wrap(err, "listing revisions")
+	}
+
+	for _, rev := range revs {
+		if !available[rev] {
+			if a.manifest.entry(rev) == nil && !a.compacted[rev] {
+				logrus.Warnf("revision %s was compacted away before it could be archived", rev)
+
+				if a.compacted == nil {
+					a.compacted = map[string]bool{}
+				}
+
+				a.compacted[rev] = true
+			}
+			continue
+		}
+
+		entry, err := a.archive(rev, rev == observed)
+
+		if err != nil {
+			return err
+		}
+
+		if entry != nil {
+			logrus.Infof("archived revision %s as %s, %d employees", rev, entry.File, entry.Headcount)
+		}
+	}
+
+	return nil
+}
+
+// follow archives every revision couchdb keeps, then every revision of the chart as it is
+// saved. The changes feed is followed from the sequence the database was at before the
+// revisions were listed, so that none saved in between is missed, and each change archives
+// all of the revisions not archived yet as a longpoll returns only the latest of several.
+func (a *chartArchiver) follow() error {
+
+	client := &http.Client{Timeout: 90 * time.Second}
+
+	seq, err := chartUpdateSeq(client, a.location)
+
+	if err != nil {
+		return errors.Wrap(err, "reading the update sequence")
+	}
+
+	if err := a.archiveAvailable(""); err != nil {
+		return err
+	}
+
+	failures := 0
+
+	for {
+		next, rev, err := chartChanges(client, a.location, seq)
+
+		if err != nil {
+			failures++
+
+			if failures > 5 {
+				return errors.Wrap(err, "following changes")
+			}
+
+			logrus.Warnf("following changes: %v", err)
+			time.Sleep(time.Duration(failures) * time.Second)
+			continue
+		}
+
+		failures = 0
+		seq = next
+
+		if rev == "" {
+			continue
+		}
+
+		if err := a.archiveAvailable(rev); err != nil {
+			return err
+		}
+	}
+}
+
+// loadOrgChartSnapshot loads the chart from a snapshot archive, the latest one or the one
+// named by a rev parameter or in place at a time given as an at parameter, RFC 3339 or a date
+func loadOrgChartSnapshot(location string) (*OrgChart, error) {
+
+	store, query, err := openSnapshotStore(location)
+
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := loadSnapshotManifest(store)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "reading manifest")
+	}
+
+	var entry *snapshotEntry
+
+	switch {
+	case query.Get("rev") != "":
+		entry = manifest.entry(query.Get("rev"))
+	case query.Get("at") != "":
+		at, err := time.Parse(time.RFC3339, query.Get("at"))
+
+		if err != nil {
+			day, dayErr := time.Parse("2006-01-02", query.Get("at"))
+
+			if dayErr != nil {
+				return nil, errors.Wrap(err, "parsing at")
+			}
+
+			// a day means the chart as it was at the end of it
+			at = day.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+
+		entry = manifest.at(at)
+	case len(manifest.Snapshots) > 0:
+		entry = manifest.Snapshots[len(manifest.Snapshots)-1]
+	}
+
+	if entry == nil {
+		return nil, errors.Errorf("no snapshot matching %s", location)
+	}
+
+	b, err := store.get(entry.File)
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s", entry.File)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := ioutil.ReadAll(gz)
+
+	if err != nil {
+		return nil, err
+	}
+
+	chart, err := decodeOrgChart(bytes.NewReader(content))
+
+	if err != nil {
+		return nil, err
+	}
+
+	chart.Rev = entry.Rev
+
+	return chart, nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// snapshotStore keeps the files of a snapshot archive, in a local directory or a bucket
+type snapshotStore interface {
+	get(name string) ([]byte, error)
+	put(name string, data []byte, contentType string) error
+}
+
+var errSnapshotNotFound = errors.New("not found in the snapshot archive")
+
+// isSnapshotLocation tells snapshot archives apart from couchdb urls and chart files, a plain
+// path or file:// url is an archive when it is a directory
+func isSnapshotLocation(location string) bool {
+
+	if strings.HasPrefix(location, "s3://") {
+		return true
+	}
+
+	u, err := url.Parse(location)
+
+	if err != nil || (u.Scheme != "" && u.Scheme != "file") {
+		return false
+	}
+
+	info, err := os.Stat(u.Path)
+
+	return err == nil && info.IsDir()
+}
+
+// openSnapshotStore opens the archive at s3://bucket/prefix, file:///path or a plain path,
+// returning the query of the location too. Buckets take endpoint and region parameters, for
+// MinIO and other S3 compatible stores, and the standard AWS credential variables.
+func openSnapshotStore(location string) (snapshotStore, url.Values, error) {
+
+	u, err := url.Parse(location)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	query := u.Query()
+
+	switch u.Scheme {
+	case "s3":
+		if u.Host == "" {
+			return nil, nil, errors.Errorf("no bucket in %s", location)
+		}
+
+		store := &s3Store{
+			endpoint:     strings.TrimSuffix(query.Get("endpoint"), "/"),
+			region:       query.Get("region"),
+			bucket:       u.Host,
+			prefix:       strings.Trim(u.Path, "/"),
+			accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+			client:       &http.Client{Timeout: time.Minute},
+		}
+
+		if store.region == "" {
+			store.region = "us-east-1"
+		}
+
+		if store.endpoint == "" {
+			store.endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", store.region)
+		}
+
+		return store, query, nil
+	case "file":
+		return &dirStore{dir: u.Path}, query, nil
+	case "":
+		return &dirStore{dir: u.Path}, query, nil
+	default:
+		return nil, nil, errors.Errorf("unsupported snapshot archive %s, expected s3://, file:// or a directory", location)
+	}
+}
+
+type dirStore struct {
+	dir string
+}
+
+func (s *dirStore) get(name string) ([]byte, error) {
+	b, err := ioutil.ReadFile(filepath.Join(s.dir, filepath.FromSlash(name)))
+
+	if os.IsNotExist(err) {
+		return nil, errSnapshotNotFound
+	}
+
+	return b, err
+}
+
+// put writes through a temporary file, so that readers never see half a manifest
+func (s *dirStore) put(name string, data []byte, contentType string) error {
+	path := filepath.Join(s.dir, filepath.FromSlash(name))
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// s3Store talks to S3 compatible object stores with path style urls and signature v4
+type s3Store struct {
+	endpoint     string
+	region       string
+	bucket       string
+	prefix       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+}
+
+func (s *s3Store) objectURL(name string) string {
+	key := name
+
+	if s.prefix != "" {
+		key = s.prefix + "/" + name
+	}
+
+	return s.endpoint + "/" + awsURIEncode(s.bucket+"/"+key)
+}
+
+func (s *s3Store) do(method, name string, body []byte, contentType string) (*http.Response, error) {
+
+	req, err := http.NewRequest(method, s.objectURL(name), bytes.NewReader(body))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	payloadHash := sha256.Sum256(body)
+
+	signS3(req, hex.EncodeToString(payloadHash[:]), s.accessKey, s.secretKey, s.region, time.Now())
+
+	return s.client.Do(req)
+}
+
+func (s *s3Store) get(name string) ([]byte, error) {
+
+	resp, err := s.do("GET", name, nil, "")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errSnapshotNotFound
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, errors.Errorf("getting %s returned %s: %s", name, resp.Status, b)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (s *s3Store) put(name string, data []byte, contentType string) error {
+
+	resp, err := s.do("PUT", name, data, contentType)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.Errorf("putting %s returned %s: %s", name, resp.Status, b)
+	}
+
+	return nil
+}
+
+// awsURIEncode escapes a path the way signature v4 expects, everything but unreserved
+// characters and slashes
+func awsURIEncode(path string) string {
+	b := &strings.Builder{}
+
+	for _, c := range []byte(path) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// signS3 adds the signature v4 authorization of a request to S3, signing the host and every
+// header already set
+func signS3(req *http.Request, payloadHash, accessKey, secretKey, region string, now time.Time) {
+
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	names := []string{}
+
+	for name := range headers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	canonicalHeaders := &strings.Builder{}
+
+	for _, name := range names {
+		fmt.Fprintf(canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsURIEncode(req.URL.Path),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, region)
+
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(requestHash[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// snapshotTestArchive archives the revisions of a fake couchdb to a temporary directory,
+// 2-b and 3-c have the same content and 4-d was compacted away
+func snapshotTestArchive(t *testing.T) (string, *chartArchiver, func()) {
+	teams := []map[string]interface{}{{"id": "squad", "name": "Squad"}}
+	alice := map[string]interface{}{"id": "alice", "name": "Alice", "memberOf": "squad"}
+	bob := map[string]interface{}{"id": "bob", "name": "Bob", "memberOf": "squad"}
+
+	couchdb := newFakeCouch()
+	couchdb.save("1-a", teams, []map[string]interface{}{alice})
+	couchdb.save("2-b", teams, []map[string]interface{}{alice, bob})
+	couchdb.save("3-c", teams, []map[string]interface{}{alice, bob})
+	couchdb.save("4-d", teams, []map[string]interface{}{bob})
+	couchdb.save("5-e", teams, []map[string]interface{}{bob})
+	couchdb.save("6-f", teams, []map[string]interface{}{alice})
+	couchdb.charts["1-a"]["updatedAt"] = "2020-10-01T09:00:00Z"
+	couchdb.charts["2-b"]["updatedAt"] = "2020-10-02T09:00:00Z"
+	couchdb.charts["3-c"]["updatedAt"] = "2020-10-02T09:00:00Z"
+	couchdb.missing["4-d"] = true
+
+	couch := httptest.NewServer(couchdb)
+
+	dir, err := ioutil.TempDir("", "snapshots")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archiver := &chartArchiver{
+		location: couch.URL + "/db",
+		store:    &dirStore{dir: dir},
+		manifest: &snapshotManifest{Snapshots: []*snapshotEntry{}},
+	}
+
+	return dir, archiver, func() {
+		couch.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestChartArchiverArchivesRevisionsByContent(t *testing.T) {
+	dir, archiver, cleanup := snapshotTestArchive(t)
+	defer cleanup()
+
+	if _, err := archiver.archive("2-b", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// 6-f is the revision the changes feed reported, 5-e is caught up on with it
+	if err := archiver.archiveAvailable("6-f"); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := loadSnapshotManifest(archiver.store)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(manifest, archiver.manifest) {
+		t.Errorf("the manifest written differs from the one archived to\n%+v\n%+v", manifest, archiver.manifest)
+	}
+
+	revs, headcounts, timestamps := []string{}, []int{}, []bool{}
+
+	for _, entry := range manifest.Snapshots {
+		revs = append(revs, entry.Rev)
+		headcounts = append(headcounts, entry.Headcount)
+		timestamps = append(timestamps, entry.Timestamp != nil)
+	}
+
+	if expected := []string{"1-a", "2-b", "3-c", "5-e", "6-f"}; !reflect.DeepEqual(revs, expected) {
+		t.Errorf("unexpected revisions %v, expected %v", revs, expected)
+	}
+
+	if expected := []int{1, 2, 2, 1, 1}; !reflect.DeepEqual(headcounts, expected) {
+		t.Errorf("unexpected headcounts %v, expected %v", headcounts, expected)
+	}
+
+	if expected := []bool{true, true, true, false, true}; !reflect.DeepEqual(timestamps, expected) {
+		t.Errorf("unexpected timestamps %v, expected %v", timestamps, expected)
+	}
+
+	if at := manifest.entry("2-b").Timestamp; !at.Equal(time.Date(2020, 10, 2, 9, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected timestamp of 2-b %v", at)
+	}
+
+	if manifest.entry("2-b").File != manifest.entry("3-c").File {
+		t.Errorf("expected revisions with the same content to share a file")
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, "charts"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 4 {
+		t.Errorf("expected 4 charts, got %d", len(files))
+	}
+
+	for _, entry := range manifest.Snapshots {
+		b, err := archiver.store.get(entry.File)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		gz, err := gzip.NewReader(bytes.NewReader(b))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := ioutil.ReadAll(gz)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sum := sha256.Sum256(content)
+
+		if hash := hex.EncodeToString(sum[:]); hash != entry.Hash || entry.File != "charts/"+hash+".json.gz" {
+			t.Errorf("revision %s is not named after its content, %s in %s", entry.Rev, hash, entry.File)
+		}
+	}
+
+	// revisions archived already are left alone
+	if entry, err := archiver.archive("3-c", true); err != nil || entry != nil {
+		t.Errorf("expected 3-c not to be archived again, got %+v, %v", entry, err)
+	}
+}
+
+func TestLoadOrgChartSnapshot(t *testing.T) {
+	dir, archiver, cleanup := snapshotTestArchive(t)
+	defer cleanup()
+
+	if err := archiver.archiveAvailable("6-f"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		location  string
+		rev       string
+		employees int
+	}{
+		{dir, "6-f", 1},
+		{"file://" + dir, "6-f", 1},
+		{dir + "?rev=2-b", "2-b", 2},
+		{dir + "?rev=5-e", "5-e", 1},
+		{dir + "?at=2020-10-01T12:00:00Z", "1-a", 1},
+		{"file://" + dir + "?at=2020-10-01", "1-a", 1},
+		{dir + "?at=2020-10-02", "3-c", 2},
+		{dir + "?at=2020-10-02T09:00:00%2B01:00", "1-a", 1},
+	} {
+		chart, err := loadOrgChartSnapshot(test.location)
+
+		if err != nil {
+			t.Errorf("loading %s: %v", test.location, err)
+			continue
+		}
+
+		if chart.Rev != test.rev || len(chart.Employees) != test.employees || chart.TeamsByID["squad"] == nil {
+			t.Errorf("unexpected chart from %s, revision %s with %d employees", test.location, chart.Rev, len(chart.Employees))
+		}
+	}
+
+	for _, location := range []string{
+		dir + "?rev=4-d",
+		dir + "?at=2020-09-30",
+		dir + "?at=yesterday",
+	} {
+		if _, err := loadOrgChartSnapshot(location); err == nil {
+			t.Errorf("expected %s not to be found", location)
+		}
+	}
+}
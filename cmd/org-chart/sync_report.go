@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// reasons an employee can't be matched to an account of another system
+const (
+	unmatchedNoEmail  = "no email in the chart"
+	unmatchedNotFound = "not found"
+)
+
+// syncReportEmployee is an employee a sync to slack, ldap or google couldn't match to an account
+type syncReportEmployee struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Team   string `json:"team"`
+	Email  string `json:"email,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// unmatchedEmployee reports an employee who couldn't be matched, telling those with nothing
+// to match them by from those missing from the other system. Every sync matches on email,
+// slack also on the slack id.
+func unmatchedEmployee(e *Employee, bySlackID bool) syncReportEmployee {
+	reason := unmatchedNotFound
+
+	if strings.TrimSpace(e.Email) == "" && (!bySlackID || strings.TrimSpace(e.Slack) == "") {
+		reason = unmatchedNoEmail
+	}
+
+	return syncReportEmployee{
+		ID:     e.ID,
+		Name:   e.Name,
+		Team:   e.MemberOf,
+		Email:  e.Email,
+		Reason: reason,
+	}
+}
+
+func unmatchedEmployees(employees []*Employee, bySlackID bool) []syncReportEmployee {
+	report := make([]syncReportEmployee, 0, len(employees))
+
+	for _, e := range employees {
+		report = append(report, unmatchedEmployee(e, bySlackID))
+	}
+
+	return report
+}
+
+// logUnmatched logs the employees a sync couldn't match, warning when some have no email at
+// all, emails of existing employees are only filled in by import-hr or the admin page
+func logUnmatched(system string, employees []syncReportEmployee) {
+	noEmail := 0
+
+	for _, e := range employees {
+		if e.Reason == unmatchedNoEmail {
+			noEmail++
+		}
+
+		logrus.Infof("employee %s (%s) not matched in %s: %s", e.Name, e.ID, system, e.Reason)
+	}
+
+	if noEmail > 0 {
+		logrus.Warnf("%d employees have no email in the chart and can't be matched in %s, fill them in with import-hr", noEmail, system)
+	}
+}
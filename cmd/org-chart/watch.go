@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// chartWatcher follows the couchdb changes feed of the chart and posts the events of every
+// new revision to webhooks
+type chartWatcher struct {
+	location   string
+	webhooks   []string
+	secret     string
+	client     *http.Client
+	feedClient *http.Client
+	// attempts bounds both the posts of a delivery and consecutive failures to read the feed
+	attempts       int
+	retryDelay     time.Duration
+	deadLetterFile string
+	stateFile      string
+}
+
+// watchState is where the watcher got to, so that a restart picks up the changes made while
+// it was down
+type watchState struct {
+	Seq string `json:"seq"`
+	Rev string `json:"rev"`
+}
+
+// chartDelivery is the body posted to webhooks, the events turning one revision into the next
+type chartDelivery struct {
+	ID               string       `json:"id"`
+	Revision         string       `json:"revision"`
+	PreviousRevision string       `json:"previousRevision"`
+	Timestamp        time.Time    `json:"timestamp"`
+	Events           []chartEvent `json:"events"`
+}
+
+// deadLetter is a delivery which failed, or a revision which couldn't be loaded to make one
+// and comes without a url
+type deadLetter struct {
+	URL      string         `json:"url,omitempty"`
+	FailedAt time.Time      `json:"failedAt"`
+	Error    string         `json:"error"`
+	Delivery *chartDelivery `json:"delivery"`
+}
+
+type couchChanges struct {
+	Results []struct {
+		Seq     json.RawMessage `json:"seq"`
+		ID      string          `json:"id"`
+		Deleted bool            `json:"deleted"`
+		Changes []struct {
+			Rev string `json:"rev"`
+		} `json:"changes"`
+	} `json:"results"`
+	LastSeq json.RawMessage `json:"last_seq"`
+}
+
+// couchSeq reads an update sequence, a number before couchdb 2 and an opaque string since
+func couchSeq(raw json.RawMessage) string {
+	var s string
+
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+
+	return string(raw)
+}
+
+func (w *chartWatcher) loadState() (*watchState, error) {
+	state := &watchState{}
+
+	if w.stateFile == "" {
+		return state, nil
+	}
+
+	b, err := ioutil.ReadFile(w.stateFile)
+
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return state, json.Unmarshal(b, state)
+}
+
+func (w *chartWatcher) saveState(state *watchState) error {
+	if w.stateFile == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(state)
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(w.stateFile, b, 0644)
+}
+
+func (w *chartWatcher) changes(seq string) (string, string, error) {
+	return chartChanges(w.feedClient, w.location, seq)
+}
+
+// chartChanges waits for the chart to change after seq, returning the new sequence and
+// revision, the revision is empty when the wait timed out
+func chartChanges(client *http.Client, location, seq string) (string, string, error) {
+
+	values := url.Values{
+		"feed":    []string{"longpoll"},
+		"since":   []string{seq},
+		"filter":  []string{"_doc_ids"},
+		"doc_ids": []string{`["chart"]`},
+		"timeout": []string{"60000"},
+	}
+
+	resp, err := client.Get(strings.TrimSuffix(location, "/") + "/_changes?" + values.Encode())
+
+	if err != nil {
+		return "", "", err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", "", errors.Errorf("changes feed returned %s: %s", resp.Status, b)
+	}
+
+	var changes couchChanges
+
+	if err := json.NewDecoder(resp.Body).Decode(&changes); err != nil {
+		return "", "", errors.Wrap(err, "decoding changes")
+	}
+
+	rev := ""
+
+	for _, result := range changes.Results {
+		if result.ID == "chart" && !result.Deleted && len(result.Changes) > 0 {
+			rev = result.Changes[0].Rev
+		}
+	}
+
+	return couchSeq(changes.LastSeq), rev, nil
+}
+
+// chartUpdateSeq reads the update sequence the database is at, changes from it on are those
+// saved after
+func chartUpdateSeq(client *http.Client, location string) (string, error) {
+
+	resp, err := client.Get(location)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", errors.Errorf("database info returned %s: %s", resp.Status, b)
+	}
+
+	var info struct {
+		UpdateSeq json.RawMessage `json:"update_seq"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", errors.Wrap(err, "decoding database info")
+	}
+
+	return couchSeq(info.UpdateSeq), nil
+}
+
+// run follows the changes feed until it fails to be read for good
+func (w *chartWatcher) run() error {
+
+	state, err := w.loadState()
+
+	if err != nil {
+		return errors.Wrap(err, "reading state")
+	}
+
+	var current *OrgChart
+
+	if state.Rev != "" {
+		current, err = loadOrgChartRevision(w.location, state.Rev)
+
+		if err != nil {
+			logrus.Warnf("could not load revision %s the watch stopped at, changes made since are lost: %v", state.Rev, err)
+			state = &watchState{}
+		}
+	}
+
+	if current == nil {
+		current, err = loadOrgChartData(w.location)
+
+		if err != nil {
+			return errors.Wrap(err, "retrieving org chart data")
+		}
+
+		state.Rev = current.Rev
+	}
+
+	if state.Seq == "" {
+		state.Seq = "now"
+	}
+
+	logrus.Infof("watching org chart from revision %s", state.Rev)
+
+	failures := 0
+
+	for {
+		seq, rev, err := w.changes(state.Seq)
+
+		if err != nil {
+			failures++
+
+			if failures > w.attempts {
+				return errors.Wrap(err, "following changes")
+			}
+
+			logrus.Warnf("following changes: %v", err)
+			time.Sleep(w.retryDelay * time.Duration(failures))
+			continue
+		}
+
+		failures = 0
+
+		if rev != "" && rev != state.Rev {
+			next, err := loadOrgChartRevision(w.location, rev)
+
+			if err != nil {
+				w.skip(rev, state.Rev, err)
+			} else {
+				events := diffOrgCharts(current, next)
+
+				if len(events) > 0 {
+					w.deliver(&chartDelivery{
+						ID:               rev,
+						Revision:         rev,
+						PreviousRevision: state.Rev,
+						Timestamp:        time.Now().UTC(),
+						Events:           events,
+					})
+				}
+
+				logrus.Infof("org chart revision %s, %d events", rev, len(events))
+
+				current = next
+				state.Rev = rev
+			}
+		}
+
+		state.Seq = seq
+
+		if err := w.saveState(state); err != nil {
+			return errors.Wrap(err, "writing state")
+		}
+	}
+}
+
+// skip records a revision which couldn't be loaded and is left behind, the next one is
+// diffed with the last revision loaded so that its events cover both
+func (w *chartWatcher) skip(rev, previous string, err error) {
+
+	logrus.Errorf("retrieving org chart revision %s, skipping it: %v", rev, err)
+
+	letter := &deadLetter{
+		FailedAt: time.Now().UTC(),
+		Error:    errors.Wrapf(err, "retrieving org chart revision %s", rev).Error(),
+		Delivery: &chartDelivery{ID: rev, Revision: rev, PreviousRevision: previous, Timestamp: time.Now().UTC(), Events: []chartEvent{}},
+	}
+
+	if err := w.deadLetter(letter); err != nil {
+		logrus.Errorf("writing revision %s to the dead letter file: %v", rev, err)
+	}
+}
+
+// sign returns the hex HMAC-SHA256 of a body, receivers compute it with the shared secret
+// to check the X-Org-Chart-Signature header
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver posts a delivery to every webhook, those still failing after retries are written
+// to the dead letter file
+func (w *chartWatcher) deliver(delivery *chartDelivery) {
+
+	body, err := json.Marshal(delivery)
+
+	if err != nil {
+		logrus.Errorf("encoding delivery %s: %v", delivery.ID, err)
+		return
+	}
+
+	for _, webhook := range w.webhooks {
+		err := w.post(webhook, delivery.ID, body)
+
+		if err == nil {
+			continue
+		}
+
+		logrus.Errorf("delivering %s to %s: %v", delivery.ID, webhook, err)
+
+		if err := w.deadLetter(&deadLetter{webhook, time.Now().UTC(), err.Error(), delivery}); err != nil {
+			logrus.Errorf("writing delivery %s to the dead letter file: %v", delivery.ID, err)
+		}
+	}
+}
+
+// post sends a body to a webhook, retrying with a growing delay on network errors, rate
+// limiting and server errors
+func (w *chartWatcher) post(webhook, id string, body []byte) error {
+
+	delay := w.retryDelay
+
+	for attempt := 1; ; attempt++ {
+		retry, err := w.postOnce(webhook, id, body)
+
+		if err == nil || !retry || attempt >= w.attempts {
+			return err
+		}
+
+		logrus.Warnf("delivering %s to %s, attempt %d: %v", id, webhook, attempt, err)
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (w *chartWatcher) postOnce(webhook, id string, body []byte) (bool, error) {
+
+	req, err := http.NewRequest("POST", webhook, bytes.NewReader(body))
+
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Org-Chart-Delivery", id)
+
+	if w.secret != "" {
+		req.Header.Set("X-Org-Chart-Signature", sign(w.secret, body))
+	}
+
+	resp, err := w.client.Do(req)
+
+	if err != nil {
+		return true, err
+	}
+
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+
+	return retry, fmt.Errorf("webhook returned %s", resp.Status)
+}
+
+func (w *chartWatcher) deadLetter(letter *deadLetter) error {
+	if w.deadLetterFile == "" {
+		return errors.New("no dead letter file")
+	}
+
+	b, err := json.Marshal(letter)
+
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(w.deadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCouch serves the revisions of the chart document, oldest first, and a changes feed
+// reporting the revisions in changes in turn before failing
+type fakeCouch struct {
+	mu      sync.Mutex
+	revs    []string
+	charts  map[string]map[string]interface{}
+	missing map[string]bool
+	changes []string
+	since   []string
+}
+
+func newFakeCouch() *fakeCouch {
+	return &fakeCouch{charts: map[string]map[string]interface{}{}, missing: map[string]bool{}}
+}
+
+func (f *fakeCouch) save(rev string, teams, employees []map[string]interface{}) {
+	f.revs = append(f.revs, rev)
+	f.charts[rev] = map[string]interface{}{"_id": "chart", "_rev": rev, "teams": teams, "employees": employees}
+}
+
+func (f *fakeCouch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	notFound := func() {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "not_found", "reason": "missing"})
+	}
+
+	switch r.URL.Path {
+	case "/db":
+		json.NewEncoder(w).Encode(map[string]interface{}{"db_name": "db", "update_seq": fmt.Sprintf("%d-seq", len(f.revs))})
+	case "/db/_changes":
+		f.since = append(f.since, r.URL.Query().Get("since"))
+
+		if len(f.changes) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]string{"error": "unavailable", "reason": "feed closed"})
+			return
+		}
+
+		rev := f.changes[0]
+		f.changes = f.changes[1:]
+		seq := fmt.Sprintf("%d-seq", len(f.since))
+
+		results := []interface{}{}
+
+		if rev != "" {
+			results = append(results, map[string]interface{}{"seq": seq, "id": "chart", "changes": []map[string]string{{"rev": rev}}})
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": results, "last_seq": seq})
+	case "/db/chart":
+		if len(f.revs) == 0 {
+			notFound()
+			return
+		}
+
+		rev := r.URL.Query().Get("rev")
+
+		if rev == "" {
+			rev = f.revs[len(f.revs)-1]
+		}
+
+		chart, ok := f.charts[rev]
+
+		if !ok || f.missing[rev] {
+			notFound()
+			return
+		}
+
+		if r.URL.Query().Get("revs_info") == "true" {
+			info := []map[string]string{}
+
+			for i := len(f.revs) - 1; i >= 0; i-- {
+				status := "available"
+
+				if f.missing[f.revs[i]] {
+					status = "missing"
+				}
+
+				info = append(info, map[string]string{"rev": f.revs[i], "status": status})
+			}
+
+			doc := map[string]interface{}{"_revs_info": info}
+
+			for k, v := range chart {
+				doc[k] = v
+			}
+
+			json.NewEncoder(w).Encode(doc)
+			return
+		}
+
+		json.NewEncoder(w).Encode(chart)
+	default:
+		notFound()
+	}
+}
+
+// fakeWebhook records the deliveries posted to it, answering with statuses in turn and 200
+// once they run out
+type fakeWebhook struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (f *fakeWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+
+	f.requests = append(f.requests, r)
+	f.bodies = append(f.bodies, body)
+
+	if len(f.statuses) > 0 {
+		status := f.statuses[0]
+		f.statuses = f.statuses[1:]
+		w.WriteHeader(status)
+	}
+}
+
+func (f *fakeWebhook) deliveries(t *testing.T) []*chartDelivery {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	deliveries := []*chartDelivery{}
+
+	for _, body := range f.bodies {
+		delivery := &chartDelivery{}
+
+		if err := json.Unmarshal(body, delivery); err != nil {
+			t.Fatal(err)
+		}
+
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries
+}
+
+func readDeadLetters(t *testing.T, file string) []*deadLetter {
+	f, err := os.Open(file)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	letters := []*deadLetter{}
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		letter := &deadLetter{}
+
+		if err := json.Unmarshal(scanner.Bytes(), letter); err != nil {
+			t.Fatal(err)
+		}
+
+		letters = append(letters, letter)
+	}
+
+	return letters
+}
+
+func watchTestWatcher(t *testing.T, location string, webhooks ...string) (*chartWatcher, func()) {
+	dir, err := ioutil.TempDir("", "watch")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &chartWatcher{
+		location:       location,
+		webhooks:       webhooks,
+		secret:         "secret",
+		client:         &http.Client{},
+		feedClient:     &http.Client{},
+		attempts:       3,
+		retryDelay:     time.Millisecond,
+		deadLetterFile: filepath.Join(dir, "dead-letters.jsonl"),
+		stateFile:      filepath.Join(dir, "state.json"),
+	}
+
+	return w, func() { os.RemoveAll(dir) }
+}
+
+func TestChartWatcherSignsDeliveries(t *testing.T) {
+	webhook := &fakeWebhook{}
+	server := httptest.NewServer(webhook)
+	defer server.Close()
+
+	w, cleanup := watchTestWatcher(t, "", server.URL)
+	defer cleanup()
+
+	w.deliver(&chartDelivery{ID: "2-b", Revision: "2-b", PreviousRevision: "1-a", Events: []chartEvent{{Type: eventEmployeeAdded, ID: "bob"}}})
+
+	if len(webhook.requests) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(webhook.requests))
+	}
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(webhook.bodies[0])
+
+	if got, expected := webhook.requests[0].Header.Get("X-Org-Chart-Signature"), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != expected {
+		t.Errorf("unexpected signature %s, expected %s", got, expected)
+	}
+
+	if got := webhook.requests[0].Header.Get("X-Org-Chart-Delivery"); got != "2-b" {
+		t.Errorf("unexpected delivery id %s", got)
+	}
+
+	if deliveries := webhook.deliveries(t); deliveries[0].PreviousRevision != "1-a" || len(deliveries[0].Events) != 1 {
+		t.Errorf("unexpected delivery %+v", deliveries[0])
+	}
+}
+
+func TestChartWatcherRetriesAndDeadLetters(t *testing.T) {
+	tests := []struct {
+		name       string
+		statuses   []int
+		requests   int
+		deadLetter bool
+	}{
+		{"server errors and rate limiting are retried", []int{500, 429, 200}, 3, false},
+		{"client errors are not retried", []int{400}, 1, true},
+		{"retries are bounded", []int{503, 503, 503, 503}, 3, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			webhook := &fakeWebhook{statuses: test.statuses}
+			server := httptest.NewServer(webhook)
+			defer server.Close()
+
+			w, cleanup := watchTestWatcher(t, "", server.URL)
+			defer cleanup()
+
+			w.deliver(&chartDelivery{ID: "2-b", Revision: "2-b", Events: []chartEvent{}})
+
+			if len(webhook.requests) != test.requests {
+				t.Errorf("expected %d requests, got %d", test.requests, len(webhook.requests))
+			}
+
+			letters := readDeadLetters(t, w.deadLetterFile)
+
+			if !test.deadLetter {
+				if len(letters) != 0 {
+					t.Errorf("unexpected dead letters %+v", letters)
+				}
+				return
+			}
+
+			if len(letters) != 1 {
+				t.Fatalf("expected 1 dead letter, got %d", len(letters))
+			}
+
+			if letters[0].URL != server.URL || letters[0].Delivery.ID != "2-b" || letters[0].Error == "" {
+				t.Errorf("unexpected dead letter %+v", letters[0])
+			}
+		})
+	}
+}
+
+func TestChartWatcherResumesAndSkipsRevisionsFailingToLoad(t *testing.T) {
+	teams := []map[string]interface{}{
+		{"id": "tribe", "name": "Tribe"},
+		{"id": "squad", "name": "Squad", "parent": "tribe"},
+	}
+	alice := map[string]interface{}{"id": "alice", "name": "Alice", "memberOf": "squad"}
+	bob := map[string]interface{}{"id": "bob", "name": "Bob", "memberOf": "squad"}
+	carol := map[string]interface{}{"id": "carol", "name": "Carol", "memberOf": "tribe"}
+
+	couchdb := newFakeCouch()
+	couchdb.save("1-a", teams, []map[string]interface{}{alice})
+	couchdb.save("2-b", teams, []map[string]interface{}{alice, bob})
+	couchdb.save("3-c", teams, []map[string]interface{}{alice, bob, carol})
+	couchdb.save("4-d", teams, []map[string]interface{}{bob, carol})
+	couchdb.missing["3-c"] = true
+	couchdb.changes = []string{"2-b", "", "3-c", "4-d"}
+
+	couch := httptest.NewServer(couchdb)
+	defer couch.Close()
+
+	webhook := &fakeWebhook{}
+	server := httptest.NewServer(webhook)
+	defer server.Close()
+
+	w, cleanup := watchTestWatcher(t, couch.URL+"/db", server.URL)
+	defer cleanup()
+
+	w.attempts = 1
+
+	// the watch stopped at the first revision, the changes made since are still delivered
+	if err := w.saveState(&watchState{Seq: "5-seq", Rev: "1-a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.run(); err == nil || !strings.Contains(err.Error(), "following changes") {
+		t.Fatalf("expected the watch to stop on the failing feed, got %v", err)
+	}
+
+	if expected := []string{"5-seq", "1-seq", "2-seq", "3-seq", "4-seq", "4-seq"}; !reflect.DeepEqual(couchdb.since, expected) {
+		t.Errorf("unexpected sequences %v, expected %v", couchdb.since, expected)
+	}
+
+	deliveries := webhook.deliveries(t)
+
+	if len(deliveries) != 2 {
+		t.Fatalf("expected 2 deliveries, got %d", len(deliveries))
+	}
+
+	if d := deliveries[0]; d.Revision != "2-b" || d.PreviousRevision != "1-a" || !reflect.DeepEqual(d.Events, []chartEvent{{Type: eventEmployeeAdded, ID: "bob", Name: "Bob", Team: "squad"}}) {
+		t.Errorf("unexpected delivery %+v", d)
+	}
+
+	// the revision which couldn't be loaded is covered by the one after it
+	expected := []chartEvent{
+		{Type: eventEmployeeAdded, ID: "carol", Name: "Carol", Team: "tribe"},
+		{Type: eventEmployeeRemoved, ID: "alice", Name: "Alice", Team: "squad"},
+	}
+
+	if d := deliveries[1]; d.Revision != "4-d" || d.PreviousRevision != "2-b" || !reflect.DeepEqual(d.Events, expected) {
+		t.Errorf("unexpected delivery %+v", d)
+	}
+
+	letters := readDeadLetters(t, w.deadLetterFile)
+
+	if len(letters) != 1 {
+		t.Fatalf("expected 1 dead letter, got %d", len(letters))
+	}
+
+	if l := letters[0]; l.URL != "" || l.Delivery.Revision != "3-c" || l.Delivery.PreviousRevision != "2-b" || !strings.Contains(l.Error, "3-c") {
+		t.Errorf("unexpected dead letter %+v", l)
+	}
+
+	state, err := w.loadState()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := (&watchState{Seq: "4-seq", Rev: "4-d"}); !reflect.DeepEqual(state, expected) {
+		t.Errorf("unexpected state %+v, expected %+v", state, expected)
+	}
+}
@@ -370,6 +370,8 @@ class AddPersonDialog extends React.Component {
         stream: Object.keys(STREAM)[0],
         reportsTo: null,
         github: "",
+        slack: "",
+        email: "",
         number: "",
         type: TYPE.EMPLOYEE,
         startDate: "",
@@ -386,6 +388,8 @@ class AddPersonDialog extends React.Component {
             name: "",
             title: "",
             github: "",
+            slack: "",
+            email: "",
             number: "",
             stream: Object.keys(STREAM)[0],
             reportsTo: null,
@@ -402,16 +406,16 @@ class AddPersonDialog extends React.Component {
     };
 
     submit = () => {
-        const {id, name, title, stream, reportsTo, number, github, type, startDate} = this.state
+        const {id, name, title, stream, reportsTo, number, github, type, startDate, email, slack} = this.state
 
         if (!name || !title || !stream || !type) {
             return
         }
 
         if (id) {
-            this.props.editEmployee(id, name, title, stream, reportsTo, number, github, startDate, type);
+            this.props.editEmployee(id, name, title, stream, reportsTo, number, github, startDate, type, email, slack);
         } else {
-            this.props.addEmployee(name, title, stream, reportsTo, number, github, startDate, type);
+            this.props.addEmployee(name, title, stream, reportsTo, number, github, startDate, type, email, slack);
         }
 
         this.handleClose()
@@ -474,6 +478,14 @@ class AddPersonDialog extends React.Component {
                     this.setState({github: val})
                 }} value={this.state.github}/><br/>
 
+                <TextField floatingLabelText={"Email"} onChange={(_, val) => {
+                    this.setState({email: val})
+                }} value={this.state.email}/><br/>
+
+                <TextField floatingLabelText={"Slack"} onChange={(_, val) => {
+                    this.setState({slack: val})
+                }} value={this.state.slack}/><br/>
+
                 <TextField floatingLabelText={"Employee #"} onChange={(_, val) => {
                     this.setState({number: val})
                 }} value={this.state.number}/><br/>
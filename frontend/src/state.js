@@ -28,7 +28,7 @@ export let TYPE = {
 }
 
 class Employee {
-    constructor(id, name, title, reportsTo, memberOf, stream, number, github, startDate, type) {
+    constructor(id, name, title, reportsTo, memberOf, stream, number, github, startDate, type, email, slack) {
         this.id = id
         this.name = name
         this.title = title
@@ -39,6 +39,8 @@ class Employee {
         this.github = github
         this.startDate = startDate || ""
         this.type = type || TYPE.EMPLOYEE
+        this.email = email || ""
+        this.slack = slack || ""
     }
 }
 
@@ -325,6 +327,9 @@ class Organisation {
                 kinds: Object.values(KIND),
                 types: Object.values(TYPE),
                 rootEmployee: this.rootEmployee,
+                // couchdb doesn't time saves, the admin UI talks to it directly so this is the
+                // clock of the browser saving the chart and only as right as that is
+                updatedAt: new Date().toISOString(),
             },
             this.documentRevision,
         )
@@ -417,11 +422,11 @@ class Organisation {
         this.teams = this.teams.filter(t => t.id !== team)
     }
 
-    addEmployee(name, title, stream, reportsTo, employee, github, startDate, type) {
-        this.employees.push(new Employee(makeEmployeeId(name), name, title, reportsTo, undefined, stream, employee, github, startDate === "" ? null : startDate, type))
+    addEmployee(name, title, stream, reportsTo, employee, github, startDate, type, email, slack) {
+        this.employees.push(new Employee(makeEmployeeId(name), name, title, reportsTo, undefined, stream, employee, github, startDate === "" ? null : startDate, type, email, slack))
     }
 
-    editEmployee(id, name, title, stream, reportsTo, employeeNumber, github, startDate, type) {
+    editEmployee(id, name, title, stream, reportsTo, employeeNumber, github, startDate, type, email, slack) {
         const employee = this.employees.find(e => e.id === id)
 
         employee.name = name
@@ -432,6 +437,8 @@ class Organisation {
         employee.github = github
         employee.startDate = startDate === "" ? null : startDate
         employee.type = type
+        employee.email = email
+        employee.slack = slack
 
     }
 
@@ -4,6 +4,7 @@ go 1.13
 
 require (
 	cloud.google.com/go/bigquery v1.3.0
+	github.com/go-ldap/ldap/v3 v3.4.6
 	github.com/google/go-github v17.0.0+incompatible
 	github.com/google/go-querystring v1.0.0
 	github.com/jszwec/csvutil v1.4.0
@@ -13,4 +14,5 @@ require (
 	github.com/urfave/cli v1.22.2
 	golang.org/x/oauth2 v0.0.0-20191202225959-858c2ad4c8b6
 	google.golang.org/api v0.13.0
+	gopkg.in/yaml.v3 v3.0.1
 )